@@ -23,3 +23,10 @@ sysctl -w net.bridge.bridge-nf-call-arpables=1
 iptables -t nat -A POSTROUTING -o eno1 -s 10.0.0.0/16 -j MASQUERADE
 iptables -A FORWARD -i fire0 -o eno1 -j ACCEPT
 iptables -A FORWARD -i eno1 -o fire0 -m state --state RELATED,ESTABLISHED -j ACCEPT
+
+# Tenant isolation. host_daemon keeps this chain filled with rules that let
+# guests reach only guests of their own tenant. Until it does, no guest reaches
+# any other.
+iptables -N FC-TENANTS 2>/dev/null || iptables -F FC-TENANTS
+iptables -A FC-TENANTS -m physdev --physdev-is-bridged -j DROP
+iptables -C FORWARD -j FC-TENANTS 2>/dev/null || iptables -I FORWARD 1 -j FC-TENANTS
@@ -46,35 +46,14 @@ rm -fr /var/lib/apt/lists/*
 #echo "nameserver 8.8.8.8" > /etc/resolv.conf
 
 
-SCRIPT_DIR="/usr/local/bin"
-SCRIPT_PATH="$SCRIPT_DIR/setupnetwork.sh"
-SERVICE_NAME="setupnetwork.service"
+# Network setup is done at boot by guest_network, which must already have
+# been copied into /usr/local/bin. It reads the address, gateway, DNS and
+# hostname from MMDS, and falls back to deriving the address from the MAC.
+# This replaces the old setupnetwork.sh, so network changes no longer
+# require rebuilding images.
+SCRIPT_PATH="/usr/local/bin/guest_network"
+SERVICE_NAME="guestnetwork.service"
 
-# shell MUST be bash because of the substitutions used
-cat << 'EOF' | tee "$SCRIPT_PATH" > /dev/null
-#!/bin/bash
-INTERFACE="eth0"
-MAC=$(ip link show "$INTERFACE" | awk '/ether/ {print $2}' | tr -d ':')
-if [ -z "$MAC" ] || [ ${#MAC} -ne 12 ]; then
-    echo "Error: Could not read a valid MAC address from $INTERFACE"
-    exit 1
-fi
-LAST4="${MAC: -8}"
-A=$((16#${LAST4:0:2}))
-B=$((16#${LAST4:2:2}))
-C=$((16#${LAST4:4:2}))
-D=$((16#${LAST4:6:2}))
-IP="$A.$B.$C.$D"
-echo "MAC $MAC  →  last 4 octets $LAST4  →  IP $IP"
-ip addr flush dev "$INTERFACE" 2>/dev/null
-ip addr add "$IP/16" dev "$INTERFACE"
-ip link set "$INTERFACE" up
-ip ro add default via 10.0.0.1
-echo "127.0.0.1 localhost" > /etc/hosts
-EOF
-
-chmod +x "$SCRIPT_PATH"
-chmod 0700 "$SCRIPT_DIR"
 chmod 0700 "$SCRIPT_PATH"
 
 # --- 2. Create the systemd service ---
@@ -96,76 +75,36 @@ EOF
 systemctl enable "$SERVICE_NAME"
 
 echo "Service $SERVICE_NAME created and enabled."
-echo "Startup script located at $SCRIPT_PATH"
-
-
-
-
 
 
 
 
-# setup the guest daemon. OBSOLETE.
 
-#GUEST_DAEMON_SERVICE_NAME="guestdaemon.service"
-#cat << EOF | tee "/etc/systemd/system/$GUEST_DAEMON_SERVICE_NAME" > /dev/null
-#[Unit]
-#Description=Guest Daemon Service
-#After=setupnetwork.service
-#Requires=setupnetwork.service
-#
-#[Service]
-#ExecStart=/usr/local/bin/guest_daemon
-#Restart=always
-#RestartSec=1
-#StopSignal=SIGTERM
-#
-#[Install]
-#WantedBy=multi-user.target
-#EOF
 
-#systemctl enable "$GUEST_DAEMON_SERVICE_NAME"
 
 
+# setup the guest daemon and the guest-sentences daemon. Their unit files ship
+# with them (guest_daemon/guest_daemon.service, guest_sentences/guest_sentences.service)
+# and have been copied into /etc/systemd/system.
 
-# setup the guest-sentences daemon
-
-GUEST_SENTENCES_SERVICE_NAME="guestsentences.service"
-cat << EOF | tee "/etc/systemd/system/$GUEST_SENTENCES_SERVICE_NAME" > /dev/null
-[Unit]
-Description=Guest Sentences Service
-After=setupnetwork.service
-Requires=setupnetwork.service
-
-[Service]
-ExecStart=/usr/local/bin/guest_sentences
-Restart=always
-RestartSec=1
-StopSignal=SIGTERM
-
-[Install]
-WantedBy=multi-user.target
-EOF
-
-systemctl enable "$GUEST_SENTENCES_SERVICE_NAME"
+systemctl enable guest_daemon.service
+systemctl enable guest_sentences.service
 
 
 
 
 
 # setup the identity file (needs to be edited for each instance)
-# Leave this in for now although it's not currently used.
+# The guest binaries only read this as a last resort, after MMDS and the
+# kernel command line, which is where the host puts the real identity.
 # Personalizing it per-agent is a pain because of the need to mount
 # it loopback.
-# The agent-id value and slot number are passed in through firecracker
-# as Linux boot parameter, and the other parms aren't as critical
+# There is deliberately no agent id in the template: an unpersonalized
+# image must not claim to be some particular agent.
 
 mkdir -p /.ngen
 cat << EOF | tee "/.ngen/.id" > /dev/null
 {
- "host":"1000",
- "agent":"1000",
- "slot":1000,
  "nats-server":"nats://192.168.0.225:4222"
 }
 EOF
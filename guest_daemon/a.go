@@ -1,100 +1,131 @@
 package main
 
+/* Runs in each guest: answers operators' requests on the agent's subject, to
+ * run commands (exec.go) and move files in and out (files.go), keeps root's
+ * authorized_keys in step with MMDS (ssh_keys.go), and tells whoever is
+ * listening how the guest is doing (heartbeat.go).
+ *
+ * On SIGTERM or SIGINT, as at poweroff, we stop taking requests, stop the
+ * commands and transfers in progress, drain NATS and exit, within
+ * SHUTDOWN_TIMEOUT. A second signal kills us straight away.
+ */
+
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/nats-io/nats.go"
+	"guest_mmds"
 	"log"
-	"os"
-	"strings"
+	"nats_connect"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	cfg struct {
-		Host       string `json:"host"`
-		Agent      string `json:"agent"`
-		Slot       int    `json:"slot"`
-		NatsServer string `json:"nats-server"`
-	}
-)
-
-// read_config
-func read_config() error {
-	w := func(f string) error {
-		if d, e := os.ReadFile(f); e == nil {
-			if e := json.Unmarshal(d, &cfg); e == nil {
-				return nil
-			} else {
-				return e
-			}
-		} else {
-			return e
-		}
-	}
+	id  *guest_mmds.Identity
+	cfg *guest_mmds.Config
+	nc  *nats.Conn
 
-	// production
-	if e := w("/.ngen/.id"); e == nil {
-		return e
-	}
-	// testing
-	return w("./.id")
-}
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+)
 
 // main
 func main() {
-	log.Printf("Guest Daemon")
+	log.Printf("Guest Daemon %s", version())
 	log.Printf("NEXGENOMICS, Inc.")
 
-	if e := read_config(); e != nil {
-		log.Printf("config failed: %s", e)
-		//os.Exit(-1)
-	}
-
-	cfg.Agent = getCmdlineValue("agent")
-	if cfg.NatsServer == "" {
-		cfg.NatsServer = "nats://192.168.0.225:4222"
+	var e error
+	if id, cfg, e = guest_mmds.Load(); e != nil {
+		log.Fatalf("config failed: %s", e)
 	}
 
-	log.Printf("%s", cfg)
+	log.Printf("agent %s (from %s), tenant %s, host %s, slot %d, nats %s",
+		id.Agent, id.Source, id.Tenant, id.Host, id.Slot, cfg.NatsServer)
 
-	if e := read_nats(); e != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if e := read_nats(ctx, stop); e != nil {
 		log.Printf("nats error %s", e)
 	}
 }
 
-// read_nats
-func read_nats() error {
-	nc, e := nats.Connect(cfg.NatsServer)
+// read_nats serves until ctx is cancelled, then shuts down. stop lets a second
+// signal through.
+func read_nats(ctx context.Context, stop context.CancelFunc) error {
+	var e error
+	nc, e = guest_mmds.Connect(id, cfg, "guest_daemon")
 	if e != nil {
 		return e
 	}
-	defer nc.Drain()
 
-	if _, e := nc.Subscribe(fmt.Sprintf("firecracker.agent.%s", cfg.Agent), nats_handler); e != nil {
+	if _, e := nc.Subscribe(fmt.Sprintf("firecracker.agent.%s.%s", id.Tenant, id.Agent), nats_handler(ctx)); e != nil {
+		nc.Close()
 		return e
 	}
 
-	select {}
+	var wg sync.WaitGroup
+	wg.Go(func() { sync_ssh_keys_loop(ctx) })
+	wg.Go(func() { heartbeat_loop(ctx) })
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down")
+	wg.Go(close_sessions)
+	deadline := time.Now().Add(SHUTDOWN_TIMEOUT)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("gave up waiting for work in progress after %s", SHUTDOWN_TIMEOUT)
+	}
+	if e := nats_connect.Drain(nc, max(time.Until(deadline), time.Second)); e != nil {
+		return e
+	}
+	log.Printf("stopped")
 	return nil
 }
 
-// getCmdlineValue
-func getCmdlineValue(key string) string {
-	data, err := os.ReadFile("/proc/cmdline")
-	if err != nil {
-		return ""
-	}
-	parts := strings.Fields(string(data))
-	for _, p := range parts {
-		if strings.HasPrefix(p, key+"=") {
-			return strings.TrimPrefix(p, key+"=")
+// nats_handler answers requests on the agent's subject. They're JSON with a
+// "type" field. Whatever they start runs until ctx is cancelled at the latest.
+func nats_handler(ctx context.Context) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		var t struct {
+			Type string `json:"type"`
+		}
+		if e := json.Unmarshal(msg.Data, &t); e != nil {
+			respond(msg, map[string]any{"ok": false, "error": fmt.Sprintf("bad request: %s", e)})
+			return
+		}
+		switch t.Type {
+		case "exec":
+			respond(msg, handle_exec(ctx, msg))
+		case "put", "get":
+			respond(msg, handle_file(ctx, msg))
+		default:
+			respond(msg, map[string]any{"ok": false, "error": fmt.Sprintf("unknown request type %q", t.Type)})
 		}
 	}
-	return ""
 }
 
-// nats_handler
-func nats_handler(msg *nats.Msg) {
-	log.Printf("I got a rock. %s", cfg.Agent)
-	msg.Respond([]byte(fmt.Sprintf("Hi! I'm %s. You said %s", cfg.Agent, string(msg.Data))))
+// respond sends v back as JSON, signed, if anyone's waiting for it.
+func respond(msg *nats.Msg, v any) {
+	if msg.Reply == "" {
+		return
+	}
+	j, _ := json.Marshal(v)
+	m := &nats.Msg{Subject: msg.Reply, Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("failed to sign reply: %s", e)
+		return
+	}
+	if e := msg.RespondMsg(m); e != nil {
+		log.Printf("failed to reply: %s", e)
+	}
 }
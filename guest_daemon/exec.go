@@ -0,0 +1,511 @@
+package main
+
+/* Remote exec, so operators can debug an agent without SSH keys and tunnels.
+ *
+ * A request on the agent's subject, signed with an operator key the host lists
+ * for us in MMDS under "exec-keys" (see guest_identity.SignOperatorMsg), runs a
+ * command:
+ *
+ *   {"type":"exec","id":"d41f09c2","command":"/bin/sh","args":["-c","ls /"],
+ *    "env":["FOO=1"],"cwd":"/tmp","timeout":"30s","stdin":true,"pty":false}
+ *
+ *   {"ok":true,"id":"d41f09c2","output":"firecracker.exec.<tenant>.<agent>.d41f09c2.out",
+ *    "input":"firecracker.exec.<tenant>.<agent>.d41f09c2.in"}
+ *
+ * The output subject follows from the id, so subscribe to it before sending the
+ * request. Output comes in chunks, signed by us and numbered from 1 so a gap
+ * shows, and the exit message is always last:
+ *
+ *   {"seq":1,"stream":"stdout","data":"<base64>"}
+ *   {"seq":5,"stream":"error","error":"stdin is full, dropped input 9"}
+ *   {"seq":7,"stream":"exit","status":0}
+ *
+ * On the input subject, each message signed with the same operator key and
+ * with seq going up:
+ *
+ *   {"seq":1,"type":"stdin","data":"<base64>"}
+ *   {"seq":2,"type":"eof"}
+ *   {"seq":3,"type":"resize","rows":50,"cols":120}
+ *   {"seq":4,"type":"cancel"}
+ *
+ * Stdin and eof are queued, up to EXEC_STDIN_QUEUE of them, and written in
+ * order by the session's own goroutine, so a command that stops reading can't
+ * hold up a cancel. Input that doesn't fit, or can't be written, is dropped
+ * with an "error" message.
+ *
+ * With "pty", the command gets a terminal, stdout and stderr both come back as
+ * stdout, and stdin is always open. The command runs in its own process group.
+ * Cancelling, the timeout, or our own shutdown sends the group SIGTERM, and
+ * SIGKILL EXEC_KILL_GRACE later; anything left in the group when the command
+ * exits is killed too.
+ *
+ * Every request we start, finish or turn away is logged and reported to the
+ * host as an "exec" audit event.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"guest_identity"
+	"guest_mmds"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	EXEC_MAX_SESSIONS    = 8
+	EXEC_DEFAULT_TIMEOUT = 10 * time.Minute
+	EXEC_MAX_TIMEOUT     = time.Hour
+	EXEC_KILL_GRACE      = 5 * time.Second
+	EXEC_CHUNK           = 32 * 1024
+	EXEC_STDIN_QUEUE     = 64
+)
+
+var (
+	exec_id_re = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+	ERR_EXEC_TIMEOUT = errors.New("timed out")
+)
+
+// exec_request
+type exec_request struct {
+	Type    string   `json:"type"`
+	Id      string   `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Env     []string `json:"env"`
+	Cwd     string   `json:"cwd"`
+	Timeout string   `json:"timeout"`
+	Stdin   bool     `json:"stdin"`
+	Pty     bool     `json:"pty"`
+	Rows    uint16   `json:"rows"`
+	Cols    uint16   `json:"cols"`
+}
+
+// exec_reply
+type exec_reply struct {
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Id     string `json:"id,omitempty"`
+	Output string `json:"output,omitempty"`
+	Input  string `json:"input,omitempty"`
+}
+
+// exec_output is one message on the output subject. Status is only set on exit.
+type exec_output struct {
+	Seq    uint64 `json:"seq"`
+	Stream string `json:"stream"` // stdout, stderr, error or exit
+	Data   []byte `json:"data,omitempty"`
+	Status *int   `json:"status,omitempty"`
+	Signal string `json:"signal,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// exec_input is one message on the input subject.
+type exec_input struct {
+	Seq  uint64 `json:"seq"`
+	Type string `json:"type"` // stdin, eof, resize or cancel
+	Data []byte `json:"data"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// exec_audit is the event we send to the host.
+type exec_audit struct {
+	Type     string    `json:"type"`
+	Agent    string    `json:"agent"`
+	Tenant   string    `json:"tenant"`
+	Action   string    `json:"action"` // started, finished, failed or rejected
+	Id       string    `json:"id"`
+	Operator string    `json:"operator,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Args     []string  `json:"args,omitempty"`
+	Cwd      string    `json:"cwd,omitempty"`
+	Pty      bool      `json:"pty,omitempty"`
+	Status   int       `json:"status"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// exec_session is one running command.
+type exec_session struct {
+	req      exec_request
+	key      string
+	operator string
+	output   string
+	input    string
+
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	cmd     *exec.Cmd
+	sub     *nats.Subscription
+	stdin   io.WriteCloser
+	stdin_q chan exec_input // stdin and eof, for write_stdin
+	pty     *os.File
+	copied  chan struct{}
+	ready   chan struct{}
+	started time.Time
+
+	mu     sync.Mutex
+	seq    uint64
+	in_seq uint64
+}
+
+// handle_exec checks an exec request and starts the command.
+func handle_exec(ctx context.Context, m *nats.Msg) exec_reply {
+	req := exec_request{}
+	if e := json.Unmarshal(m.Data, &req); e != nil {
+		return exec_reply{Error: fmt.Sprintf("bad request: %s", e)}
+	}
+	key, operator := "", ""
+	fail := func(action string, e error) exec_reply {
+		audit_exec(exec_audit{Action: action, Id: req.Id, Operator: operator, Key: key, Command: req.Command, Args: req.Args, Error: e.Error()})
+		return exec_reply{Error: e.Error(), Id: req.Id}
+	}
+
+	key, operator, e := operator_key(m)
+	if e != nil {
+		return fail("rejected", e)
+	}
+	timeout, e := check_exec_request(&req)
+	if e != nil {
+		return fail("rejected", e)
+	}
+	s := &exec_session{
+		req:      req,
+		key:      key,
+		operator: operator,
+		output:   fmt.Sprintf("firecracker.exec.%s.%s.%s.out", id.Tenant, id.Agent, req.Id),
+		input:    fmt.Sprintf("firecracker.exec.%s.%s.%s.in", id.Tenant, id.Agent, req.Id),
+	}
+	if e := claim_session(req.Id, "exec", EXEC_MAX_SESSIONS); e != nil {
+		return fail("rejected", e)
+	}
+
+	if e := s.start(ctx, timeout); e != nil {
+		release_session(req.Id)
+		return fail("failed", e)
+	}
+	s.audit("started", exec_audit{})
+	go s.wait()
+	return exec_reply{Ok: true, Id: req.Id, Output: s.output, Input: s.input}
+}
+
+// check_exec_request fills in the defaults and returns the timeout.
+func check_exec_request(req *exec_request) (time.Duration, error) {
+	if !exec_id_re.MatchString(req.Id) {
+		return 0, fmt.Errorf("id must be 8 to 64 letters, digits, - or _")
+	}
+	if req.Command == "" {
+		return 0, fmt.Errorf("no command")
+	}
+	for _, kv := range req.Env {
+		if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+			return 0, fmt.Errorf("bad env entry %q", kv)
+		}
+	}
+	if req.Cwd == "" {
+		req.Cwd = "/"
+	}
+	if req.Pty {
+		req.Stdin = true
+	}
+	timeout := EXEC_DEFAULT_TIMEOUT
+	if req.Timeout != "" {
+		d, e := time.ParseDuration(req.Timeout)
+		if e != nil || d <= 0 {
+			return 0, fmt.Errorf("bad timeout %q", req.Timeout)
+		}
+		timeout = d
+	}
+	return min(timeout, EXEC_MAX_TIMEOUT), nil
+}
+
+// start subscribes to the input subject and starts the command. Input waits
+// until the command has started, or failed to.
+func (s *exec_session) start(ctx context.Context, timeout time.Duration) error {
+	s.ready = make(chan struct{})
+	defer close(s.ready)
+	s.ctx, s.cancel = context.WithCancelCause(ctx)
+	cmd := exec.CommandContext(s.ctx, s.req.Command, s.req.Args...)
+	cmd.Dir = s.req.Cwd
+	cmd.Env = append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}, os.Environ()...)
+	if s.req.Pty {
+		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	}
+	cmd.Env = append(cmd.Env, s.req.Env...)
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) }
+	cmd.WaitDelay = EXEC_KILL_GRACE
+	s.cmd = cmd
+
+	s.stdin_q = make(chan exec_input, EXEC_STDIN_QUEUE)
+	var e error
+	if s.sub, e = nc.Subscribe(s.input, s.handle_input); e != nil {
+		s.cancel(e)
+		return e
+	}
+	if s.req.Pty {
+		e = s.start_pty()
+	} else {
+		e = s.start_pipes()
+	}
+	if e != nil {
+		s.sub.Unsubscribe()
+		s.cancel(e)
+		return e
+	}
+	s.started = time.Now()
+	s.timer = time.AfterFunc(timeout, func() { s.cancel(ERR_EXEC_TIMEOUT) })
+	if s.stdin != nil {
+		go s.write_stdin()
+	}
+	return nil
+}
+
+// start_pipes runs the command with its output going straight to us, in its own
+// process group.
+func (s *exec_session) start_pipes() error {
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	s.cmd.Stdout = &exec_writer{s, "stdout"}
+	s.cmd.Stderr = &exec_writer{s, "stderr"}
+	if s.req.Stdin {
+		w, e := s.cmd.StdinPipe()
+		if e != nil {
+			return e
+		}
+		s.stdin = w
+	}
+	return s.cmd.Start()
+}
+
+// start_pty runs the command in a new session on a new terminal, and copies the
+// terminal's output to us until the command and everything it left behind have
+// let go of it.
+func (s *exec_session) start_pty() error {
+	master, tty, e := open_pty()
+	if e != nil {
+		return e
+	}
+	defer tty.Close()
+	if s.req.Rows > 0 && s.req.Cols > 0 {
+		if e := set_pty_size(master, s.req.Rows, s.req.Cols); e != nil {
+			log.Printf("exec %s: setting the terminal size: %s", s.req.Id, e)
+		}
+	}
+	s.cmd.Stdin, s.cmd.Stdout, s.cmd.Stderr = tty, tty, tty
+	s.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if e := s.cmd.Start(); e != nil {
+		master.Close()
+		return e
+	}
+	s.pty, s.stdin = master, master
+	s.copied = make(chan struct{})
+	go func() {
+		defer close(s.copied)
+		io.Copy(&exec_writer{s, "stdout"}, master)
+	}()
+	return nil
+}
+
+// wait sees the command out: it sends the exit message and the audit event.
+func (s *exec_session) wait() {
+	defer release_session(s.req.Id)
+	e := s.cmd.Wait()
+	s.timer.Stop()
+	syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+	if s.pty != nil {
+		select {
+		case <-s.copied:
+		case <-time.After(EXEC_KILL_GRACE):
+		}
+		s.pty.Close()
+		<-s.copied
+	}
+	s.sub.Unsubscribe()
+
+	cause := context.Cause(s.ctx)
+	s.cancel(nil)
+	status, signal := -1, ""
+	if s.cmd.ProcessState != nil {
+		if ws, ok := s.cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				signal = ws.Signal().String()
+			} else {
+				status = ws.ExitStatus()
+			}
+		}
+	}
+	msg := ""
+	switch {
+	case cause == ERR_EXEC_TIMEOUT || cause == ERR_CANCELLED:
+		msg = cause.Error()
+	case cause != nil:
+		msg = "guest_daemon is shutting down"
+	case e != nil && !errors.As(e, new(*exec.ExitError)):
+		msg = e.Error()
+	}
+
+	s.publish(exec_output{Stream: "exit", Status: &status, Signal: signal, Error: msg})
+	s.audit("finished", exec_audit{
+		Status:   status,
+		Signal:   signal,
+		Error:    msg,
+		Duration: time.Since(s.started).Round(time.Millisecond).String(),
+	})
+}
+
+// handle_input takes stdin, resizes and cancellation from the operator who
+// started the command. Stdin and eof go to write_stdin, since writing them can
+// block for as long as the command doesn't read.
+func (s *exec_session) handle_input(m *nats.Msg) {
+	<-s.ready
+	if _, e := guest_identity.VerifyOperatorMsg(m, []string{s.key}); e != nil {
+		log.Printf("exec %s: ignoring input: %s", s.req.Id, e)
+		return
+	}
+	in := exec_input{}
+	if e := json.Unmarshal(m.Data, &in); e != nil {
+		log.Printf("exec %s: bad input: %s", s.req.Id, e)
+		return
+	}
+	if in.Seq <= s.in_seq {
+		log.Printf("exec %s: ignoring input %d, already had %d", s.req.Id, in.Seq, s.in_seq)
+		return
+	}
+	s.in_seq = in.Seq
+
+	switch in.Type {
+	case "stdin", "eof":
+		if s.stdin == nil {
+			return
+		}
+		select {
+		case s.stdin_q <- in:
+		default:
+			s.input_error(fmt.Errorf("stdin is full, dropped input %d", in.Seq))
+		}
+	case "resize":
+		if s.pty != nil && in.Rows > 0 && in.Cols > 0 {
+			if e := set_pty_size(s.pty, in.Rows, in.Cols); e != nil {
+				s.input_error(fmt.Errorf("input %d: setting the terminal size: %w", in.Seq, e))
+			}
+		}
+	case "cancel":
+		log.Printf("exec %s: cancelled by %s", s.req.Id, s.operator)
+		s.cancel(ERR_CANCELLED)
+	default:
+		log.Printf("exec %s: unknown input type %q", s.req.Id, in.Type)
+	}
+}
+
+// write_stdin writes the queued stdin and eof to the command, in order, until
+// the session ends. Once the command has exited, wait closes the pipe or the
+// terminal, which ends a write that's stuck.
+func (s *exec_session) write_stdin() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case in := <-s.stdin_q:
+			var e error
+			switch {
+			case in.Type == "stdin":
+				_, e = s.stdin.Write(in.Data)
+			case s.pty != nil:
+				// The terminal's end-of-file character, as if typed.
+				_, e = s.pty.Write([]byte{4})
+			default:
+				e = s.stdin.Close()
+			}
+			if e != nil {
+				s.input_error(fmt.Errorf("input %d: %w", in.Seq, e))
+			}
+		}
+	}
+}
+
+// input_error tells the operator, and our log, that some input didn't get to
+// the command.
+func (s *exec_session) input_error(e error) {
+	log.Printf("exec %s: %s", s.req.Id, e)
+	s.publish(exec_output{Stream: "error", Error: e.Error()})
+}
+
+// publish sends the next output message.
+func (s *exec_session) publish(out exec_output) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	out.Seq = s.seq
+	j, _ := json.Marshal(out)
+	m := &nats.Msg{Subject: s.output, Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("exec %s: failed to sign output: %s", s.req.Id, e)
+		return
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		log.Printf("exec %s: failed to send output: %s", s.req.Id, e)
+	}
+}
+
+// audit reports what happened to the session, with its request filled in.
+func (s *exec_session) audit(action string, a exec_audit) {
+	a.Action, a.Id, a.Operator, a.Key = action, s.req.Id, s.operator, s.key
+	a.Command, a.Args, a.Cwd, a.Pty = s.req.Command, s.req.Args, s.req.Cwd, s.req.Pty
+	audit_exec(a)
+}
+
+// exec_writer sends what it's given as output, in chunks of at most EXEC_CHUNK.
+// It never fails, so the command doesn't notice if we can't deliver.
+type exec_writer struct {
+	s      *exec_session
+	stream string
+}
+
+// Write
+func (w *exec_writer) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += EXEC_CHUNK {
+		w.s.publish(exec_output{Stream: w.stream, Data: p[i:min(i+EXEC_CHUNK, len(p))]})
+	}
+	return len(p), nil
+}
+
+// audit_exec logs an exec event and reports it to the host.
+func audit_exec(a exec_audit) {
+	switch {
+	case a.Error != "":
+		log.Printf("AUDIT exec %s %s: %s %s %q: %s", a.Id, a.Action, a.Operator, a.Command, a.Args, a.Error)
+	case a.Action == "finished":
+		log.Printf("AUDIT exec %s %s: %s %s %q, status %d %s", a.Id, a.Action, a.Operator, a.Command, a.Args, a.Status, a.Signal)
+	default:
+		log.Printf("AUDIT exec %s %s: %s %s %q", a.Id, a.Action, a.Operator, a.Command, a.Args)
+	}
+
+	if nc == nil || id.Host == "" {
+		return
+	}
+	a.Type, a.Agent, a.Tenant, a.Time = "exec", id.Agent, id.Tenant, time.Now().UTC()
+	j, _ := json.Marshal(a)
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.host.%s", id.Host), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("failed to sign exec audit: %s", e)
+		return
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		log.Printf("failed to report exec audit: %s", e)
+	}
+}
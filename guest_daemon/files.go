@@ -0,0 +1,682 @@
+package main
+
+/* File transfers, so operators can put model weights and config into a running
+ * guest, and get logs and core dumps out, without SSH or touching the rootfs.
+ *
+ * Like exec, requests come on the agent's subject, signed with an operator key
+ * (see sessions.go). Where files may go and come from, and how big they may
+ * be, is up to the host, in MMDS under "files":
+ *
+ *   {"put":["/opt/models","/etc/agent"],"get":["/var/log","/var/crash"],"max-size":10737418240}
+ *
+ * Without it, there are no transfers. Paths are checked after resolving
+ * symlinks, so a link can't lead out of the allowed directories.
+ *
+ * A put says how big the file is and what its SHA-256 is, and then the
+ * operator sends it in chunks, each one a signed request on the transfer's
+ * input subject:
+ *
+ *   {"type":"put","id":"7c1e55aa","path":"/opt/models/w.bin","size":1048576,
+ *    "sha256":"<hex>","mode":"0640","owner":"agent","group":"agent","overwrite":true}
+ *   {"ok":true,"id":"7c1e55aa","input":"firecracker.file.<tenant>.<agent>.7c1e55aa.in","chunk":262144}
+ *
+ *   {"type":"chunk","offset":0,"data":"<base64>"}     {"ok":true,"offset":262144}
+ *   ...                                                {"ok":true,"offset":1048576,"done":true}
+ *
+ * The file is written next to its destination, and only renamed into place
+ * once the size and digest match, with its mode and owner set. A chunk that
+ * was already written is acknowledged again, so a client can retry one whose
+ * reply it lost.
+ *
+ * A get says how big the file is, and the operator asks for chunks, and says
+ * when it's done. The SHA-256, worked out while the chunks go, comes with the
+ * reply to done:
+ *
+ *   {"type":"get","id":"9a0b77cc","path":"/var/crash/core.1234"}
+ *   {"ok":true,"id":"9a0b77cc","input":"...","size":5242880,"mode":"0600",
+ *    "owner":"root","group":"root","chunk":262144}
+ *
+ *   {"type":"chunk","offset":0,"length":262144}       {"ok":true,"offset":0,"data":"<base64>"}
+ *   {"type":"done"}                                   {"ok":true,"done":true,"sha256":"<hex>"}
+ *
+ * Either way, {"type":"cancel"} stops the transfer, and so does FILE_IDLE_TIMEOUT
+ * without a chunk, and our shutdown. A put that didn't finish leaves nothing
+ * behind, not even the directories it made. Every transfer is reported to the
+ * host as a "file" audit event.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+	"guest_identity"
+	"guest_mmds"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	FILE_MAX_TRANSFERS = 4
+	FILE_MAX_SIZE      = int64(1 << 30)
+	FILE_CHUNK         = 256 * 1024
+	FILE_IDLE_TIMEOUT  = 2 * time.Minute
+)
+
+var ERR_FILE_IDLE = errors.New("no chunk for too long")
+
+// files_config is "files" in MMDS.
+type files_config struct {
+	Put     []string `json:"put"`
+	Get     []string `json:"get"`
+	MaxSize int64    `json:"max-size"`
+}
+
+// file_request
+type file_request struct {
+	Type      string `json:"type"` // put or get
+	Id        string `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Mode      string `json:"mode"`
+	Owner     string `json:"owner"`
+	Group     string `json:"group"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// file_reply answers the request, and each chunk.
+type file_reply struct {
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Id     string `json:"id,omitempty"`
+	Input  string `json:"input,omitempty"`
+	Size   *int64 `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Chunk  int    `json:"chunk,omitempty"`
+	Offset *int64 `json:"offset,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// file_input is a message on the input subject.
+type file_input struct {
+	Type   string `json:"type"` // chunk, done or cancel
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+	Data   []byte `json:"data"`
+}
+
+// file_audit is the event we send to the host.
+type file_audit struct {
+	Type      string    `json:"type"`
+	Agent     string    `json:"agent"`
+	Tenant    string    `json:"tenant"`
+	Action    string    `json:"action"` // started, finished, failed or rejected
+	Id        string    `json:"id"`
+	Operator  string    `json:"operator,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Direction string    `json:"direction"` // put or get
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// file_transfer is one put or get in progress.
+type file_transfer struct {
+	req      file_request
+	key      string
+	operator string
+	input    string
+	path     string   // with symlinks resolved
+	tmp      string   // what a put writes to until it's complete
+	made     []string // directories a put made, to go if it doesn't complete
+	started  time.Time
+
+	max_size int64
+	mode     os.FileMode
+	uid, gid int
+
+	mu       sync.Mutex
+	f        *os.File
+	hash     hash.Hash
+	offset   int64
+	size     int64
+	sum      string
+	hashed   chan struct{} // closed when a get's digest is in sum, or hash_err
+	hash_err error
+	over     bool
+	sub      *nats.Subscription
+	timer    *time.Timer
+	stop_ctx func() bool
+}
+
+// handle_file checks a put or get request and gets the transfer going.
+func handle_file(ctx context.Context, m *nats.Msg) file_reply {
+	req := file_request{}
+	if e := json.Unmarshal(m.Data, &req); e != nil {
+		return file_reply{Error: fmt.Sprintf("bad request: %s", e)}
+	}
+	key, operator := "", ""
+	fail := func(action string, e error) file_reply {
+		audit_file(file_audit{Action: action, Id: req.Id, Operator: operator, Key: key, Direction: req.Type, Path: req.Path, Size: req.Size, Error: e.Error()})
+		return file_reply{Error: e.Error(), Id: req.Id}
+	}
+
+	key, operator, e := operator_key(m)
+	if e != nil {
+		return fail("rejected", e)
+	}
+	t := &file_transfer{
+		req:      req,
+		key:      key,
+		operator: operator,
+		input:    fmt.Sprintf("firecracker.file.%s.%s.%s.in", id.Tenant, id.Agent, req.Id),
+	}
+	if e := t.check(); e != nil {
+		return fail("rejected", e)
+	}
+	if e := claim_session(req.Id, "file", FILE_MAX_TRANSFERS); e != nil {
+		return fail("rejected", e)
+	}
+
+	// Chunks wait until we're set up.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var reply file_reply
+	if req.Type == "put" {
+		reply, e = t.open_put()
+	} else {
+		reply, e = t.open_get()
+	}
+	if e == nil {
+		t.sub, e = nc.Subscribe(t.input, t.handle_input)
+	}
+	if e != nil {
+		if t.f != nil {
+			t.f.Close()
+		}
+		if t.tmp != "" {
+			os.Remove(t.tmp)
+		}
+		remove_dirs(t.made)
+		release_session(req.Id)
+		return fail("failed", e)
+	}
+
+	t.started = time.Now()
+	t.timer = time.AfterFunc(FILE_IDLE_TIMEOUT, func() { t.end(ERR_FILE_IDLE) })
+	t.stop_ctx = context.AfterFunc(ctx, func() { t.end(fmt.Errorf("guest_daemon is shutting down")) })
+	t.audit("started", file_audit{})
+
+	// An empty put is complete already.
+	if req.Type == "put" && req.Size == 0 {
+		if e := t.complete(); e != nil {
+			t.finish(e)
+			return file_reply{Error: e.Error(), Id: req.Id}
+		}
+		reply.Done = true
+	}
+	reply.Ok, reply.Id, reply.Input, reply.Chunk = true, req.Id, t.input, FILE_CHUNK
+	return reply
+}
+
+// check validates the request against the host's files config, and resolves
+// the path.
+func (t *file_transfer) check() error {
+	r := &t.req
+	if !exec_id_re.MatchString(r.Id) {
+		return fmt.Errorf("id must be 8 to 64 letters, digits, - or _")
+	}
+	cfg := files_config{}
+	if e := guest_mmds.Get("/files", &cfg); e != nil && !errors.Is(e, guest_mmds.ErrNotFound) {
+		return e
+	}
+	t.max_size = FILE_MAX_SIZE
+	if cfg.MaxSize > 0 {
+		t.max_size = cfg.MaxSize
+	}
+
+	var e error
+	switch r.Type {
+	case "put":
+		if r.Size < 0 || r.Size > t.max_size {
+			return fmt.Errorf("size must be from 0 to %d", t.max_size)
+		}
+		if len(r.Sha256) != 64 {
+			return fmt.Errorf("sha256 must be 64 hex digits")
+		}
+		r.Sha256 = strings.ToLower(r.Sha256)
+		if t.mode, e = parse_mode(r.Mode); e != nil {
+			return e
+		}
+		if t.uid, t.gid, e = lookup_owner(r.Owner, r.Group); e != nil {
+			return e
+		}
+		t.path, e = allowed_path(r.Path, cfg.Put, true)
+	case "get":
+		t.path, e = allowed_path(r.Path, cfg.Get, false)
+	default:
+		return fmt.Errorf("unknown transfer %q", r.Type)
+	}
+	return e
+}
+
+// allowed_path makes sure path is in, or under, one of the allowed directories,
+// once symlinks are resolved, and returns the resolved path. For a put, the file
+// and even its directory needn't exist yet, so what's resolved is the nearest
+// directory above it that does.
+func allowed_path(path string, allow []string, put bool) (string, error) {
+	if len(allow) == 0 {
+		return "", fmt.Errorf("file transfers aren't enabled for this agent")
+	}
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return "", fmt.Errorf("path must be absolute and clean")
+	}
+
+	var resolved string
+	if put {
+		dir, rest := filepath.Dir(path), filepath.Base(path)
+		for {
+			r, e := filepath.EvalSymlinks(dir)
+			if e == nil {
+				resolved = filepath.Join(r, rest)
+				break
+			}
+			if !os.IsNotExist(e) {
+				return "", e
+			}
+			dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+		}
+	} else {
+		r, e := filepath.EvalSymlinks(path)
+		if e != nil {
+			return "", e
+		}
+		resolved = r
+	}
+
+	for _, a := range allow {
+		if r, e := filepath.EvalSymlinks(a); e == nil {
+			a = r
+		}
+		if a == "/" || resolved == a || strings.HasPrefix(resolved, a+"/") {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't in an allowed directory", path)
+}
+
+// parse_mode takes octal permission bits, and defaults to 0644.
+func parse_mode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0644, nil
+	}
+	m, e := strconv.ParseUint(s, 8, 32)
+	if e != nil || m&^0777 != 0 {
+		return 0, fmt.Errorf("mode must be octal permission bits, like 0644")
+	}
+	return os.FileMode(m), nil
+}
+
+// lookup_owner takes user and group names or numbers. Missing ones are -1, which
+// chown leaves alone.
+func lookup_owner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		if n, e := strconv.Atoi(owner); e == nil {
+			uid = n
+		} else if u, e := user.Lookup(owner); e == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return 0, 0, e
+		}
+	}
+	if group != "" {
+		if n, e := strconv.Atoi(group); e == nil {
+			gid = n
+		} else if g, e := user.LookupGroup(group); e == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return 0, 0, e
+		}
+	}
+	return uid, gid, nil
+}
+
+// make_dirs makes dir and whatever is missing above it, like os.MkdirAll, and
+// returns the directories it made, top first.
+func make_dirs(dir string) ([]string, error) {
+	missing := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, e := os.Stat(d); e == nil {
+			break
+		} else if !os.IsNotExist(e) || d == filepath.Dir(d) {
+			return nil, e
+		}
+		missing = append(missing, d)
+	}
+	made := []string{}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if e := os.Mkdir(missing[i], 0755); e != nil && !os.IsExist(e) {
+			remove_dirs(made)
+			return nil, e
+		} else if e == nil {
+			made = append(made, missing[i])
+		}
+	}
+	return made, nil
+}
+
+// remove_dirs removes the directories make_dirs made, bottom first, if they're
+// still empty.
+func remove_dirs(made []string) {
+	for i := len(made) - 1; i >= 0; i-- {
+		os.Remove(made[i])
+	}
+}
+
+// open_put makes the directories and the temporary file, once we know the file
+// will fit.
+func (t *file_transfer) open_put() (file_reply, error) {
+	if !t.req.Overwrite {
+		if _, e := os.Lstat(t.path); e == nil {
+			return file_reply{}, fmt.Errorf("%s exists", t.req.Path)
+		}
+	}
+	dir := filepath.Dir(t.path)
+	var e error
+	if t.made, e = make_dirs(dir); e != nil {
+		return file_reply{}, e
+	}
+	var st unix.Statfs_t
+	if e := unix.Statfs(dir, &st); e == nil && int64(st.Bavail)*st.Bsize < t.req.Size {
+		return file_reply{}, fmt.Errorf("not enough space for %d bytes in %s", t.req.Size, dir)
+	}
+
+	t.tmp = filepath.Join(dir, fmt.Sprintf(".%s.%s.part", filepath.Base(t.path), t.req.Id))
+	f, e := os.OpenFile(t.tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		t.tmp = ""
+		return file_reply{}, e
+	}
+	t.f, t.hash, t.size = f, sha256.New(), t.req.Size
+	return file_reply{}, nil
+}
+
+// open_get opens the file, and starts working out its digest, which the
+// operator gets at the end. Hashing a big file takes a while, and we mustn't
+// keep other requests waiting. We serve chunks from the same open file.
+func (t *file_transfer) open_get() (file_reply, error) {
+	f, e := os.Open(t.path)
+	if e != nil {
+		return file_reply{}, e
+	}
+	t.f = f
+	fi, e := f.Stat()
+	if e != nil {
+		return file_reply{}, e
+	}
+	if !fi.Mode().IsRegular() {
+		return file_reply{}, fmt.Errorf("%s isn't a regular file", t.req.Path)
+	}
+	if fi.Size() > t.max_size {
+		return file_reply{}, fmt.Errorf("%s is %d bytes, more than %d", t.req.Path, fi.Size(), t.max_size)
+	}
+	t.size = fi.Size()
+	t.hashed = make(chan struct{})
+	go t.hash_get()
+
+	owner, group := "", ""
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		owner, group = strconv.Itoa(int(st.Uid)), strconv.Itoa(int(st.Gid))
+		if u, e := user.LookupId(owner); e == nil {
+			owner = u.Username
+		}
+		if g, e := user.LookupGroupId(group); e == nil {
+			group = g.Name
+		}
+	}
+	return file_reply{
+		Size:  &t.size,
+		Mode:  fmt.Sprintf("%04o", fi.Mode().Perm()),
+		Owner: owner,
+		Group: group,
+	}, nil
+}
+
+// hash_get works out the digest of the file a get is serving. If the transfer
+// ends first, closing the file stops it.
+func (t *file_transfer) hash_get() {
+	defer close(t.hashed)
+	h := sha256.New()
+	_, e := io.Copy(h, io.NewSectionReader(t.f, 0, t.size))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e != nil {
+		t.hash_err = e
+		return
+	}
+	t.sum = hex.EncodeToString(h.Sum(nil))
+}
+
+// handle_input answers chunk requests from the operator who started the transfer.
+func (t *file_transfer) handle_input(m *nats.Msg) {
+	if _, e := guest_identity.VerifyOperatorMsg(m, []string{t.key}); e != nil {
+		log.Printf("file %s: ignoring input: %s", t.req.Id, e)
+		return
+	}
+	in := file_input{}
+	if e := json.Unmarshal(m.Data, &in); e != nil {
+		respond(m, file_reply{Error: fmt.Sprintf("bad input: %s", e)})
+		return
+	}
+	if in.Type == "done" && t.hashed != nil {
+		// Without t.mu, so the idle timeout and shutdown can still end it.
+		<-t.hashed
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.over {
+		respond(m, file_reply{Error: "the transfer is over"})
+		return
+	}
+	t.timer.Reset(FILE_IDLE_TIMEOUT)
+
+	var reply file_reply
+	var e error
+	switch in.Type {
+	case "chunk":
+		if t.req.Type == "put" {
+			reply, e = t.put_chunk(in)
+		} else {
+			reply, e = t.get_chunk(in)
+		}
+	case "done":
+		if t.req.Type == "put" {
+			e = fmt.Errorf("a put is done when it has all %d bytes", t.size)
+			break
+		}
+		if t.hash_err != nil {
+			e = fmt.Errorf("working out the sha256: %w", t.hash_err)
+			break
+		}
+		t.finish(nil)
+		reply = file_reply{Done: true, Sha256: t.sum}
+	case "cancel":
+		log.Printf("file %s: cancelled by %s", t.req.Id, t.operator)
+		e = ERR_CANCELLED
+	default:
+		e = fmt.Errorf("unknown input type %q", in.Type)
+	}
+	if e != nil {
+		t.finish(e)
+		respond(m, file_reply{Error: e.Error()})
+		return
+	}
+	reply.Ok = true
+	respond(m, reply)
+}
+
+// put_chunk writes the next chunk, and when it's the last one, completes the put.
+func (t *file_transfer) put_chunk(in file_input) (file_reply, error) {
+	switch {
+	case in.Offset < t.offset:
+		// We have it already. The reply must have gone missing.
+		return file_reply{Offset: &t.offset}, nil
+	case in.Offset > t.offset:
+		return file_reply{}, fmt.Errorf("expected offset %d, got %d", t.offset, in.Offset)
+	case len(in.Data) > FILE_CHUNK:
+		return file_reply{}, fmt.Errorf("chunks can't be more than %d bytes", FILE_CHUNK)
+	case t.offset+int64(len(in.Data)) > t.size:
+		return file_reply{}, fmt.Errorf("more than the %d bytes we were promised", t.size)
+	}
+	if _, e := t.f.Write(in.Data); e != nil {
+		return file_reply{}, e
+	}
+	t.hash.Write(in.Data)
+	t.offset += int64(len(in.Data))
+	if t.offset < t.size {
+		return file_reply{Offset: &t.offset}, nil
+	}
+	if e := t.complete(); e != nil {
+		return file_reply{}, e
+	}
+	return file_reply{Offset: &t.offset, Done: true}, nil
+}
+
+// complete checks the digest, and moves the file into place with its mode and
+// owner, synced so it survives a crash.
+func (t *file_transfer) complete() error {
+	t.sum = hex.EncodeToString(t.hash.Sum(nil))
+	if t.sum != t.req.Sha256 {
+		return fmt.Errorf("sha256 is %s, not %s", t.sum, t.req.Sha256)
+	}
+	if e := t.f.Chmod(t.mode); e != nil {
+		return e
+	}
+	if e := t.f.Chown(t.uid, t.gid); e != nil {
+		return e
+	}
+	if e := t.f.Sync(); e != nil {
+		return e
+	}
+	if e := os.Rename(t.tmp, t.path); e != nil {
+		return e
+	}
+	t.tmp = ""
+	if d, e := os.Open(filepath.Dir(t.path)); e == nil {
+		d.Sync()
+		d.Close()
+	}
+	t.finish(nil)
+	return nil
+}
+
+// get_chunk reads the chunk asked for. Past the end, it's empty.
+func (t *file_transfer) get_chunk(in file_input) (file_reply, error) {
+	n := in.Length
+	if n <= 0 || n > FILE_CHUNK {
+		n = FILE_CHUNK
+	}
+	if in.Offset < 0 {
+		return file_reply{}, fmt.Errorf("bad offset %d", in.Offset)
+	}
+	if in.Offset >= t.size {
+		return file_reply{Offset: &in.Offset}, nil
+	}
+	buf := make([]byte, min(int64(n), t.size-in.Offset))
+	got, e := t.f.ReadAt(buf, in.Offset)
+	if e != nil && e != io.EOF {
+		return file_reply{}, e
+	}
+	t.offset = max(t.offset, in.Offset+int64(got))
+	return file_reply{Offset: &in.Offset, Data: buf[:got]}, nil
+}
+
+// end stops the transfer from outside: idle, or shutting down.
+func (t *file_transfer) end(e error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finish(e)
+}
+
+// finish closes the transfer, with t.mu held, and reports how it went. A put
+// that didn't complete is thrown away.
+func (t *file_transfer) finish(e error) {
+	if t.over {
+		return
+	}
+	t.over = true
+	t.timer.Stop()
+	t.stop_ctx()
+	t.sub.Unsubscribe()
+	t.f.Close()
+	if t.tmp != "" {
+		os.Remove(t.tmp)
+		remove_dirs(t.made)
+	}
+	defer release_session(t.req.Id)
+
+	a := file_audit{Size: t.offset, Duration: time.Since(t.started).Round(time.Millisecond).String()}
+	if e != nil {
+		a.Error = e.Error()
+		t.audit("failed", a)
+		return
+	}
+	a.Sha256 = t.sum
+	t.audit("finished", a)
+}
+
+// audit reports what happened to the transfer, with its request filled in.
+func (t *file_transfer) audit(action string, a file_audit) {
+	a.Action, a.Id, a.Operator, a.Key = action, t.req.Id, t.operator, t.key
+	a.Direction, a.Path = t.req.Type, t.req.Path
+	if action == "started" {
+		a.Size = t.size
+	}
+	audit_file(a)
+}
+
+// audit_file logs a transfer event and reports it to the host.
+func audit_file(a file_audit) {
+	if a.Error != "" {
+		log.Printf("AUDIT file %s %s %s: %s %s: %s", a.Id, a.Direction, a.Action, a.Operator, a.Path, a.Error)
+	} else {
+		log.Printf("AUDIT file %s %s %s: %s %s, %d bytes %s", a.Id, a.Direction, a.Action, a.Operator, a.Path, a.Size, a.Sha256)
+	}
+
+	if nc == nil || id.Host == "" {
+		return
+	}
+	a.Type, a.Agent, a.Tenant, a.Time = "file", id.Agent, id.Tenant, time.Now().UTC()
+	j, _ := json.Marshal(a)
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.host.%s", id.Host), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("failed to sign file audit: %s", e)
+		return
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		log.Printf("failed to report file audit: %s", e)
+	}
+}
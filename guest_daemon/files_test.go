@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Paths resolve to somewhere under an allowed directory, or they're refused.
+func TestAllowedPath(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	models := filepath.Join(root, "opt/models")
+	outside := filepath.Join(root, "etc")
+	for _, d := range []string{models, filepath.Join(root, "opt/models2"), outside} {
+		if e := os.MkdirAll(d, 0755); e != nil {
+			t.Fatal(e)
+		}
+	}
+	os.WriteFile(filepath.Join(models, "w.bin"), []byte("w"), 0644)
+	os.WriteFile(filepath.Join(outside, "shadow"), []byte("s"), 0644)
+	os.Symlink(outside, filepath.Join(models, "out"))
+	os.Symlink(filepath.Join(outside, "shadow"), filepath.Join(models, "shadow"))
+	os.Symlink(filepath.Join(models, "w.bin"), filepath.Join(root, "opt/models2/in"))
+	allow := []string{models}
+
+	for _, c := range []struct {
+		what, path string
+		put        bool
+		want       string // "" for refused
+	}{
+		{"a file", "opt/models/w.bin", false, "opt/models/w.bin"},
+		{"a new file", "opt/models/new.bin", true, "opt/models/new.bin"},
+		{"under missing dirs", "opt/models/a/b/c.bin", true, "opt/models/a/b/c.bin"},
+		{"the directory itself", "opt/models", false, "opt/models"},
+		{"a link that stays in", "opt/models2/in", false, "opt/models/w.bin"},
+		{"a link to a file outside", "opt/models/shadow", false, ""},
+		// The rename replaces the link, not what it points to.
+		{"a put over a link to a file outside", "opt/models/shadow", true, "opt/models/shadow"},
+		{"through a link to a dir outside", "opt/models/out/shadow", false, ""},
+		{"a put through a link to a dir outside", "opt/models/out/new", true, ""},
+		{"missing dirs under a link outside", "opt/models/out/a/b/new", true, ""},
+		{"a sibling with the same prefix", "opt/models2/x", true, ""},
+		{"..", "opt/models/../../etc/shadow", false, ""},
+		{"a put with ..", "opt/models/../models2/x", true, ""},
+		{"a missing file", "opt/models/nope", false, ""},
+	} {
+		got, e := allowed_path(root+"/"+c.path, allow, c.put)
+		switch {
+		case c.want == "" && e == nil:
+			t.Errorf("%s: allowed as %s", c.what, got)
+		case c.want != "" && e != nil:
+			t.Errorf("%s: %s", c.what, e)
+		case c.want != "" && got != filepath.Join(root, c.want):
+			t.Errorf("%s: resolved to %s, want %s", c.what, got, filepath.Join(root, c.want))
+		}
+	}
+
+	if _, e := allowed_path(filepath.Join(models, "w.bin"), nil, false); e == nil {
+		t.Errorf("allowed with nothing allowed")
+	}
+	if _, e := allowed_path("opt/models/w.bin", []string{"opt/models"}, false); e == nil {
+		t.Errorf("allowed a relative path")
+	}
+}
+
+// make_dirs says what it made, and remove_dirs takes away only those.
+func TestMakeDirs(t *testing.T) {
+	root := t.TempDir()
+	made, e := make_dirs(filepath.Join(root, "a/b/c"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(made) != 3 || made[0] != filepath.Join(root, "a") || made[2] != filepath.Join(root, "a/b/c") {
+		t.Errorf("made %v", made)
+	}
+	remove_dirs(made)
+	if _, e := os.Stat(filepath.Join(root, "a")); !os.IsNotExist(e) {
+		t.Errorf("a is still there: %v", e)
+	}
+	if _, e := os.Stat(root); e != nil {
+		t.Errorf("removed what was there before: %s", e)
+	}
+
+	// One that's been used since stays.
+	made, _ = make_dirs(filepath.Join(root, "x/y"))
+	os.WriteFile(filepath.Join(root, "x/keep"), []byte("k"), 0644)
+	remove_dirs(made)
+	if _, e := os.Stat(filepath.Join(root, "x/keep")); e != nil {
+		t.Errorf("x/keep: %s", e)
+	}
+	if _, e := os.Stat(filepath.Join(root, "x/y")); !os.IsNotExist(e) {
+		t.Errorf("x/y is still there: %v", e)
+	}
+
+	if made, e := make_dirs(root); e != nil || len(made) != 0 {
+		t.Errorf("made %v, %v for a dir that exists", made, e)
+	}
+}
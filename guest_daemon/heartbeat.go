@@ -0,0 +1,500 @@
+package main
+
+/* Heartbeats, so the host can tell a healthy agent from one whose app has
+ * crashed, or whose disk has filled up, while the VM itself runs on.
+ *
+ * Every HEARTBEAT_INTERVAL, and once more as we shut down, we publish a signed
+ * heartbeat on firecracker.heartbeat.<host>.<tenant>.<agent>, for host_daemon and
+ * for anyone else with a use for it. The host is in the subject so each
+ * host_daemon hears only its own guests:
+ *
+ *   {
+ *     "type": "heartbeat",
+ *     "agent": "agent-7", "tenant": "acme", "host": "h1", "slot": 3,
+ *     "version": "v1.4.0",        // ours, see version
+ *     "state": "running",         // or stopping, in the last one
+ *     "seq": 42,                  // since we started
+ *     "interval": 30,             // seconds until the next one
+ *     "uptime": 12345.6,          // the guest's, from /proc/uptime
+ *     "daemon_uptime": 1260.2,    // ours
+ *     "load": [0.12, 0.08, 0.01],
+ *     "cpus": 2,
+ *     "memory": {"total": 2147483648, "available": 1610612736, "swap_total": 0, "swap_free": 0},
+ *     "disks": [{"path": "/", "total": 2147483648, "available": 1073741824,
+ *                "inodes": 131072, "inodes_free": 120000}],
+ *     "apps": [{"unit": "app.service", "load": "loaded", "active": "active",
+ *               "sub": "running", "restarts": 0, "exit_status": 0, "since": "..."}],
+ *     "sentences": [{"subscription": "sentences", "connection": "connected",
+ *                    "num_pending": 0, "backlog_files": 5, "backlog_bytes": 1234,
+ *                    "held_off": "", "updated": "..."}],
+ *     "errors": ["..."],          // whatever we couldn't find out
+ *     "time": "2026-01-02T03:04:05Z"
+ *   }
+ *
+ * The apps are the systemd units that run the agent's app, one per executable
+ * in APP_DIR (see dev_notes_and_scripts/setup_lite.sh). The sentences are
+ * guest_sentences' status.json files, in SENTENCES_DIR, its subdirectories,
+ * and any other dir its subscriptions name. The host can change what we look
+ * at in MMDS under "heartbeat", which we read again before every heartbeat:
+ *
+ *   {"interval":"15s","apps":["model.service"],"disks":["/","/opt/models"]}
+ */
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/sys/unix"
+	"guest_mmds"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	HEARTBEAT_INTERVAL = 30 * time.Second
+	HEARTBEAT_TIMEOUT  = 5 * time.Second
+	PROC_DIR           = "/proc"
+	APP_DIR            = "/apps"
+	SENTENCES_DIR      = "/opt/agentsentences"
+	SYSTEMCTL          = "systemctl"
+
+	// VERSION is set at build time, with -ldflags "-X main.VERSION=v1.4.0".
+	// Without it we go by what the go command recorded, see version.
+	VERSION = ""
+
+	started = time.Now()
+)
+
+// heartbeat_config is "heartbeat" in MMDS.
+type heartbeat_config struct {
+	Interval string   `json:"interval"`
+	Apps     []string `json:"apps"`
+	Disks    []string `json:"disks"`
+}
+
+// heartbeat is what we publish.
+type heartbeat struct {
+	Type         string                `json:"type"`
+	Agent        string                `json:"agent"`
+	Tenant       string                `json:"tenant"`
+	Host         string                `json:"host"`
+	Slot         int                   `json:"slot"`
+	Version      string                `json:"version"`
+	State        string                `json:"state"`
+	Seq          uint64                `json:"seq"`
+	Interval     float64               `json:"interval"`
+	Uptime       float64               `json:"uptime"`
+	DaemonUptime float64               `json:"daemon_uptime"`
+	Load         [3]float64            `json:"load"`
+	Cpus         int                   `json:"cpus"`
+	Memory       heartbeat_memory      `json:"memory"`
+	Disks        []heartbeat_disk      `json:"disks"`
+	Apps         []heartbeat_app       `json:"apps"`
+	Sentences    []heartbeat_sentences `json:"sentences"`
+	Errors       []string              `json:"errors,omitempty"`
+	Time         time.Time             `json:"time"`
+}
+
+// heartbeat_memory is in bytes.
+type heartbeat_memory struct {
+	Total     int64 `json:"total"`
+	Available int64 `json:"available"`
+	SwapTotal int64 `json:"swap_total"`
+	SwapFree  int64 `json:"swap_free"`
+}
+
+// heartbeat_disk is the filesystem that path is on, in bytes. Available is what an
+// unprivileged user could still write.
+type heartbeat_disk struct {
+	Path       string `json:"path"`
+	Total      int64  `json:"total"`
+	Available  int64  `json:"available"`
+	Inodes     int64  `json:"inodes"`
+	InodesFree int64  `json:"inodes_free"`
+}
+
+// heartbeat_app is what systemd says about one of the app's units.
+type heartbeat_app struct {
+	Unit       string `json:"unit"`
+	Load       string `json:"load"`
+	Active     string `json:"active"`
+	Sub        string `json:"sub"`
+	Restarts   int    `json:"restarts"`
+	ExitStatus int    `json:"exit_status"`
+	Since      string `json:"since"`
+}
+
+// heartbeat_sentences is the part of a guest_sentences status.json we pass on.
+type heartbeat_sentences struct {
+	Subscription string    `json:"subscription"`
+	Connection   string    `json:"connection"`
+	NumPending   int64     `json:"num_pending"`
+	BacklogFiles int       `json:"backlog_files"`
+	BacklogBytes int64     `json:"backlog_bytes"`
+	HeldOff      string    `json:"held_off"`
+	Updated      time.Time `json:"updated,omitzero"`
+}
+
+// heartbeat_loop publishes a heartbeat every interval until ctx is cancelled,
+// and then a last one that says we're stopping. What we couldn't find out is
+// logged when it changes.
+func heartbeat_loop(ctx context.Context) {
+	var seq uint64
+	var logged string
+	interval := HEARTBEAT_INTERVAL
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		hc := read_heartbeat_config()
+		if d := heartbeat_interval(hc); d != interval {
+			interval = d
+			tick.Reset(interval)
+		}
+		seq++
+		h := collect_heartbeat(hc, "running", seq, interval)
+		if e := strings.Join(h.Errors, "; "); e != logged {
+			logged = e
+			if e != "" {
+				log.Printf("heartbeat: %s", e)
+			}
+		}
+		publish_heartbeat(h)
+		select {
+		case <-ctx.Done():
+			seq++
+			publish_heartbeat(collect_heartbeat(hc, "stopping", seq, interval))
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// read_heartbeat_config
+func read_heartbeat_config() heartbeat_config {
+	hc := heartbeat_config{}
+	if e := guest_mmds.Get("/heartbeat", &hc); e != nil && !errors.Is(e, guest_mmds.ErrNotFound) {
+		log.Printf("no heartbeat config from mmds, using defaults: %s", e)
+	}
+	return hc
+}
+
+// heartbeat_interval is the configured interval, or HEARTBEAT_INTERVAL if
+// there isn't a sensible one.
+func heartbeat_interval(hc heartbeat_config) time.Duration {
+	if hc.Interval == "" {
+		return HEARTBEAT_INTERVAL
+	}
+	d, e := time.ParseDuration(hc.Interval)
+	if e != nil || d < time.Second {
+		log.Printf("bad heartbeat interval %q, using %s", hc.Interval, HEARTBEAT_INTERVAL)
+		return HEARTBEAT_INTERVAL
+	}
+	return d
+}
+
+// collect_heartbeat finds out how we're doing. Anything it can't find out goes
+// into Errors, and the rest is sent anyway.
+func collect_heartbeat(hc heartbeat_config, state string, seq uint64, interval time.Duration) heartbeat {
+	h := heartbeat{
+		Type:         "heartbeat",
+		Agent:        id.Agent,
+		Tenant:       id.Tenant,
+		Host:         id.Host,
+		Slot:         id.Slot,
+		Version:      version(),
+		State:        state,
+		Seq:          seq,
+		Interval:     interval.Seconds(),
+		DaemonUptime: time.Since(started).Seconds(),
+		Cpus:         runtime.NumCPU(),
+		Disks:        []heartbeat_disk{},
+		Apps:         []heartbeat_app{},
+		Sentences:    []heartbeat_sentences{},
+	}
+	fail := func(what string, e error) {
+		h.Errors = append(h.Errors, fmt.Sprintf("%s: %s", what, e))
+	}
+
+	if e := read_uptime(&h); e != nil {
+		fail("uptime", e)
+	}
+	if e := read_loadavg(&h); e != nil {
+		fail("load", e)
+	}
+	if e := read_meminfo(&h.Memory); e != nil {
+		fail("memory", e)
+	}
+
+	disks := hc.Disks
+	if disks == nil {
+		disks = []string{"/"}
+		if _, e := os.Stat(SENTENCES_DIR); e == nil {
+			disks = append(disks, SENTENCES_DIR)
+		}
+	}
+	for _, path := range disks {
+		var st unix.Statfs_t
+		if e := unix.Statfs(path, &st); e != nil {
+			fail("disk "+path, e)
+			continue
+		}
+		h.Disks = append(h.Disks, heartbeat_disk{
+			Path:       path,
+			Total:      int64(st.Blocks) * st.Bsize,
+			Available:  int64(st.Bavail) * st.Bsize,
+			Inodes:     int64(st.Files),
+			InodesFree: int64(st.Ffree),
+		})
+	}
+
+	apps := hc.Apps
+	if apps == nil {
+		apps = app_units()
+	}
+	if len(apps) > 0 {
+		var e error
+		if h.Apps, e = app_states(apps); e != nil {
+			fail("apps", e)
+		}
+	}
+
+	for _, path := range sentences_status_files() {
+		s, e := read_sentences_status(path)
+		if e != nil {
+			fail("sentences "+path, e)
+			continue
+		}
+		h.Sentences = append(h.Sentences, s)
+	}
+
+	h.Time = time.Now().UTC()
+	return h
+}
+
+// publish_heartbeat
+func publish_heartbeat(h heartbeat) {
+	if nc == nil || id.Host == "" || id.Tenant == "" || id.Agent == "" {
+		return
+	}
+	j, _ := json.Marshal(h)
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.heartbeat.%s.%s.%s", id.Host, id.Tenant, id.Agent), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("failed to sign heartbeat: %s", e)
+		return
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		log.Printf("failed to publish heartbeat: %s", e)
+	}
+}
+
+// version is VERSION, or the VCS revision the go command stamped into the
+// binary, or "dev".
+func version() string {
+	if VERSION != "" {
+		return VERSION
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	rev, dirty := "", false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return "dev"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if dirty {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// read_uptime
+func read_uptime(h *heartbeat) error {
+	b, e := os.ReadFile(filepath.Join(PROC_DIR, "uptime"))
+	if e != nil {
+		return e
+	}
+	f := strings.Fields(string(b))
+	if len(f) < 1 {
+		return fmt.Errorf("can't parse %q", string(b))
+	}
+	h.Uptime, e = strconv.ParseFloat(f[0], 64)
+	return e
+}
+
+// read_loadavg
+func read_loadavg(h *heartbeat) error {
+	b, e := os.ReadFile(filepath.Join(PROC_DIR, "loadavg"))
+	if e != nil {
+		return e
+	}
+	f := strings.Fields(string(b))
+	if len(f) < 3 {
+		return fmt.Errorf("can't parse %q", string(b))
+	}
+	for i := range 3 {
+		if h.Load[i], e = strconv.ParseFloat(f[i], 64); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// read_meminfo. The kernel counts in kB.
+func read_meminfo(m *heartbeat_memory) error {
+	f, e := os.Open(filepath.Join(PROC_DIR, "meminfo"))
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	fields := map[string]*int64{
+		"MemTotal":     &m.Total,
+		"MemAvailable": &m.Available,
+		"SwapTotal":    &m.SwapTotal,
+		"SwapFree":     &m.SwapFree,
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		p := fields[name]
+		if !ok || p == nil {
+			continue
+		}
+		kb, e := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if e != nil {
+			return fmt.Errorf("can't parse %s: %s", name, e)
+		}
+		*p = kb * 1024
+	}
+	return scanner.Err()
+}
+
+// app_units are the app's systemd units: one per executable in APP_DIR, named
+// after it.
+func app_units() []string {
+	entries, e := os.ReadDir(APP_DIR)
+	if e != nil {
+		return nil
+	}
+	units := []string{}
+	for _, d := range entries {
+		info, e := d.Info()
+		if e != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			continue
+		}
+		units = append(units, d.Name()+".service")
+	}
+	return units
+}
+
+// app_states asks systemd about units, all at once. A unit systemd doesn't
+// know comes back with load "not-found", and if we can't ask, they're all
+// "unknown".
+func app_states(units []string) ([]heartbeat_app, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HEARTBEAT_TIMEOUT)
+	defer cancel()
+	args := append([]string{"show", "--property=Id,LoadState,ActiveState,SubState,NRestarts,ExecMainStatus,StateChangeTimestamp", "--"}, units...)
+	out, e := exec.CommandContext(ctx, SYSTEMCTL, args...).Output()
+	if e != nil {
+		if ee, ok := e.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			e = fmt.Errorf("%s: %s", e, strings.TrimSpace(strings.SplitN(string(ee.Stderr), "\n", 2)[0]))
+		}
+		apps := []heartbeat_app{}
+		for _, u := range units {
+			apps = append(apps, heartbeat_app{Unit: u, Load: "unknown", Active: "unknown"})
+		}
+		return apps, e
+	}
+
+	// One block of name=value lines per unit, in the order we asked, with a
+	// blank line between them.
+	apps := []heartbeat_app{}
+	for i, block := range strings.Split(strings.TrimSpace(string(out)), "\n\n") {
+		a := heartbeat_app{}
+		if i < len(units) {
+			a.Unit = units[i]
+		}
+		for line := range strings.SplitSeq(block, "\n") {
+			name, value, _ := strings.Cut(line, "=")
+			switch name {
+			case "Id":
+				if value != "" {
+					a.Unit = value
+				}
+			case "LoadState":
+				a.Load = value
+			case "ActiveState":
+				a.Active = value
+			case "SubState":
+				a.Sub = value
+			case "NRestarts":
+				a.Restarts, _ = strconv.Atoi(value)
+			case "ExecMainStatus":
+				a.ExitStatus, _ = strconv.Atoi(value)
+			case "StateChangeTimestamp":
+				a.Since = value
+			}
+		}
+		apps = append(apps, a)
+	}
+	return apps, nil
+}
+
+// sentences_status_files finds guest_sentences' status.json files: in
+// SENTENCES_DIR for the default subscription, in its subdirectories for the
+// others, and in whatever dirs the subscriptions in MMDS name.
+func sentences_status_files() []string {
+	files, _ := filepath.Glob(filepath.Join(SENTENCES_DIR, "status.json"))
+	more, _ := filepath.Glob(filepath.Join(SENTENCES_DIR, "*", "status.json"))
+	files = append(files, more...)
+
+	var sc struct {
+		Subscriptions []struct {
+			Dir string `json:"dir"`
+		} `json:"subscriptions"`
+	}
+	if e := guest_mmds.Get("/sentences", &sc); e == nil {
+		for _, s := range sc.Subscriptions {
+			if s.Dir == "" {
+				continue
+			}
+			path := filepath.Join(s.Dir, "status.json")
+			if _, e := os.Stat(path); e == nil && !slices.Contains(files, path) {
+				files = append(files, path)
+			}
+		}
+	}
+	return files
+}
+
+// read_sentences_status
+func read_sentences_status(path string) (heartbeat_sentences, error) {
+	s := heartbeat_sentences{}
+	b, e := os.ReadFile(path)
+	if e != nil {
+		return s, e
+	}
+	e = json.Unmarshal(b, &s)
+	return s, e
+}
@@ -0,0 +1,58 @@
+package main
+
+/* Just enough pseudo-terminal for exec's pty mode. */
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+// open_pty returns the master and the terminal end of a new pty. We use the
+// master's fd through SyscallConn, so it stays non-blocking and Close can
+// interrupt a read.
+func open_pty() (*os.File, *os.File, error) {
+	master, e := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if e != nil {
+		return nil, nil, e
+	}
+	var n uint32
+	if e := pty_control(master, func(fd int) error {
+		if e := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); e != nil {
+			return e
+		}
+		var e error
+		n, e = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		return e
+	}); e != nil {
+		master.Close()
+		return nil, nil, e
+	}
+	tty, e := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if e != nil {
+		master.Close()
+		return nil, nil, e
+	}
+	return master, tty, nil
+}
+
+// set_pty_size
+func set_pty_size(master *os.File, rows, cols uint16) error {
+	return pty_control(master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+}
+
+// pty_control runs fn on the file's fd.
+func pty_control(f *os.File, fn func(fd int) error) error {
+	rc, e := f.SyscallConn()
+	if e != nil {
+		return e
+	}
+	var fe error
+	if e := rc.Control(func(fd uintptr) { fe = fn(int(fd)) }); e != nil {
+		return e
+	}
+	return fe
+}
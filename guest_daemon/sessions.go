@@ -0,0 +1,111 @@
+package main
+
+/* What exec and file transfers share: operators sign their requests with keys
+ * the host lists in MMDS under "exec-keys", each request id is good for one
+ * session, only so many sessions of a kind run at once, and shutdown waits for
+ * them all.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"guest_identity"
+	"guest_mmds"
+	"sync"
+	"time"
+)
+
+var ERR_CANCELLED = errors.New("cancelled")
+
+// sessions maps the ids of running sessions to their kind, and remembers the ids
+// we've seen.
+var sessions = struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[string]string
+	seen    map[string]time.Time
+	closing bool
+}{
+	running: map[string]string{},
+	seen:    map[string]time.Time{},
+}
+
+// operator_key checks a request's signature against the keys the host gave us
+// and returns the key and its operator.
+func operator_key(m *nats.Msg) (string, string, error) {
+	keys, e := guest_mmds.ExecKeys()
+	if e != nil {
+		return "", "", e
+	}
+	now := time.Now()
+	valid := []string{}
+	for _, k := range keys {
+		if !k.Expires.IsZero() && now.Before(k.Expires) {
+			valid = append(valid, k.Key)
+		}
+	}
+	if len(valid) == 0 {
+		return "", "", fmt.Errorf("no operator keys for this agent")
+	}
+	key, e := guest_identity.VerifyOperatorMsg(m, valid)
+	if e != nil {
+		return "", "", e
+	}
+	for _, k := range keys {
+		if k.Key == key {
+			return key, k.Operator, nil
+		}
+	}
+	return key, "", nil
+}
+
+// claim_session starts a session of kind, unless there are already max of them.
+// Each id runs once: a signed request stays good for guest_identity.MAX_SKEW, and
+// we remember ids for twice that.
+func claim_session(id string, kind string, max int) error {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if sessions.closing {
+		return fmt.Errorf("guest_daemon is shutting down")
+	}
+	now := time.Now()
+	for id, t := range sessions.seen {
+		if now.Sub(t) > 2*guest_identity.MAX_SKEW {
+			delete(sessions.seen, id)
+		}
+	}
+	if _, ok := sessions.seen[id]; ok {
+		return fmt.Errorf("id %s has been used", id)
+	}
+	n := 0
+	for _, k := range sessions.running {
+		if k == kind {
+			n++
+		}
+	}
+	if n >= max {
+		return fmt.Errorf("already running %d of those", n)
+	}
+	sessions.seen[id] = now
+	sessions.running[id] = kind
+	sessions.wg.Add(1)
+	return nil
+}
+
+// release_session
+func release_session(id string) {
+	sessions.mu.Lock()
+	delete(sessions.running, id)
+	sessions.mu.Unlock()
+	sessions.wg.Done()
+}
+
+// close_sessions turns away new requests and waits for the running sessions,
+// which stop when the context they were started with is cancelled.
+func close_sessions() {
+	sessions.mu.Lock()
+	sessions.closing = true
+	sessions.mu.Unlock()
+	sessions.wg.Wait()
+}
@@ -0,0 +1,251 @@
+package main
+
+/* Break-glass SSH access without baking keys into customer images.
+ *
+ * The host publishes a list of operator public keys for this agent into MMDS,
+ * each with an expiry. We keep root's authorized_keys in step with it: at boot,
+ * and then every SSH_KEYS_INTERVAL. Our keys live between two marker lines, and
+ * anything else in the file is left alone. Expired keys are dropped even if the
+ * host hasn't got round to removing them, or MMDS isn't answering. Since we
+ * can't know what the last run installed, our first pass always rewrites the
+ * block, empty if MMDS has nothing for us.
+ *
+ * Every key that's added or removed is logged and reported to the host as an
+ * audit event.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/ssh"
+	"guest_mmds"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	AUTHORIZED_KEYS   = "/root/.ssh/authorized_keys"
+	SSH_KEYS_INTERVAL = 30 * time.Second
+)
+
+const (
+	SSH_KEYS_BEGIN = "# BEGIN guest_daemon managed keys, do not edit"
+	SSH_KEYS_END   = "# END guest_daemon managed keys"
+)
+
+// ssh_audit is the event we send to the host for every change.
+type ssh_audit struct {
+	Type        string    `json:"type"`
+	Agent       string    `json:"agent"`
+	Tenant      string    `json:"tenant"`
+	Action      string    `json:"action"` // added, removed or expired
+	Operator    string    `json:"operator"`
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires"`
+	Time        time.Time `json:"time"`
+}
+
+// installed_key is what we remember about a key we put into authorized_keys.
+type installed_key struct {
+	line string
+	key  guest_mmds.SshKey
+}
+
+// sync_ssh_keys_loop runs until ctx is cancelled, never in the middle of a sync.
+func sync_ssh_keys_loop(ctx context.Context) {
+	installed := map[string]installed_key{}
+	tick := time.NewTicker(SSH_KEYS_INTERVAL)
+	defer tick.Stop()
+	for {
+		if e := sync_ssh_keys(installed); e != nil {
+			log.Printf("ssh key sync failed: %s", e)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// sync_ssh_keys makes authorized_keys match what MMDS says, minus anything
+// expired. installed is keyed by fingerprint and carries over between calls,
+// so we can tell what changed. If MMDS can't tell us, we still take out what
+// has expired, and on the first pass, whatever a previous run left behind.
+func sync_ssh_keys(installed map[string]installed_key) error {
+	keys, e := guest_mmds.SshKeys()
+	if e != nil {
+		now := time.Now()
+		changed := false
+		for fp, old := range installed {
+			if !now.Before(old.key.Expires) {
+				audit_ssh_key("expired", old.key, fp)
+				delete(installed, fp)
+				changed = true
+			}
+		}
+		if changed || !ssh_keys_written {
+			if e := write_installed_keys(installed); e != nil {
+				log.Printf("ssh key sync failed: %s", e)
+			}
+		}
+		return e
+	}
+
+	now := time.Now()
+	changed := false
+	wanted := map[string]installed_key{}
+	for _, k := range keys {
+		pub, _, _, _, e := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if e != nil {
+			log.Printf("ignoring bad ssh key for %s: %s", k.Operator, e)
+			continue
+		}
+		fp := ssh.FingerprintSHA256(pub)
+		if k.Expires.IsZero() || !now.Before(k.Expires) {
+			if old, ok := installed[fp]; ok {
+				audit_ssh_key("expired", old.key, fp)
+				delete(installed, fp)
+				changed = true
+			}
+			continue
+		}
+		// Rebuild the line from the parsed key, so nothing but the key and
+		// our comment gets in: no command= or other options.
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + ssh_key_comment(k)
+		wanted[fp] = installed_key{line, k}
+	}
+
+	// Keys that were installed but have disappeared, or have just expired.
+	for fp, old := range installed {
+		if _, ok := wanted[fp]; !ok {
+			action := "removed"
+			if !now.Before(old.key.Expires) {
+				action = "expired"
+			}
+			audit_ssh_key(action, old.key, fp)
+			delete(installed, fp)
+			changed = true
+		}
+	}
+	for fp, k := range wanted {
+		if old, ok := installed[fp]; !ok || old.line != k.line {
+			if !ok {
+				audit_ssh_key("added", k.key, fp)
+			}
+			installed[fp] = k
+			changed = true
+		}
+	}
+
+	// On the first pass we always write, to clean out whatever a previous
+	// run left behind.
+	if !changed && ssh_keys_written {
+		return nil
+	}
+	return write_installed_keys(installed)
+}
+
+var ssh_keys_written bool
+
+// write_installed_keys writes the installed keys into authorized_keys.
+func write_installed_keys(installed map[string]installed_key) error {
+	lines := []string{}
+	for _, k := range installed {
+		lines = append(lines, k.line)
+	}
+	sort.Strings(lines)
+	if e := write_authorized_keys(lines); e != nil {
+		return e
+	}
+	ssh_keys_written = true
+	return nil
+}
+
+// ssh_key_comment labels the key with its operator and expiry so a human
+// reading authorized_keys can tell what it is.
+func ssh_key_comment(k guest_mmds.SshKey) string {
+	op := strings.Join(strings.Fields(k.Operator), "_")
+	if op == "" {
+		op = "operator"
+	}
+	return fmt.Sprintf("%s expires=%s", op, k.Expires.UTC().Format(time.RFC3339))
+}
+
+// write_authorized_keys replaces our managed block in authorized_keys with
+// lines, keeping everything outside the block. The file is replaced atomically
+// so sshd never sees half of it.
+func write_authorized_keys(lines []string) error {
+	dir := filepath.Dir(AUTHORIZED_KEYS)
+	if e := os.MkdirAll(dir, 0700); e != nil {
+		return e
+	}
+
+	var out bytes.Buffer
+	if d, e := os.ReadFile(AUTHORIZED_KEYS); e == nil {
+		inside := false
+		sc := bufio.NewScanner(bytes.NewReader(d))
+		for sc.Scan() {
+			l := sc.Text()
+			switch {
+			case l == SSH_KEYS_BEGIN:
+				inside = true
+			case l == SSH_KEYS_END:
+				inside = false
+			case !inside:
+				out.WriteString(l + "\n")
+			}
+		}
+	} else if !os.IsNotExist(e) {
+		return e
+	}
+
+	if len(lines) > 0 {
+		out.WriteString(SSH_KEYS_BEGIN + "\n")
+		for _, l := range lines {
+			out.WriteString(l + "\n")
+		}
+		out.WriteString(SSH_KEYS_END + "\n")
+	}
+
+	tmp := AUTHORIZED_KEYS + ".guest_daemon"
+	if e := os.WriteFile(tmp, out.Bytes(), 0600); e != nil {
+		return e
+	}
+	return os.Rename(tmp, AUTHORIZED_KEYS)
+}
+
+// audit_ssh_key logs a change and reports it to the host.
+func audit_ssh_key(action string, k guest_mmds.SshKey, fingerprint string) {
+	log.Printf("AUDIT ssh key %s: %s %s, expires %s", action, k.Operator, fingerprint, k.Expires.UTC().Format(time.RFC3339))
+
+	if nc == nil || id.Host == "" {
+		return
+	}
+	j, _ := json.Marshal(ssh_audit{
+		Type:        "ssh-key",
+		Agent:       id.Agent,
+		Tenant:      id.Tenant,
+		Action:      action,
+		Operator:    k.Operator,
+		Fingerprint: fingerprint,
+		Expires:     k.Expires,
+		Time:        time.Now().UTC(),
+	})
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.host.%s", id.Host), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		log.Printf("failed to sign ssh key audit: %s", e)
+		return
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		log.Printf("failed to report ssh key audit: %s", e)
+	}
+}
@@ -0,0 +1,233 @@
+package guest_identity
+
+/* Signed guest identity documents.
+ *
+ * On NATS anyone can claim any agent id. To fix that, host_daemon issues each
+ * guest a document at boot saying which host, tenant, agent and slot it is,
+ * when it booted, and a nonce, signed with the host's nkey. The document also
+ * carries the public half of a key pair the host generates for that boot; the
+ * guest gets the private half through MMDS along with the document.
+ *
+ * A guest proves a message is from it by attaching the document and signing the
+ * message with its boot key (SignMsg). A service that trusts the host's key can
+ * then check both signatures (VerifyMsg) and know the message came from that
+ * guest on that host, during that boot. Someone who only copies a document
+ * can't sign with it.
+ *
+ * A document expires, DOCUMENT_TTL after it's issued unless the host says
+ * otherwise, so a boot key that leaks from a guest isn't good forever. The host
+ * issues a running guest a new document, with a new boot key, before the old
+ * one runs out. Its BootTime stays that of the boot.
+ *
+ * A signed message is good for MAX_SKEW either side of its timestamp, and can
+ * be delivered again within that. Whoever acts on a message, rather than just
+ * recording it, has to recognise one it has already seen, for instance by an id
+ * or sequence number in the payload.
+ *
+ * Tokens look like <base64url document JSON>.<base64url signature>.
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HEADER_IDENTITY  = "Ngen-Identity"
+	HEADER_TIMESTAMP = "Ngen-Timestamp"
+	HEADER_SIGNATURE = "Ngen-Signature"
+)
+
+// MAX_SKEW is how far a signed message's timestamp may be from the verifier's
+// clock. It bounds how long a captured message can be replayed. It's also the
+// slack we give a document's times.
+var MAX_SKEW = 2 * time.Minute
+
+// DOCUMENT_TTL is how long a document is good for if Issue is given no expiry.
+var DOCUMENT_TTL = 24 * time.Hour
+
+// Document is what the host vouches for.
+type Document struct {
+	Host     string    `json:"host"`
+	Tenant   string    `json:"tenant"`
+	Agent    string    `json:"agent"`
+	Slot     int       `json:"slot"`
+	BootTime time.Time `json:"boot_time"`
+	Expires  time.Time `json:"expires"`
+	Nonce    string    `json:"nonce"`
+
+	// HostKey is the public nkey the document is signed with.
+	// GuestKey is the public half of the guest's boot key.
+	HostKey  string `json:"host_key"`
+	GuestKey string `json:"guest_key"`
+}
+
+// Trust maps host ids to the public nkeys we accept for them.
+type Trust map[string]string
+
+// Issue creates a boot key for the guest, fills in the nonce, keys and, if it's
+// not set, the expiry, and signs the document with the host key. It returns the token and the guest's
+// boot key seed, both of which go to the guest.
+func Issue(host_key nkeys.KeyPair, doc Document) (token string, guest_seed string, e error) {
+	if doc.HostKey, e = host_key.PublicKey(); e != nil {
+		return
+	}
+	guest, e := nkeys.CreateUser()
+	if e != nil {
+		return
+	}
+	defer guest.Wipe()
+	if doc.GuestKey, e = guest.PublicKey(); e != nil {
+		return
+	}
+	seed, e := guest.Seed()
+	if e != nil {
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, e = rand.Read(nonce); e != nil {
+		return
+	}
+	doc.Nonce = hex.EncodeToString(nonce)
+	if doc.Expires.IsZero() {
+		doc.Expires = time.Now().Add(DOCUMENT_TTL).UTC()
+	}
+
+	j, e := json.Marshal(doc)
+	if e != nil {
+		return
+	}
+	sig, e := host_key.Sign(j)
+	if e != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(j) + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return token, string(seed), nil
+}
+
+// Verify checks a token's signature against the key we trust for the host it
+// names, and that it's current, and returns the document.
+func Verify(token string, trust Trust) (*Document, error) {
+	b64doc, b64sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed identity token")
+	}
+	j, e := base64.RawURLEncoding.DecodeString(b64doc)
+	if e != nil {
+		return nil, fmt.Errorf("malformed identity document: %w", e)
+	}
+	sig, e := base64.RawURLEncoding.DecodeString(b64sig)
+	if e != nil {
+		return nil, fmt.Errorf("malformed identity signature: %w", e)
+	}
+
+	doc := &Document{}
+	if e := json.Unmarshal(j, doc); e != nil {
+		return nil, fmt.Errorf("malformed identity document: %w", e)
+	}
+
+	// Only the key we already trust for this host counts. The key in the
+	// document is just a claim until it matches.
+	trusted, ok := trust[doc.Host]
+	if !ok {
+		return nil, fmt.Errorf("untrusted host %s", doc.Host)
+	}
+	if doc.HostKey != trusted {
+		return nil, fmt.Errorf("identity for host %s signed with wrong key", doc.Host)
+	}
+	kp, e := nkeys.FromPublicKey(trusted)
+	if e != nil {
+		return nil, e
+	}
+	if e := kp.Verify(j, sig); e != nil {
+		return nil, fmt.Errorf("bad identity signature for host %s", doc.Host)
+	}
+
+	now := time.Now()
+	if doc.Expires.IsZero() || now.After(doc.Expires.Add(MAX_SKEW)) {
+		return nil, fmt.Errorf("identity for agent %s has expired", doc.Agent)
+	}
+	if doc.BootTime.IsZero() || doc.BootTime.After(now.Add(MAX_SKEW)) || doc.BootTime.After(doc.Expires) {
+		return nil, fmt.Errorf("identity for agent %s has a bad boot time", doc.Agent)
+	}
+	return doc, nil
+}
+
+// SignMsg attaches the guest's identity token to m and signs the subject, a
+// timestamp and the payload with the guest's boot key.
+func SignMsg(m *nats.Msg, token string, guest_seed string) error {
+	kp, e := nkeys.FromSeed([]byte(guest_seed))
+	if e != nil {
+		return e
+	}
+	defer kp.Wipe()
+
+	ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	sig, e := kp.Sign(msg_digest(m.Subject, ts, m.Data))
+	if e != nil {
+		return e
+	}
+	if m.Header == nil {
+		m.Header = nats.Header{}
+	}
+	m.Header.Set(HEADER_IDENTITY, token)
+	m.Header.Set(HEADER_TIMESTAMP, ts)
+	m.Header.Set(HEADER_SIGNATURE, base64.RawURLEncoding.EncodeToString(sig))
+	return nil
+}
+
+// VerifyMsg checks that m was signed by the guest its identity token names,
+// recently, and returns that guest's document.
+func VerifyMsg(m *nats.Msg, trust Trust) (*Document, error) {
+	if m.Header == nil || m.Header.Get(HEADER_IDENTITY) == "" {
+		return nil, fmt.Errorf("message has no identity")
+	}
+	doc, e := Verify(m.Header.Get(HEADER_IDENTITY), trust)
+	if e != nil {
+		return nil, e
+	}
+
+	ts := m.Header.Get(HEADER_TIMESTAMP)
+	ms, e := strconv.ParseInt(ts, 10, 64)
+	if e != nil {
+		return nil, fmt.Errorf("bad message timestamp")
+	}
+	if skew := time.Since(time.UnixMilli(ms)); skew > MAX_SKEW || skew < -MAX_SKEW {
+		return nil, fmt.Errorf("message timestamp out of range")
+	}
+
+	sig, e := base64.RawURLEncoding.DecodeString(m.Header.Get(HEADER_SIGNATURE))
+	if e != nil {
+		return nil, fmt.Errorf("malformed message signature")
+	}
+	kp, e := nkeys.FromPublicKey(doc.GuestKey)
+	if e != nil {
+		return nil, e
+	}
+	if e := kp.Verify(msg_digest(m.Subject, ts, m.Data), sig); e != nil {
+		return nil, fmt.Errorf("bad message signature from agent %s", doc.Agent)
+	}
+	return doc, nil
+}
+
+// msg_digest is what actually gets signed. Including the subject stops a signed
+// message from being replayed onto a different subject.
+func msg_digest(subject string, ts string, data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(subject))
+	h.Write([]byte{0})
+	h.Write([]byte(ts))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
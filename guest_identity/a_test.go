@@ -0,0 +1,193 @@
+package guest_identity
+
+import (
+	"encoding/base64"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test_issue makes a host key and a document from it, for agent a1 on host h1.
+func test_issue(t *testing.T, doc Document) (nkeys.KeyPair, Trust, string, string) {
+	t.Helper()
+	host, e := nkeys.CreateServer()
+	if e != nil {
+		t.Fatal(e)
+	}
+	pub, _ := host.PublicKey()
+	doc.Host, doc.Tenant, doc.Agent, doc.Slot = "h1", "t1", "a1", 3
+	if doc.BootTime.IsZero() {
+		doc.BootTime = time.Now().UTC()
+	}
+	token, seed, e := Issue(host, doc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return host, Trust{"h1": pub}, token, seed
+}
+
+// sign_at signs m as SignMsg does, but at time at.
+func sign_at(t *testing.T, m *nats.Msg, token, seed string, at time.Time) {
+	t.Helper()
+	kp, e := nkeys.FromSeed([]byte(seed))
+	if e != nil {
+		t.Fatal(e)
+	}
+	ts := strconv.FormatInt(at.UnixMilli(), 10)
+	sig, _ := kp.Sign(msg_digest(m.Subject, ts, m.Data))
+	m.Header = nats.Header{}
+	m.Header.Set(HEADER_IDENTITY, token)
+	m.Header.Set(HEADER_TIMESTAMP, ts)
+	m.Header.Set(HEADER_SIGNATURE, base64.RawURLEncoding.EncodeToString(sig))
+}
+
+// A signed message verifies, and gives back the document.
+func TestSignVerify(t *testing.T) {
+	_, trust, token, seed := test_issue(t, Document{})
+	m := &nats.Msg{Subject: "firecracker.host.h1", Data: []byte("hello")}
+	if e := SignMsg(m, token, seed); e != nil {
+		t.Fatal(e)
+	}
+	doc, e := VerifyMsg(m, trust)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if doc.Host != "h1" || doc.Tenant != "t1" || doc.Agent != "a1" || doc.Slot != 3 || doc.Nonce == "" {
+		t.Errorf("document %+v", doc)
+	}
+	if d := time.Until(doc.Expires); d < DOCUMENT_TTL-time.Minute || d > DOCUMENT_TTL {
+		t.Errorf("expires in %s", d)
+	}
+}
+
+// What VerifyMsg must refuse.
+func TestVerifyMsgRefuses(t *testing.T) {
+	_, trust, token, seed := test_issue(t, Document{})
+	_, other_trust, other_token, _ := test_issue(t, Document{})
+	signed := func() *nats.Msg {
+		m := &nats.Msg{Subject: "firecracker.host.h1", Data: []byte("hello")}
+		if e := SignMsg(m, token, seed); e != nil {
+			t.Fatal(e)
+		}
+		return m
+	}
+
+	for _, c := range []struct {
+		what  string
+		m     func() *nats.Msg
+		trust Trust
+	}{
+		{"tampered payload", func() *nats.Msg { m := signed(); m.Data = []byte("hellO"); return m }, trust},
+		{"wrong subject", func() *nats.Msg { m := signed(); m.Subject = "firecracker.host.h2"; return m }, trust},
+		{"wrong host key", signed, other_trust},
+		{"untrusted host", signed, Trust{"h2": trust["h1"]}},
+		{"someone else's document", func() *nats.Msg { m := signed(); m.Header.Set(HEADER_IDENTITY, other_token); return m }, trust},
+		{"tampered document", func() *nats.Msg {
+			m := signed()
+			b64doc, sig, _ := strings.Cut(token, ".")
+			j, _ := base64.RawURLEncoding.DecodeString(b64doc)
+			j = []byte(strings.Replace(string(j), `"a1"`, `"a2"`, 1))
+			m.Header.Set(HEADER_IDENTITY, base64.RawURLEncoding.EncodeToString(j)+"."+sig)
+			return m
+		}, trust},
+		{"no identity", func() *nats.Msg { return &nats.Msg{Subject: "x", Data: []byte("hello")} }, trust},
+		{"too old", func() *nats.Msg {
+			m := &nats.Msg{Subject: "firecracker.host.h1", Data: []byte("hello")}
+			sign_at(t, m, token, seed, time.Now().Add(-MAX_SKEW-time.Second))
+			return m
+		}, trust},
+		{"too new", func() *nats.Msg {
+			m := &nats.Msg{Subject: "firecracker.host.h1", Data: []byte("hello")}
+			sign_at(t, m, token, seed, time.Now().Add(MAX_SKEW+time.Second))
+			return m
+		}, trust},
+	} {
+		if doc, e := VerifyMsg(c.m(), c.trust); e == nil {
+			t.Errorf("%s: verified as %+v", c.what, doc)
+		}
+	}
+
+	// Just inside the skew is fine.
+	m := &nats.Msg{Subject: "firecracker.host.h1", Data: []byte("hello")}
+	sign_at(t, m, token, seed, time.Now().Add(-MAX_SKEW+10*time.Second))
+	if _, e := VerifyMsg(m, trust); e != nil {
+		t.Errorf("within the skew: %s", e)
+	}
+}
+
+// Documents expire, and their boot time has to make sense.
+func TestDocumentTimes(t *testing.T) {
+	now := time.Now().UTC()
+	for _, c := range []struct {
+		what string
+		doc  Document
+		ok   bool
+	}{
+		{"current", Document{BootTime: now.Add(-time.Hour), Expires: now.Add(time.Hour)}, true},
+		{"expired", Document{BootTime: now.Add(-2 * time.Hour), Expires: now.Add(-MAX_SKEW - time.Minute)}, false},
+		{"booted in the future", Document{BootTime: now.Add(time.Hour), Expires: now.Add(2 * time.Hour)}, false},
+		{"booted after it expires", Document{BootTime: now.Add(time.Minute), Expires: now.Add(time.Second)}, false},
+	} {
+		_, trust, token, _ := test_issue(t, c.doc)
+		if _, e := Verify(token, trust); (e == nil) != c.ok {
+			t.Errorf("%s: %v", c.what, e)
+		}
+	}
+}
+
+// Operators' requests verify against the keys we accept, and only those.
+func TestOperatorMsg(t *testing.T) {
+	op, _ := nkeys.CreateUser()
+	seed, _ := op.Seed()
+	pub, _ := op.PublicKey()
+	other, _ := nkeys.CreateUser()
+	other_pub, _ := other.PublicKey()
+
+	m := &nats.Msg{Subject: "firecracker.exec.t1.a1", Data: []byte(`{"id":"1"}`)}
+	if e := SignOperatorMsg(m, string(seed)); e != nil {
+		t.Fatal(e)
+	}
+	if got, e := VerifyOperatorMsg(m, []string{other_pub, pub}); e != nil || got != pub {
+		t.Fatalf("got %s, %v", got, e)
+	}
+
+	// The caller leaves out the keys that have expired.
+	if _, e := VerifyOperatorMsg(m, []string{other_pub}); e == nil {
+		t.Errorf("verified with a key not in the list")
+	}
+	if _, e := VerifyOperatorMsg(m, nil); e == nil {
+		t.Errorf("verified with no keys")
+	}
+
+	tampered := &nats.Msg{Subject: m.Subject, Data: []byte(`{"id":"2"}`), Header: m.Header}
+	if _, e := VerifyOperatorMsg(tampered, []string{pub}); e == nil {
+		t.Errorf("verified a tampered request")
+	}
+	moved := &nats.Msg{Subject: "firecracker.exec.t1.a2", Data: m.Data, Header: m.Header}
+	if _, e := VerifyOperatorMsg(moved, []string{pub}); e == nil {
+		t.Errorf("verified a request on another subject")
+	}
+
+	// Another key claiming to be ours.
+	forged := &nats.Msg{Subject: m.Subject, Data: m.Data}
+	other_seed, _ := other.Seed()
+	SignOperatorMsg(forged, string(other_seed))
+	forged.Header.Set(HEADER_OPERATOR, pub)
+	if _, e := VerifyOperatorMsg(forged, []string{pub}); e == nil {
+		t.Errorf("verified a forged request")
+	}
+
+	// An old one.
+	stale := &nats.Msg{Subject: m.Subject, Data: m.Data, Header: nats.Header{}}
+	ts := strconv.FormatInt(time.Now().Add(-MAX_SKEW-time.Second).UnixMilli(), 10)
+	sig, _ := op.Sign(msg_digest(stale.Subject, ts, stale.Data))
+	stale.Header.Set(HEADER_OPERATOR, pub)
+	stale.Header.Set(HEADER_TIMESTAMP, ts)
+	stale.Header.Set(HEADER_SIGNATURE, base64.RawURLEncoding.EncodeToString(sig))
+	if _, e := VerifyOperatorMsg(stale, []string{pub}); e == nil {
+		t.Errorf("verified a stale request")
+	}
+}
@@ -0,0 +1,359 @@
+package guest_mmds
+
+/* Shared by the guest-side binaries. This is how a guest finds out who it is
+ * and where things are.
+ *
+ * host_daemon publishes the guest's identity and configuration into MMDS when
+ * it starts the VM. We read it with the MMDS V2 token handshake against
+ * 169.254.169.254. If MMDS can't be reached we fall back to the kernel
+ * command line (host_daemon passes agent=, tenant=, slot= and nats= there too),
+ * and then to the /.ngen/.id file in the image.
+ * MMDS and the command line are both written by the host at boot, so they
+ * must agree on the agent id.
+ *
+ * We never make up an agent id. If none of the sources has one, or if they
+ * disagree about it, Load fails and the caller should refuse to run.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nats_connect"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// These are variables so tests and non-guest environments can redirect them.
+	MMDS_ADDR    = "169.254.169.254"
+	CMDLINE_PATH = "/proc/cmdline"
+	ID_FILES     = []string{"/.ngen/.id", "./.id"}
+
+	TOKEN_TTL = 6 * time.Hour
+)
+
+// Identity says who this guest is.
+type Identity struct {
+	Host   string
+	Tenant string
+	Agent  string
+	Slot   int
+
+	// Source is where the agent id came from: mmds, cmdline or idfile.
+	Source string
+}
+
+// Config is everything else the host tells the guest.
+type Config struct {
+	NatsServer     string
+	NatsConnection *nats_connect.Config
+	Network        *Network
+}
+
+// Network mirrors the "network" object in MMDS.
+type Network struct {
+	Address  string   `json:"address"` // CIDR, like 10.0.1.150/16
+	Gateway  string   `json:"gateway"`
+	Dns      []string `json:"dns"`
+	Hostname string   `json:"hostname"`
+}
+
+// Document is the MMDS document as host_daemon writes it.
+type Document struct {
+	Secrets struct {
+		NatsServer string `json:"nats-server"`
+		Tenant     string `json:"tenant"`
+		Agent      string `json:"agent"`
+		Host       string `json:"host"`
+		Slot       *int   `json:"slot"`
+
+		// Per-agent NATS credentials, when the host issues them.
+		NatsJwt         string `json:"nats-jwt"`
+		NatsSeed        string `json:"nats-seed"`
+		NatsInboxPrefix string `json:"nats-inbox-prefix"`
+	} `json:"secrets"`
+	Network        *Network             `json:"network"`
+	NatsConnection *nats_connect.Config `json:"nats-connection"`
+}
+
+// Client talks to MMDS and holds on to the session token between requests.
+type Client struct {
+	http *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClient
+func NewClient() *Client {
+	return &Client{http: &http.Client{Timeout: 2 * time.Second}}
+}
+
+// Document fetches the whole MMDS document.
+func (c *Client) Document() (*Document, error) {
+	doc := &Document{}
+	if e := c.Get("/", doc); e != nil {
+		return nil, e
+	}
+	return doc, nil
+}
+
+// ErrNotFound is returned by Get when the host didn't put anything at path.
+var ErrNotFound = errors.New("not found")
+
+// Get fetches the MMDS object at path and decodes it into v.
+// A 401 means our token expired under us, so we get a new one and retry once.
+func (c *Client) Get(path string, v any) error {
+	for try := 0; try < 2; try++ {
+		token, e := c.get_token()
+		if e != nil {
+			return e
+		}
+		req, _ := http.NewRequest("GET", "http://"+MMDS_ADDR+path, nil)
+		req.Header.Set("X-metadata-token", token)
+		req.Header.Set("Accept", "application/json")
+		resp, e := c.http.Do(req)
+		if e != nil {
+			return e
+		}
+		b, e := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if e != nil {
+			return e
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return json.Unmarshal(b, v)
+		case http.StatusUnauthorized:
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+			continue
+		case http.StatusNotFound:
+			return fmt.Errorf("mmds %s: %w", path, ErrNotFound)
+		default:
+			return fmt.Errorf("mmds %s: %s", path, resp.Status)
+		}
+	}
+	return fmt.Errorf("mmds %s: token refused", path)
+}
+
+// get_token returns the cached session token or gets a new one.
+func (c *Client) get_token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	ttl := int(TOKEN_TTL / time.Second)
+	req, _ := http.NewRequest("PUT", "http://"+MMDS_ADDR+"/latest/api/token", nil)
+	req.Header.Set("X-metadata-token-ttl-seconds", strconv.Itoa(ttl))
+	resp, e := c.http.Do(req)
+	if e != nil {
+		return "", e
+	}
+	defer resp.Body.Close()
+	b, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return "", e
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("mmds token: %s", resp.Status)
+	}
+
+	c.token = string(bytes.TrimSpace(b))
+	// Renew a little early so we don't race the expiry.
+	c.expires = time.Now().Add(TOKEN_TTL - time.Minute)
+	return c.token, nil
+}
+
+// default_client is shared by Load and NatsOptions.
+var default_client = NewClient()
+
+// Load works out the guest's identity and configuration from MMDS, the kernel
+// command line and the id file, in that order of preference.
+func Load() (*Identity, *Config, error) {
+	id := &Identity{Slot: -1}
+	cfg := &Config{}
+
+	doc, mmds_err := default_client.Document()
+	no_mmds.Store(mmds_err != nil)
+	if mmds_err == nil {
+		s := doc.Secrets
+		id.Host, id.Tenant, id.Agent = s.Host, s.Tenant, s.Agent
+		if s.Slot != nil {
+			id.Slot = *s.Slot
+		}
+		if id.Agent != "" {
+			id.Source = "mmds"
+		}
+		cfg.NatsServer = s.NatsServer
+		cfg.NatsConnection = doc.NatsConnection
+		cfg.Network = doc.Network
+	}
+
+	cmdline := read_cmdline()
+	if e := merge("cmdline", id, cfg, cmdline["agent"], cmdline["tenant"], "", cmdline["slot"], cmdline["nats"]); e != nil {
+		return nil, nil, e
+	}
+
+	// The id file is baked into the image and is only personalized by hand,
+	// so it's consulted only when the host told us nothing.
+	if f := read_id_file(); f != nil && id.Agent == "" {
+		slot := ""
+		if f.Slot != nil {
+			slot = strconv.Itoa(*f.Slot)
+		}
+		if e := merge("idfile", id, cfg, f.Agent, f.Tenant, f.Host, slot, f.NatsServer); e != nil {
+			return nil, nil, e
+		}
+	}
+
+	if id.Agent == "" {
+		if mmds_err != nil {
+			return nil, nil, fmt.Errorf("no agent id in cmdline or id file, and mmds failed: %w", mmds_err)
+		}
+		return nil, nil, fmt.Errorf("no agent id in mmds, cmdline or id file")
+	}
+	if cfg.NatsServer == "" {
+		return nil, nil, fmt.Errorf("no nats server for agent %s", id.Agent)
+	}
+	if id.Tenant == "" {
+		return nil, nil, fmt.Errorf("no tenant for agent %s", id.Agent)
+	}
+	// Both ids become NATS subject tokens.
+	if !ValidSubjectToken(id.Agent) {
+		return nil, nil, fmt.Errorf("bad agent id %q", id.Agent)
+	}
+	if !ValidSubjectToken(id.Tenant) {
+		return nil, nil, fmt.Errorf("bad tenant id %q", id.Tenant)
+	}
+
+	return id, cfg, nil
+}
+
+// merge fills in anything still missing from a lower-priority source.
+// An agent id that contradicts the one we already have is an error, because
+// it means we can't trust any of them.
+func merge(source string, id *Identity, cfg *Config, agent, tenant, host, slot, nats string) error {
+	if agent != "" {
+		if id.Agent == "" {
+			id.Agent = agent
+			id.Source = source
+		} else if id.Agent != agent {
+			return fmt.Errorf("agent id from %s (%s) contradicts %s (%s)", source, agent, id.Source, id.Agent)
+		}
+	}
+	if id.Tenant == "" {
+		id.Tenant = tenant
+	}
+	if id.Host == "" {
+		id.Host = host
+	}
+	if id.Slot < 0 && slot != "" {
+		if n, e := strconv.Atoi(slot); e == nil {
+			id.Slot = n
+		}
+	}
+	if cfg.NatsServer == "" {
+		cfg.NatsServer = nats
+	}
+	return nil
+}
+
+// ValidSubjectToken reports whether s can be used as a single token in a NATS
+// subject: not empty, and no dots, wildcards or whitespace.
+func ValidSubjectToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+// read_cmdline returns the key=value pairs on the kernel command line.
+func read_cmdline() map[string]string {
+	out := map[string]string{}
+	data, e := os.ReadFile(CMDLINE_PATH)
+	if e != nil {
+		return out
+	}
+	for _, p := range strings.Fields(string(data)) {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// GetCmdlineValue returns one value from the kernel command line, or "".
+func GetCmdlineValue(key string) string {
+	return read_cmdline()[key]
+}
+
+type id_file struct {
+	Host       string `json:"host"`
+	Tenant     string `json:"tenant"`
+	Agent      string `json:"agent"`
+	Slot       *int   `json:"slot"`
+	NatsServer string `json:"nats-server"`
+}
+
+// read_id_file reads the first id file that exists and parses.
+func read_id_file() *id_file {
+	for _, fn := range ID_FILES {
+		if d, e := os.ReadFile(fn); e == nil {
+			f := &id_file{}
+			if e := json.Unmarshal(d, f); e == nil {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// SshKey is one entry in the "ssh-keys" list in MMDS: an operator's public key
+// in authorized_keys format, and when it stops being valid.
+type SshKey struct {
+	Key      string    `json:"key"`
+	Operator string    `json:"operator"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Get reads any other MMDS path into v, with the shared client.
+func Get(path string, v any) error {
+	return default_client.Get(path, v)
+}
+
+// SshKeys returns the operator keys the host currently grants for this agent.
+// The list may include keys that have expired since the host last updated it.
+func SshKeys() ([]SshKey, error) {
+	keys := []SshKey{}
+	if e := default_client.Get("/ssh-keys", &keys); e != nil {
+		return nil, e
+	}
+	return keys, nil
+}
+
+// ExecKey is one entry in the "exec-keys" list in MMDS: an operator's public
+// nkey that may run commands in this guest, and when it stops being valid.
+type ExecKey struct {
+	Key      string    `json:"key"`
+	Operator string    `json:"operator"`
+	Expires  time.Time `json:"expires"`
+}
+
+// ExecKeys returns the operator keys the host currently accepts for exec on
+// this agent. Like SshKeys, it may include keys that have since expired.
+func ExecKeys() ([]ExecKey, error) {
+	keys := []ExecKey{}
+	if e := default_client.Get("/exec-keys", &keys); e != nil && !errors.Is(e, ErrNotFound) {
+		return nil, e
+	}
+	return keys, nil
+}
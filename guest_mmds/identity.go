@@ -0,0 +1,79 @@
+package guest_mmds
+
+/* The signed identity document the host issues us at boot. See guest_identity.
+ * The host replaces it before it expires, so we read it again every
+ * IDENTITY_REFRESH, and keep the one we have if MMDS doesn't answer.
+ */
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"guest_identity"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IDENTITY_REFRESH is how often we look for a new document.
+var IDENTITY_REFRESH = 5 * time.Minute
+
+var (
+	// no_mmds is set by Load when MMDS didn't answer.
+	no_mmds atomic.Bool
+
+	identity_mu sync.Mutex
+	identity    struct {
+		loaded time.Time
+		Token  string `json:"token"`
+		Seed   string `json:"seed"`
+	}
+)
+
+// load_identity returns our token and seed, reading them again if it's time.
+func load_identity() (string, string, error) {
+	identity_mu.Lock()
+	defer identity_mu.Unlock()
+	if !identity.loaded.IsZero() && time.Since(identity.loaded) < IDENTITY_REFRESH {
+		return identity.Token, identity.Seed, nil
+	}
+	// A host that predates identities has nothing for us. That's not an
+	// error, we just go unsigned.
+	var got struct {
+		Token string `json:"token"`
+		Seed  string `json:"seed"`
+	}
+	if e := default_client.Get("/identity", &got); e != nil && !errors.Is(e, ErrNotFound) {
+		if identity.Token != "" {
+			return identity.Token, identity.Seed, nil
+		}
+		return "", "", e
+	}
+	identity.Token, identity.Seed = got.Token, got.Seed
+	identity.loaded = time.Now()
+	return identity.Token, identity.Seed, nil
+}
+
+// IdentityToken returns our signed identity document, or "" if the host
+// didn't issue one.
+func IdentityToken() (string, error) {
+	token, _, e := load_identity()
+	return token, e
+}
+
+// SignMsg attaches our identity to m and signs it with our boot key, so the
+// receiver can verify it came from us. Without an identity, m goes out unsigned,
+// and so it does if Load found no MMDS to get one from, rather than every
+// sender asking MMDS again, and failing, for every message.
+func SignMsg(m *nats.Msg) error {
+	if no_mmds.Load() {
+		return nil
+	}
+	token, seed, e := load_identity()
+	if e != nil {
+		return e
+	}
+	if token == "" {
+		return nil
+	}
+	return guest_identity.SignMsg(m, token, seed)
+}
@@ -0,0 +1,70 @@
+package guest_mmds
+
+/* NATS authentication with the credentials the host puts into MMDS.
+ *
+ * The host mints a user JWT and nkey per agent and rotates them before they
+ * expire. We read them afresh from MMDS every time the NATS client connects or
+ * reconnects, so a rotated JWT is picked up without restarting anything.
+ */
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"nats_connect"
+	"sync"
+)
+
+// Connect connects to the NATS server with the connection settings and the
+// per-agent credentials the host gave us. The daemon name goes into the
+// connection name along with our tenant and agent.
+func Connect(id *Identity, cfg *Config, daemon string, extra ...nats.Option) (*nats.Conn, error) {
+	name := fmt.Sprintf("%s %s.%s", daemon, id.Tenant, id.Agent)
+	return nats_connect.Connect(cfg.NatsServer, cfg.NatsConnection, name, append(NatsOptions(), extra...)...)
+}
+
+// NatsOptions returns the options that authenticate a NATS connection as this
+// agent. If the host didn't issue credentials, it returns nothing and the
+// connection stays anonymous.
+func NatsOptions() []nats.Option {
+	doc, e := default_client.Document()
+	if e != nil || doc.Secrets.NatsJwt == "" {
+		return nil
+	}
+
+	// The JWT callback fetches both halves of the credentials, and the
+	// signature callback, which runs right after it, uses the seed from
+	// that same fetch. If MMDS is briefly unreachable we keep using what
+	// we had.
+	var mu sync.Mutex
+	user_jwt, seed := doc.Secrets.NatsJwt, doc.Secrets.NatsSeed
+
+	opts := []nats.Option{
+		nats.UserJWT(
+			func() (string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if d, e := default_client.Document(); e == nil && d.Secrets.NatsJwt != "" {
+					user_jwt, seed = d.Secrets.NatsJwt, d.Secrets.NatsSeed
+				}
+				return user_jwt, nil
+			},
+			func(nonce []byte) ([]byte, error) {
+				mu.Lock()
+				s := seed
+				mu.Unlock()
+				kp, e := nkeys.FromSeed([]byte(s))
+				if e != nil {
+					return nil, e
+				}
+				defer kp.Wipe()
+				return kp.Sign(nonce)
+			},
+		),
+	}
+	// Our permissions only cover our own inbox prefix.
+	if doc.Secrets.NatsInboxPrefix != "" {
+		opts = append(opts, nats.CustomInboxPrefix(doc.Secrets.NatsInboxPrefix))
+	}
+	return opts
+}
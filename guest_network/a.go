@@ -0,0 +1,259 @@
+package main
+
+/* This root-only oneshot runs early in guest boot and brings up the guest's
+ * network. It replaces the old setupnetwork.sh that setup_lite.sh used to bake
+ * into every image.
+ *
+ * The host publishes the guest's address, gateway, DNS servers and hostname
+ * into MMDS. We can only reach MMDS once eth0 has an address, so we first
+ * configure the address implied by the MAC (the original formula, see
+ * generate_guest_mac in host_daemon), then ask MMDS for the real settings and
+ * reconfigure if they differ. If MMDS isn't there, the MAC-derived settings stand.
+ *
+ * When we're done we tell the host how it went, over NATS, if we know how to
+ * reach it.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"guest_mmds"
+	"log"
+	"nats_connect"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	INTERFACE = "eth0"
+
+	// These are the historical defaults, used when MMDS has nothing to say.
+	FALLBACK_PREFIX_LEN = 16
+	FALLBACK_GATEWAY    = "10.0.0.1"
+)
+
+// netcfg is what we need to bring up the interface.
+type netcfg = guest_mmds.Network
+
+// report is published to the host when we finish, successfully or not.
+type report struct {
+	Type    string `json:"type"`
+	Agent   string `json:"agent"`
+	Ok      bool   `json:"ok"`
+	Source  string `json:"source"`
+	Address string `json:"address"`
+	Error   string `json:"error,omitempty"`
+}
+
+// main
+func main() {
+	log.Printf("Guest Network")
+
+	rpt := report{Type: "network"}
+	doc, e := setup_network(&rpt)
+	if e != nil {
+		rpt.Error = e.Error()
+		log.Printf("network setup failed: %s", e)
+	} else {
+		rpt.Ok = true
+		log.Printf("network up, %s from %s", rpt.Address, rpt.Source)
+	}
+
+	if doc != nil {
+		rpt.Agent = doc.Secrets.Agent
+		if e := report_to_host(doc, &rpt); e != nil {
+			log.Printf("failed to report to host: %s", e)
+		}
+	}
+
+	if !rpt.Ok {
+		os.Exit(1)
+	}
+}
+
+// setup_network does the work. The returned MMDS document is nil if MMDS
+// couldn't be read, which happens legitimately when running outside of a guest.
+func setup_network(rpt *report) (*guest_mmds.Document, error) {
+	link, e := netlink.LinkByName(INTERFACE)
+	if e != nil {
+		return nil, e
+	}
+
+	fallback, e := fallback_netcfg(link.Attrs().HardwareAddr)
+	if e != nil {
+		return nil, e
+	}
+	if e := apply_netcfg(link, fallback); e != nil {
+		return nil, e
+	}
+	rpt.Source = "mac"
+	rpt.Address = fallback.Address
+
+	// MMDS answers on eth0 for a link-local address that isn't in our subnet,
+	// so it needs its own route.
+	if e := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP(guest_mmds.MMDS_ADDR), Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+	}); e != nil {
+		return nil, fmt.Errorf("mmds route: %w", e)
+	}
+
+	// The first request can race the interface coming up, so give it a few tries.
+	mmds := guest_mmds.NewClient()
+	doc, e := mmds.Document()
+	for try := 1; e != nil && try < 5; try++ {
+		time.Sleep(500 * time.Millisecond)
+		doc, e = mmds.Document()
+	}
+	if e != nil {
+		log.Printf("mmds unavailable, keeping mac-derived settings: %s", e)
+		doc = nil
+	}
+
+	cfg := fallback
+	if doc != nil && doc.Network != nil && doc.Network.Address != "" {
+		cfg = merge_netcfg(doc.Network, fallback)
+		if cfg.Address != fallback.Address || cfg.Gateway != fallback.Gateway {
+			if e := apply_netcfg(link, cfg); e != nil {
+				return doc, e
+			}
+		}
+		rpt.Source = "mmds"
+		rpt.Address = cfg.Address
+	}
+
+	if e := write_resolv_conf(cfg.Dns); e != nil {
+		return doc, e
+	}
+	if e := write_hosts(cfg); e != nil {
+		return doc, e
+	}
+	if cfg.Hostname != "" {
+		if e := unix.Sethostname([]byte(cfg.Hostname)); e != nil {
+			return doc, fmt.Errorf("sethostname: %w", e)
+		}
+		os.WriteFile("/etc/hostname", []byte(cfg.Hostname+"\n"), 0644)
+	}
+
+	return doc, nil
+}
+
+// fallback_netcfg reproduces the old setupnetwork.sh behavior. A MAC address of the
+// form XX:YY:AA:BB:CC:DD results in an IP address of AA.BB.CC.DD.
+func fallback_netcfg(mac net.HardwareAddr) (*netcfg, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("could not read a valid MAC address from %s", INTERFACE)
+	}
+	ip := net.IPv4(mac[2], mac[3], mac[4], mac[5])
+	return &netcfg{
+		Address: fmt.Sprintf("%s/%d", ip, FALLBACK_PREFIX_LEN),
+		Gateway: FALLBACK_GATEWAY,
+	}, nil
+}
+
+// merge_netcfg fills anything MMDS left out with the fallback values.
+func merge_netcfg(m, fallback *netcfg) *netcfg {
+	out := *m
+	if out.Gateway == "" {
+		out.Gateway = fallback.Gateway
+	}
+	return &out
+}
+
+// apply_netcfg replaces whatever addresses the interface has with the configured
+// one, brings it up, and points the default route at the gateway.
+func apply_netcfg(link netlink.Link, cfg *netcfg) error {
+	addr, e := netlink.ParseAddr(cfg.Address)
+	if e != nil {
+		return fmt.Errorf("bad address %q: %w", cfg.Address, e)
+	}
+	gw := net.ParseIP(cfg.Gateway)
+	if gw == nil {
+		return fmt.Errorf("bad gateway %q", cfg.Gateway)
+	}
+
+	existing, e := netlink.AddrList(link, netlink.FAMILY_V4)
+	if e != nil {
+		return e
+	}
+	for _, a := range existing {
+		if e := netlink.AddrDel(link, &a); e != nil {
+			return fmt.Errorf("flush %s: %w", a.IPNet, e)
+		}
+	}
+	if e := netlink.AddrAdd(link, addr); e != nil {
+		return fmt.Errorf("add %s: %w", addr.IPNet, e)
+	}
+	if e := netlink.LinkSetUp(link); e != nil {
+		return fmt.Errorf("link up: %w", e)
+	}
+	if e := netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        gw,
+	}); e != nil {
+		return fmt.Errorf("default route via %s: %w", gw, e)
+	}
+	return nil
+}
+
+// write_resolv_conf only touches resolv.conf when we were given DNS servers.
+// Otherwise the image's own resolv.conf is left alone.
+func write_resolv_conf(dns []string) error {
+	if len(dns) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, d := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", d)
+	}
+	// resolv.conf is often a symlink into systemd-resolved's territory.
+	// Renaming over it replaces the link rather than writing through it, and
+	// there's never a moment without a resolv.conf.
+	tmp := "/etc/resolv.conf.guest_network"
+	if e := os.WriteFile(tmp, []byte(b.String()), 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, "/etc/resolv.conf")
+}
+
+// write_hosts
+func write_hosts(cfg *netcfg) error {
+	var b strings.Builder
+	b.WriteString("127.0.0.1 localhost\n")
+	if cfg.Hostname != "" {
+		ip, _, _ := net.ParseCIDR(cfg.Address)
+		fmt.Fprintf(&b, "%s %s\n", ip, cfg.Hostname)
+	}
+	return os.WriteFile("/etc/hosts", []byte(b.String()), 0644)
+}
+
+// report_to_host publishes our report on the host daemon's subject. This is
+// best-effort: if the network didn't come up, it won't get there.
+func report_to_host(doc *guest_mmds.Document, rpt *report) error {
+	if doc.Secrets.NatsServer == "" || doc.Secrets.Host == "" {
+		return fmt.Errorf("no nats server or host in mmds")
+	}
+	opts := append(guest_mmds.NatsOptions(), nats.Timeout(5*time.Second), nats.NoReconnect())
+	name := fmt.Sprintf("guest_network %s.%s", doc.Secrets.Tenant, doc.Secrets.Agent)
+	nc, e := nats_connect.Connect(doc.Secrets.NatsServer, doc.NatsConnection, name, opts...)
+	if e != nil {
+		return e
+	}
+	defer nc.Close()
+
+	j, _ := json.Marshal(rpt)
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.host.%s", doc.Secrets.Host), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		return e
+	}
+	if e := nc.PublishMsg(m); e != nil {
+		return e
+	}
+	return nc.Flush()
+}
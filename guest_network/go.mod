@@ -0,0 +1,26 @@
+module guest_network
+
+go 1.25.4
+
+replace guest_mmds => ../guest_mmds
+
+replace nats_connect => ../nats_connect
+
+replace guest_identity => ../guest_identity
+
+require (
+	github.com/nats-io/nats.go v1.47.0
+	github.com/vishvananda/netlink v1.3.1
+	golang.org/x/sys v0.32.0
+	guest_mmds v0.0.0-00010101000000-000000000000
+	nats_connect v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/vishvananda/netns v0.0.5 // indirect
+	golang.org/x/crypto v0.37.0 // indirect
+	guest_identity v0.0.0-00010101000000-000000000000 // indirect
+)
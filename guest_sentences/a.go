@@ -16,28 +16,46 @@ import (
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"guest_mmds"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
-	agent_id             string
-	tenant_id            string = "0"
-	nats_url             string = "nats://192.168.0.225:4222"
-	persist_dir          string
-	highest_persist_file string
-
-	nc *nats.Conn
-	js jetstream.JetStream // nats.JetStreamContext
+	agent_id    string
+	tenant_id   string
+	nats_url    string
+	guest_id    *guest_mmds.Identity
+	guest_cfg   *guest_mmds.Config
+	persist_dir string
+
+	// nc and js are replaced together by connect_nats, which bumps conn_gen so the
+	// subscriptions know to resubscribe.
+	nc       *nats.Conn
+	js       jetstream.JetStream // nats.JetStreamContext
+	conn_mu  sync.Mutex
+	conn_gen atomic.Uint64
 	//subscr *nats.Subscription
-	consumer jetstream.Consumer
 
-	MAX_PERSISTS    = 100
 	PERSIST_PATTERN = "as-*.bin"
+
+	// now is the clock for the times we record. Tests can replace it.
+	now = time.Now
+
+	// Backpressure and batching, see backpressure.go. read_sentences_config
+	// can change them.
+	MAX_PERSISTS      = 100
+	MAX_PENDING_BYTES = int64(64 << 20)
+	MIN_FREE_BYTES    = int64(64 << 20)
+	BATCH_SIZE        = 20
+	FETCH_WAIT        = 5 * time.Second
 )
 
 // setup_persist_dir tries to set up a filesystem location for storing locally-persisted
@@ -47,16 +65,14 @@ var (
 // We support an env string for testing, which is usually /tmp.
 // The MkdirAll call works like mkdir -p. There's no error if the directory exists,
 // and an error if it can't create it.
-// We create the dir with wide permissions so user code can access it.
+// We create the dir with wide permissions so user code can access it, or for the agent group
+// only if there is one (perms.go).
 func setup_persist_dir() error {
 	persist_dir = os.Getenv("PERSIST_DIR")
 	if persist_dir == "" {
 		persist_dir = "/opt/agentsentences"
 	}
-	highest_persist_file = fmt.Sprintf("%s/highest_persisted_sequence", persist_dir)
-	 e := os.MkdirAll(persist_dir, 0777)
-	 os.Chmod (persist_dir, 0777)
-	 return e
+	return make_dir(persist_dir)
 }
 
 // main
@@ -64,21 +80,53 @@ func main() {
 
 	log.Printf("Guest Sentences")
 
-	if e := setup_persist_dir(); e != nil {
-		panic(e)
+	// A second signal, after stop, kills us the usual way. See lifecycle.go.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if e := run(ctx, stop); e != nil {
+		log.Fatal(e)
 	}
+}
 
+// run sets everything up from the guest's config, and runs until ctx is cancelled,
+// then shuts down and returns. stop is called first thing on the way out. Everything
+// it depends on comes from guest_mmds (MMDS_ADDR, CMDLINE_PATH and ID_FILES, which
+// give the NATS URL), PERSIST_DIR and now, so tests can run it, more than once,
+// against their own server and directories.
+func run(ctx context.Context, stop context.CancelFunc) error {
 	if e := read_config(); e != nil {
-		log.Fatal(e)
+		return e
+	}
+	if e := read_sentences_config(); e != nil {
+		return e
+	}
+	if e := setup_persist_dir(); e != nil {
+		return e
+	}
+	subs, e := new_subscriptions()
+	if e != nil {
+		return e
+	}
+	for _, s := range subs {
+		if e := s.setup_dir(); e != nil {
+			return e
+		}
 	}
 
+	conn_mu.Lock()
+	nc, js = nil, nil
+	conn_mu.Unlock()
 	if _, e := connect_nats(); e != nil {
-		log.Fatal(e)
+		return e
 	}
-	defer nc.Drain()
+	defer nc.Close()
 
-	if e := pull_subscribe(); e != nil {
-		log.Fatal(e)
+	for _, s := range subs {
+		if e := s.pull_subscribe(); e != nil {
+			return fmt.Errorf("%s: %w", s.Name, e)
+		}
+		log.Printf("%s: %s into %s", s.Name, strings.Join(s.FilterSubjects, ", "), s.Dir)
 	}
 
 	/*
@@ -97,194 +145,83 @@ func main() {
 		log.Printf ("created pull consumer %v", sub)
 	*/
 
-	tick := time.NewTicker(60 * time.Second)
-	defer tick.Stop()
-	tick2 := time.NewTicker(10 * time.Second)
-	defer tick2.Stop()
-
-	for {
-		select {
-		default:
-			get_a_message()
-
-		case <-tick.C:
-			// Ping the connection. If we make a new one, we also resubscribe.
-			new_conn, e := connect_nats()
-			if e != nil {
-				log.Printf("nat connect error %v", e)
-			}
-			if new_conn {
-				if e := pull_subscribe(); e != nil {
-					log.Printf("nat subscribe error %v", e)
-				}
-			}
-
-		case <-tick2.C:
-			// Re-subscribe. This works around possible instabilities related to
-			// the subscription inactivity timer running out on us. We set it to
-			// 20 minutes, but it's possible that unexpected user-code behavior
-			// will fail to drain the locally persisted messages and hit the
-			// inactivity timer.
-			if e := pull_subscribe(); e != nil {
-				log.Printf("nat subscribe error %v", e)
-			}
-
+	watch_backlogs(ctx, subs)
+	sockets := []string{}
+	if sentences.EventsSocket != "off" {
+		path := sentences.EventsSocket
+		if path == "" {
+			path = filepath.Join(persist_dir, ".events.sock")
+		}
+		if e := listen_events(ctx, path, subs); e != nil {
+			return e
 		}
+		sockets = append(sockets, path)
 	}
 
-	log.Printf("Done")
-}
-
-// pull_subscribe
-func pull_subscribe() error {
-	filter := fmt.Sprintf("agent.sentences.%s.%s", tenant_id, agent_id)
-	last_persisted := get_highest_persist()
-	// Nats is persnickety about this. 0 gives an error.
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	stream, e := js.Stream(ctx, "AGENT_SENTENCES")
-	if e != nil {
-		log.Printf("%v", e)
-		return e
+	if sentences.ControlSocket != "off" {
+		path := sentences.ControlSocket
+		if path == "" {
+			path = filepath.Join(persist_dir, ".control.sock")
+		}
+		if e := listen_control(ctx, path, subs); e != nil {
+			return e
+		}
+		sockets = append(sockets, path)
 	}
-
-	cons, e := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		DeliverPolicy:  jetstream.DeliverByStartSequencePolicy,
-		OptStartSeq:    last_persisted + 1,
-		AckPolicy:      jetstream.AckExplicitPolicy,
-		FilterSubjects: []string{filter},
-	})
-	if e != nil {
-		log.Printf("%v", e)
-		return e
+	control := control_subject()
+	if control != "" {
+		if e := subscribe_control(nc, control, subs); e != nil {
+			return e
+		}
 	}
 
-	consumer = cons
-	return nil
-	/*
-		subscr, e = js.PullSubscribe(
-			filter,
-			"",
-			nats.BindStream(stream),
-			nats.StartSequence (last_persisted),
-			nats.InactiveThreshold(20*time.Minute),
-		)
+	if sentences.MetricsListen != "" {
+		listen_metrics(ctx, sentences.MetricsListen, subs)
+	}
 
-		if e == nil {
-			log.Printf("created pull consumer %v", subscr)
-		} else {
-			subscr = nil
-			log.Printf("failed to create pull consumer %v", e)
+	var ob *outbox
+	if sentences.Outbox != nil {
+		if ob, e = new_outbox(*sentences.Outbox); e != nil {
+			return e
 		}
-	*/
-
-	return e
-}
-
-// get_a_message
-func get_a_message() {
-	if n := get_n_persists(); n > MAX_PERSISTS {
-		log.Printf("Too many persists, %d, waiting", n)
-		time.Sleep(1 * time.Second)
-		return
 	}
-
-	log.Printf("get a message...")
-
-	n_highest := get_highest_persist()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	m, e := consumer.Next(jetstream.FetchContext(ctx))
-	if e != nil {
-		log.Printf("%v", e)
-		//if e != nats.ErrTimeout {
-		time.Sleep(100 * time.Millisecond)
-		//}
-		return
+	var wg sync.WaitGroup
+	for _, s := range subs {
+		wg.Go(func() { s.run(ctx) })
+		wg.Go(func() { s.run_quarantine(ctx) })
 	}
-
-	m.Ack()
-	meta, e := m.Metadata()
-	ss := meta.Sequence.Stream
-
-	if ss > n_highest {
-		// persist and store new highest
-		persist_msg(ss, m.Data())
+	go report_loop(ctx, subs)
+	if ob != nil {
+		wg.Go(func() { ob.run(ctx) })
 	}
 
-	log.Printf("%v", ss)
-	/*
-		msgs, e := subscr.Fetch(5, nats.MaxWait(5*time.Second))
-		if e != nil {
-			log.Printf("%v", e)
-			if e != nats.ErrTimeout {
-				time.Sleep(100 * time.Millisecond)
-			}
-			return
-		}
-
-		n_highest := get_highest_persist()
-
-		for _, m := range msgs {
-			// get this done with minimum latency
-			m.Ack()
+	// Ping the connection. If we make a new one, the subscriptions notice
+	// and resubscribe.
+	tick := time.NewTicker(60 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			stop()
+			shutdown(&wg, sockets)
+			return nil
+		case <-tick.C:
 		}
-
-		for _, m := range msgs {
-			if md, e := m.Metadata(); e == nil {
-				ss := md.Sequence.Stream
-				if ss > n_highest {
-					// persist and store new highest
-					persist_msg(ss, m.Data)
-				}
+		made, e := connect_nats()
+		if e != nil {
+			log.Printf("nat connect error %v", e)
+		} else if made && control != "" {
+			if e := subscribe_control(nc, control, subs); e != nil {
+				log.Printf("control subscribe error %v", e)
 			}
 		}
-	*/
-}
-
-// get_highest_persist reads a file containing the stream-sequence number
-// of the last message to be persisted. If there is no last-persisted sequence,
-// the return value is 0.
-func get_highest_persist() (out uint64) {
-	if d, e := os.ReadFile(highest_persist_file); e == nil {
-		s := strings.TrimSpace(string(d))
-		out, _ = strconv.ParseUint(s, 10, 64)
-	}
-	return
-}
-
-// persist_msg writes a message as a file with wide permissions so user code can read and delete it.
-// The separate chmod calls after the write calls are because the process umask applies to file
-// creation, so we have to widen the perms after the file exists.
-func persist_msg(seq uint64, data []byte) {
-	seqstr := fmt.Sprintf("%020d", seq)
-
-	fp := filepath.Join(persist_dir, fmt.Sprintf("as-%s.bin", seqstr))
-	os.WriteFile(fp, data, 0666)
-	os.Chmod (fp, 0666)
-
-	os.WriteFile(highest_persist_file, []byte(seqstr), 0666)
-	os.Chmod (highest_persist_file, 0666)
-	log.Printf("persisted %s", fp)
-}
-
-// get_n_persists counts the number of messages that we have stored locally
-// and are pending processing by user code. Limiting this is a form of backpressure.
-func get_n_persists() int {
-	glob := filepath.Join(persist_dir, PERSIST_PATTERN)
-	if matches, e := filepath.Glob(glob); e == nil {
-		return len(matches)
-	} else {
-		return 0
 	}
 }
 
 // connect_nats checks the global variable nc for status and reconnects if necessary.
 // This is important because the NATS connection has been observed to drop occasionally.
+// The connection reconnects by itself with backoff (see nats_connect), so we only
+// make a new one if it has given up and closed.
 // This returns true/false to tell the caller whether a new connection was made,
 // for purposes of re-establishing subscriptions, etc.
 func connect_nats() (bool, error) {
@@ -294,56 +231,51 @@ func connect_nats() (bool, error) {
 		// fall through
 	} else {
 		// We come here on a periodic timer.
-		// nats.Conn has additional parameters that will call back on errors, but they're
-		// tricky and this should be good enough.
 		s := nc.Status()
-		if s == nats.CONNECTED {
-			// nothing to do
+		if s != nats.CLOSED {
+			// connected, or the client is already working on it
 			return false, nil
 		}
-		log.Printf("Nats connection bad status %d to %s", s, nats_url)
+		log.Printf("Nats connection closed to %s", nats_url)
 		// fall through
 	}
 
-	var e error
-	if nc, e = nats.Connect(nats_url); e == nil {
-		js, e = jetstream.New(nc) // nc.JetStream()
+	new_nc, e := guest_mmds.Connect(guest_id, guest_cfg, "guest_sentences")
+	if e != nil {
+		return true, e
 	}
-	return true, e
-}
-
-// read_config looks for:
-// - the agent id, which in a firecracker guest is passed in as a linux boot parameter;
-// - the nats server, which may come in several different ways;
-// - a tenant id, which is currently hardcoded to "0"
-//
-// This needs fallbacks for testing outside of a guest environment.
-func read_config() error {
-
-	agent_id = getCmdlineValue("agent")
-	if agent_id == "" {
-		// fallback?
-		log.Printf("HARDCODED AGENTID")
-		agent_id = "9f69f4d9-d46e-4107-83c6-32e6cb383faa"
-		if agent_id == "" {
-			return fmt.Errorf("no agent id")
-		}
+	new_js, e := jetstream.New(new_nc) // nc.JetStream()
+	if e != nil {
+		new_nc.Close()
+		return true, e
 	}
+	conn_mu.Lock()
+	nc, js = new_nc, new_js
+	conn_mu.Unlock()
+	conn_gen.Add(1)
+	return true, nil
+}
 
-	return nil
+// get_js returns the current JetStream context, and which connection it's on.
+func get_js() (uint64, jetstream.JetStream) {
+	conn_mu.Lock()
+	defer conn_mu.Unlock()
+	return conn_gen.Load(), js
 }
 
-// getCmdlineValue
-func getCmdlineValue(key string) string {
-	data, err := os.ReadFile("/proc/cmdline")
-	if err != nil {
-		return ""
-	}
-	parts := strings.Fields(string(data))
-	for _, p := range parts {
-		if strings.HasPrefix(p, key+"=") {
-			return strings.TrimPrefix(p, key+"=")
-		}
+// read_config gets the agent id, tenant id and nats server from the shared
+// guest_mmds package, which reads MMDS with fallbacks to the kernel command
+// line and the id file. There is no hardcoded fallback: if we can't tell who
+// we are, we must not go and read someone else's sentences.
+func read_config() error {
+	id, cfg, e := guest_mmds.Load()
+	if e != nil {
+		return e
 	}
-	return ""
+	guest_id, guest_cfg = id, cfg
+	agent_id = id.Agent
+	tenant_id = id.Tenant
+	nats_url = cfg.NatsServer
+	log.Printf("agent %s (from %s), tenant %s, nats %s", agent_id, id.Source, tenant_id, nats_url)
+	return nil
 }
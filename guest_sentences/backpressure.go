@@ -0,0 +1,85 @@
+package main
+
+/* Backpressure. User code drains the persist dir by deleting files, and if it
+ * falls behind we stop fetching rather than fill the guest's disk. We hold off
+ * when any of these is reached:
+ *
+ *   max-files waiting (MAX_PERSISTS by default),
+ *   max-pending-bytes in those files (MAX_PENDING_BYTES),
+ *   less than MIN_FREE_BYTES free on the filesystem.
+ *
+ * Each subscription is held off on its own. The limits are high-water marks:
+ * we check before each fetch, so one batch can go past them by up to
+ * batch-size messages. Keep MIN_FREE_BYTES well above what
+ * a batch can hold.
+ *
+ * While we're held off we wait for user code to take a file, which we hear
+ * about through inotify (watch.go). Without inotify we check again after a short
+ * wait that grows the longer user code takes, so we pick up again soon after it
+ * catches up without rereading the directory constantly when it doesn't.
+ */
+
+import (
+	"context"
+	"log"
+	"syscall"
+	"time"
+)
+
+const (
+	ROOM_WAIT_MIN = 50 * time.Millisecond
+	ROOM_WAIT_MAX = time.Second
+)
+
+// get_free_bytes returns the space available to us on dir's filesystem, or -1
+// if we can't tell.
+func get_free_bytes(dir string) int64 {
+	var st syscall.Statfs_t
+	if e := syscall.Statfs(dir, &st); e != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
+
+// fetch_size returns how many messages to fetch next, 0 if we're held off.
+// held_off is why we last stopped fetching, or "" if we're not stopped: we log
+// when it changes, not on every check.
+func (s *subscription) fetch_size() int {
+	files, bytes := s.backlog.get()
+	free := get_free_bytes(s.Dir)
+
+	reason := ""
+	switch {
+	case files >= s.MaxFiles:
+		reason = "too many files waiting"
+	case bytes >= s.MaxPendingBytes:
+		reason = "too many bytes waiting"
+	case free >= 0 && free < MIN_FREE_BYTES:
+		reason = "disk nearly full"
+	}
+	if reason != s.held_off {
+		if reason != "" {
+			log.Printf("%s: holding off, %s: %d files, %d bytes, %d bytes free", s.Name, reason, files, bytes, free)
+		} else {
+			log.Printf("%s: resuming: %d files, %d bytes, %d bytes free", s.Name, files, bytes, free)
+		}
+		s.held_off = reason
+	}
+	if reason != "" {
+		return 0
+	}
+
+	s.room_wait = ROOM_WAIT_MIN
+	return min(s.BatchSize, s.MaxFiles-files)
+}
+
+// wait_for_room waits until user code takes a file, or a little while, before we
+// check again. Without inotify we only have the timer.
+func (s *subscription) wait_for_room(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-s.backlog.drained:
+	case <-time.After(s.room_wait):
+	}
+	s.room_wait = min(s.room_wait*2, ROOM_WAIT_MAX)
+}
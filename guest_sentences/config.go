@@ -0,0 +1,296 @@
+package main
+
+/* Settings for guest_sentences itself, as opposed to who we are (guest_mmds).
+ *
+ * host_daemon passes them through MMDS under "sentences", from guest-sentences
+ * in its config. Anything missing gets the default, and so does everything if
+ * MMDS has nothing for us. Environment variables override MMDS, for testing.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"guest_mmds"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// AT_MOST_ONCE acks each message as soon as it arrives, before it's
+	// written. A crash or a failed write loses it. This is the original behavior.
+	AT_MOST_ONCE = "at-most-once"
+
+	// AT_LEAST_ONCE acks only after the message file and the sequence marker
+	// are on disk. A failed write NAKs, and the server redelivers after
+	// NakDelay. A crash between the write and the ack redelivers a message we
+	// already have, which we recognize by its sequence and just ack.
+	AT_LEAST_ONCE = "at-least-once"
+)
+
+const (
+	// EPHEMERAL consumers are recreated every few seconds from the local
+	// marker and vanish when we stop using them. This is the original behavior.
+	EPHEMERAL = "ephemeral"
+
+	// DURABLE uses one named consumer per tenant and agent, which the server
+	// keeps across reconnects and reboots.
+	DURABLE = "durable"
+)
+
+// sentences_config
+type sentences_config struct {
+	DeliveryMode string `json:"delivery-mode"`
+	NakDelay     string `json:"nak-delay"`
+
+	// Consumer is EPHEMERAL or DURABLE. InactiveThreshold is how long the
+	// server keeps a durable consumer nobody is fetching from; empty means
+	// forever.
+	Consumer          string `json:"consumer"`
+	InactiveThreshold string `json:"inactive-threshold"`
+
+	// Batching and backpressure. Zero or empty leaves the default in a.go.
+	BatchSize       int    `json:"batch-size"`
+	FetchWait       string `json:"fetch-wait"`
+	MaxFiles        int    `json:"max-files"`
+	MaxPendingBytes int64  `json:"max-pending-bytes"`
+	MinFreeBytes    int64  `json:"min-free-bytes"`
+
+	// Subscriptions replaces DEFAULT_SUBSCRIPTION if it's given, so list that
+	// one too if you still want it.
+	Subscriptions []subscription_config `json:"subscriptions"`
+
+	// AgentGroup, if set, owns our files and directories, which are then
+	// closed to everyone else. See perms.go.
+	AgentGroup string `json:"agent-group"`
+
+	// Compression is none, gzip or zstd. Encryption is none or aes-256-gcm.
+	// See encoding.go.
+	Compression string `json:"compression"`
+	Encryption  string `json:"encryption"`
+
+	// Counter gives every sentence a count, one more than the last, see status.go.
+	Counter bool `json:"counter"`
+
+	// Metadata turns on the as-<seq>.json sidecars, see metadata.go.
+	Metadata bool `json:"metadata"`
+
+	// EventsSocket is where user code can listen for new sentences, see
+	// events.go. Empty means .events.sock in PERSIST_DIR; "off" turns it off.
+	EventsSocket string `json:"events-socket"`
+
+	// ControlSocket and ControlSubject take replay requests, see control.go.
+	// Empty means .control.sock in PERSIST_DIR and firecracker.agent.<tenant>.<agent>.sentences;
+	// "off" turns either off.
+	ControlSocket  string `json:"control-socket"`
+	ControlSubject string `json:"control-subject"`
+
+	// Quarantine, see quarantine.go. MaxSentenceBytes 0 means no limit.
+	MaxPersistFailures int    `json:"max-persist-failures"`
+	MaxSentenceBytes   int64  `json:"max-sentence-bytes"`
+	QuarantineMaxFiles int    `json:"quarantine-max-files"`
+	DeadLetterSubject  string `json:"dead-letter-subject"`
+
+	// MetricsListen is a host:port for the metrics endpoint, see metrics.go.
+	// Empty means none.
+	MetricsListen string `json:"metrics-listen"`
+
+	// Outbox turns on publishing from an outbox directory. See outbox.go.
+	Outbox *outbox_config `json:"outbox"`
+
+	nak_delay          time.Duration
+	inactive_threshold time.Duration
+}
+
+// subscription_config is one stream consumer and the directory it fills.
+// Zero or empty fields take the defaults from sentences_config.
+type subscription_config struct {
+	// Name identifies the subscription in logs and in the durable consumer
+	// name, so it has to be a valid subject token.
+	Name   string `json:"name"`
+	Stream string `json:"stream"`
+
+	// FilterSubjects may contain {tenant} and {agent}, which are replaced
+	// with ours.
+	FilterSubjects []string `json:"filter-subjects"`
+
+	// Dir defaults to PERSIST_DIR/<name>.
+	Dir string `json:"dir"`
+
+	// DeliverPolicy is where a consumer starts when we have nothing
+	// persisted yet: all, new, last or last-per-subject. After that we always
+	// start after the marker.
+	DeliverPolicy string `json:"deliver-policy"`
+
+	Consumer        string `json:"consumer"`
+	BatchSize       int    `json:"batch-size"`
+	MaxFiles        int    `json:"max-files"`
+	MaxPendingBytes int64  `json:"max-pending-bytes"`
+}
+
+// DEFAULT_SUBSCRIPTION is the agent's own sentences, written straight into
+// PERSIST_DIR, which is all we did before there were subscriptions.
+var DEFAULT_SUBSCRIPTION = subscription_config{
+	Name:           "sentences",
+	Stream:         "AGENT_SENTENCES",
+	FilterSubjects: []string{"agent.sentences.{tenant}.{agent}"},
+}
+
+// DEFAULT_SENTENCES is what sentences starts from, before MMDS and the environment.
+var DEFAULT_SENTENCES = sentences_config{
+	DeliveryMode:       AT_MOST_ONCE,
+	NakDelay:           "5s",
+	Consumer:           EPHEMERAL,
+	MaxPersistFailures: 5,
+	QuarantineMaxFiles: 1000,
+}
+
+var sentences sentences_config
+
+// read_sentences_config fills in sentences. Not being able to reach MMDS isn't
+// an error here, since guest_mmds.Load has other sources for the things that
+// matter, but a setting we don't understand is.
+func read_sentences_config() error {
+	sentences = DEFAULT_SENTENCES
+	if e := guest_mmds.Get("/sentences", &sentences); e != nil && !errors.Is(e, guest_mmds.ErrNotFound) {
+		log.Printf("no sentences config from mmds, using defaults: %s", e)
+	}
+	if s := os.Getenv("DELIVERY_MODE"); s != "" {
+		sentences.DeliveryMode = s
+	}
+	if s := os.Getenv("CONSUMER"); s != "" {
+		sentences.Consumer = s
+	}
+	if s := os.Getenv("METRICS_LISTEN"); s != "" {
+		sentences.MetricsListen = s
+	}
+
+	switch sentences.DeliveryMode {
+	case AT_MOST_ONCE, AT_LEAST_ONCE:
+	default:
+		return fmt.Errorf("unknown delivery-mode %q", sentences.DeliveryMode)
+	}
+	d, e := time.ParseDuration(sentences.NakDelay)
+	if e != nil || d < 0 {
+		return fmt.Errorf("bad nak-delay %q", sentences.NakDelay)
+	}
+	sentences.nak_delay = d
+
+	switch sentences.Consumer {
+	case EPHEMERAL, DURABLE:
+	default:
+		return fmt.Errorf("unknown consumer %q", sentences.Consumer)
+	}
+	if sentences.InactiveThreshold != "" {
+		d, e := time.ParseDuration(sentences.InactiveThreshold)
+		if e != nil || d < 0 {
+			return fmt.Errorf("bad inactive-threshold %q", sentences.InactiveThreshold)
+		}
+		sentences.inactive_threshold = d
+	}
+
+	if sentences.BatchSize > 0 {
+		BATCH_SIZE = sentences.BatchSize
+	}
+	if sentences.FetchWait != "" {
+		d, e := time.ParseDuration(sentences.FetchWait)
+		if e != nil || d <= 0 {
+			return fmt.Errorf("bad fetch-wait %q", sentences.FetchWait)
+		}
+		FETCH_WAIT = d
+	}
+	if sentences.MaxFiles > 0 {
+		MAX_PERSISTS = sentences.MaxFiles
+	}
+	if sentences.MaxPendingBytes > 0 {
+		MAX_PENDING_BYTES = sentences.MaxPendingBytes
+	}
+	if sentences.MinFreeBytes > 0 {
+		MIN_FREE_BYTES = sentences.MinFreeBytes
+	}
+
+	if sentences.MaxPersistFailures < 1 {
+		return fmt.Errorf("bad max-persist-failures %d", sentences.MaxPersistFailures)
+	}
+	if sentences.QuarantineMaxFiles < 1 {
+		return fmt.Errorf("bad quarantine-max-files %d", sentences.QuarantineMaxFiles)
+	}
+
+	if d := os.Getenv("OUTBOX_DIR"); d != "" {
+		if sentences.Outbox == nil {
+			sentences.Outbox = &outbox_config{}
+		}
+		sentences.Outbox.Dir = d
+	}
+
+	if e := setup_agent_group(sentences.AgentGroup); e != nil {
+		return e
+	}
+	if e := setup_encoding(); e != nil {
+		return e
+	}
+
+	if len(sentences.Subscriptions) == 0 {
+		sentences.Subscriptions = []subscription_config{DEFAULT_SUBSCRIPTION}
+	}
+
+	log.Printf("delivery mode %s, %s consumer, batches of %d", sentences.DeliveryMode, sentences.Consumer, BATCH_SIZE)
+	return nil
+}
+
+// new_subscriptions fills in the defaults for each configured subscription and
+// checks it. Two subscriptions can't share a name or a directory, since each
+// keeps its own marker.
+func new_subscriptions() ([]*subscription, error) {
+	subs := []*subscription{}
+	names, dirs := map[string]bool{}, map[string]bool{}
+	for _, c := range sentences.Subscriptions {
+		if !guest_mmds.ValidSubjectToken(c.Name) {
+			return nil, fmt.Errorf("bad subscription name %q", c.Name)
+		}
+		if c.Stream == "" || len(c.FilterSubjects) == 0 {
+			return nil, fmt.Errorf("subscription %s needs a stream and filter subjects", c.Name)
+		}
+		r := strings.NewReplacer("{tenant}", tenant_id, "{agent}", agent_id)
+		filters := []string{}
+		for _, f := range c.FilterSubjects {
+			filters = append(filters, r.Replace(f))
+		}
+		c.FilterSubjects = filters
+
+		if c.Dir == "" {
+			if c.Name == DEFAULT_SUBSCRIPTION.Name {
+				c.Dir = persist_dir
+			} else {
+				c.Dir = filepath.Join(persist_dir, c.Name)
+			}
+		}
+		if c.Consumer == "" {
+			c.Consumer = sentences.Consumer
+		}
+		if c.Consumer != EPHEMERAL && c.Consumer != DURABLE {
+			return nil, fmt.Errorf("subscription %s: unknown consumer %q", c.Name, c.Consumer)
+		}
+		if _, ok := DELIVER_POLICIES[c.DeliverPolicy]; !ok {
+			return nil, fmt.Errorf("subscription %s: unknown deliver-policy %q", c.Name, c.DeliverPolicy)
+		}
+		if c.BatchSize <= 0 {
+			c.BatchSize = BATCH_SIZE
+		}
+		if c.MaxFiles <= 0 {
+			c.MaxFiles = MAX_PERSISTS
+		}
+		if c.MaxPendingBytes <= 0 {
+			c.MaxPendingBytes = MAX_PENDING_BYTES
+		}
+
+		if names[c.Name] || dirs[filepath.Clean(c.Dir)] {
+			return nil, fmt.Errorf("subscription %s: name or dir used twice", c.Name)
+		}
+		names[c.Name], dirs[filepath.Clean(c.Dir)] = true, true
+		subs = append(subs, new_subscription(c))
+	}
+	return subs, nil
+}
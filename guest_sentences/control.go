@@ -0,0 +1,286 @@
+package main
+
+/* Replay and rewind.
+ *
+ * Normally we start after highest_persisted_sequence and that's that. An agent
+ * that mishandled some sentences can ask for them again, one JSON request per
+ * line on the control socket (.control.sock in PERSIST_DIR), or in a NATS
+ * request to the control subject, and gets one JSON reply:
+ *
+ *   {"command":"replay","subscription":"sentences","seq":120}
+ *   {"command":"replay","time":"2026-10-19T08:00:00Z"}
+ *   {"command":"redeliver","seq":120,"to_seq":130}
+ *   {"command":"skip"}
+ *
+ *   {"ok":true,"subscription":"sentences","seq":120}
+ *
+ * replay starts over from a sequence, or from the first message at or after a
+ * time. redeliver sends a range again and then carries on where we were. skip
+ * drops everything up to the head of the stream. seq in the reply is where
+ * delivery now starts.
+ *
+ * Each request is carried out by the subscription's own goroutine, between
+ * batches, by moving the marker and recreating the consumer from it. Files user
+ * code still has are never overwritten, see persist_msg.
+ */
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CONTROL_TIMEOUT is how long a request may wait for its subscription, which
+// could be in the middle of a fetch.
+var CONTROL_TIMEOUT = 30 * time.Second
+
+// control_request
+type control_request struct {
+	Command      string    `json:"command"`
+	Subscription string    `json:"subscription"`
+	Seq          uint64    `json:"seq"`
+	ToSeq        uint64    `json:"to_seq"`
+	Time         time.Time `json:"time"`
+
+	reply chan control_reply
+}
+
+// control_reply
+type control_reply struct {
+	Ok           bool   `json:"ok"`
+	Error        string `json:"error,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Seq          uint64 `json:"seq,omitempty"`
+}
+
+// listen_control starts the control socket. As with the events socket, anything
+// left at path by our last run is removed first.
+func listen_control(ctx context.Context, path string, subs []*subscription) error {
+	os.Remove(path)
+	l, e := net.Listen("unix", path)
+	if e != nil {
+		return e
+	}
+	if e := set_perms(path, SOCKET_MODE); e != nil {
+		return e
+	}
+	log.Printf("control on %s", path)
+
+	go close_on_done(ctx, l)
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				if ctx.Err() == nil {
+					log.Printf("control: %s", e)
+				}
+				return
+			}
+			go serve_control(conn, subs)
+		}
+	}()
+	return nil
+}
+
+// serve_control answers requests from one client until it goes away.
+func serve_control(conn net.Conn, subs []*subscription) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		if _, e := conn.Write(control_line(do_control(subs, sc.Bytes()))); e != nil {
+			return
+		}
+	}
+}
+
+// subscribe_control answers requests on the control subject. It has to be called
+// again for every new connection.
+func subscribe_control(c *nats.Conn, subject string, subs []*subscription) error {
+	_, e := c.Subscribe(subject, func(m *nats.Msg) {
+		if e := m.Respond(control_line(do_control(subs, m.Data))); e != nil {
+			log.Printf("control: %s", e)
+		}
+	})
+	return e
+}
+
+// control_subject is where we take requests over NATS, or "" for nowhere.
+func control_subject() string {
+	switch sentences.ControlSubject {
+	case "off":
+		return ""
+	case "":
+		return fmt.Sprintf("firecracker.agent.%s.%s.sentences", tenant_id, agent_id)
+	}
+	return strings.NewReplacer("{tenant}", tenant_id, "{agent}", agent_id).Replace(sentences.ControlSubject)
+}
+
+// do_control hands a request to its subscription and waits for the outcome.
+func do_control(subs []*subscription, data []byte) control_reply {
+	r := &control_request{reply: make(chan control_reply, 1)}
+	if e := json.Unmarshal(data, r); e != nil {
+		return control_reply{Error: fmt.Sprintf("bad request: %s", e)}
+	}
+
+	var s *subscription
+	for _, sub := range subs {
+		if sub.Name == r.Subscription || (r.Subscription == "" && len(subs) == 1) {
+			s = sub
+		}
+	}
+	if s == nil {
+		return control_reply{Error: fmt.Sprintf("no subscription %q", r.Subscription)}
+	}
+
+	log.Printf("%s: control request %s", s.Name, strings.TrimSpace(string(data)))
+	timer := time.NewTimer(CONTROL_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case s.control <- r:
+	case <-timer.C:
+		return control_reply{Error: "timed out", Subscription: s.Name}
+	}
+	return <-r.reply
+}
+
+// control_line
+func control_line(r control_reply) []byte {
+	j, _ := json.Marshal(r)
+	return append(j, '\n')
+}
+
+// apply_control carries out a request, in the subscription's goroutine.
+func (s *subscription) apply_control(r *control_request) {
+	to_seq := uint64(0)
+	if r.Command == "redeliver" {
+		to_seq = r.ToSeq
+	}
+	start, e := s.control_start(r)
+	if e == nil {
+		e = s.rewind(start, to_seq)
+	}
+	if e != nil {
+		log.Printf("%s: control %s failed: %s", s.Name, r.Command, e)
+		r.reply <- control_reply{Error: e.Error(), Subscription: s.Name}
+		return
+	}
+	log.Printf("%s: %s, starting again from %d", s.Name, r.Command, start)
+	r.reply <- control_reply{Ok: true, Subscription: s.Name, Seq: start}
+}
+
+// control_start works out the sequence a request starts delivery from.
+func (s *subscription) control_start(r *control_request) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CONTROL_TIMEOUT)
+	defer cancel()
+	_, js := get_js()
+	stream, e := js.Stream(ctx, s.Stream)
+	if e != nil {
+		return 0, e
+	}
+
+	switch r.Command {
+	case "replay":
+		if !r.Time.IsZero() {
+			return s.seq_at_time(ctx, stream, r.Time)
+		}
+		if r.Seq == 0 {
+			return 0, fmt.Errorf("replay needs a seq or a time")
+		}
+		return r.Seq, nil
+	case "redeliver":
+		if r.Seq == 0 || r.ToSeq < r.Seq {
+			return 0, fmt.Errorf("redeliver needs seq and to_seq, in that order")
+		}
+		return r.Seq, nil
+	case "skip":
+		info, e := stream.Info(ctx)
+		if e != nil {
+			return 0, e
+		}
+		return info.State.LastSeq + 1, nil
+	}
+	return 0, fmt.Errorf("unknown command %q", r.Command)
+}
+
+// seq_at_time finds the first of our messages stored at or after t, with a
+// throwaway consumer, since the stream can't look that up for us. If there's
+// nothing since then, it's the next message to arrive.
+func (s *subscription) seq_at_time(ctx context.Context, stream jetstream.Stream, t time.Time) (uint64, error) {
+	c := s.consumer_config(0)
+	c.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+	c.OptStartSeq = 0
+	c.OptStartTime = &t
+	c.AckPolicy = jetstream.AckNonePolicy
+	c.InactiveThreshold = 10 * time.Second
+	c.Name = s.lookup_name()
+	if e := stream.DeleteConsumer(ctx, c.Name); e != nil && !errors.Is(e, jetstream.ErrConsumerNotFound) {
+		return 0, e
+	}
+	cons, e := stream.CreateConsumer(ctx, c)
+	if e != nil {
+		return 0, e
+	}
+	defer stream.DeleteConsumer(ctx, c.Name)
+	batch, e := cons.Fetch(1, jetstream.FetchMaxWait(time.Second))
+	if e != nil {
+		return 0, e
+	}
+	for m := range batch.Messages() {
+		if meta, e := m.Metadata(); e == nil {
+			return meta.Sequence.Stream, nil
+		}
+	}
+
+	info, e := stream.Info(ctx)
+	if e != nil {
+		return 0, e
+	}
+	return info.State.LastSeq + 1, nil
+}
+
+// rewind moves the marker to just before start and has the consumer recreated from
+// there. With to_seq, once we're past it we go back to where we were: see end_replay.
+func (s *subscription) rewind(start uint64, to_seq uint64) error {
+	was := s.get_highest_persist()
+	if e := s.set_highest_persist(start - 1); e != nil {
+		return e
+	}
+	s.replay_end, s.resume_after = 0, 0
+	if to_seq != 0 && was > to_seq {
+		s.replay_end, s.resume_after = to_seq, was
+	}
+	s.nak_floor = 0
+	clear(s.failures)
+	s.consumer = nil
+	s.reset = true
+	return nil
+}
+
+// end_replay skips back to where we were before a redeliver, once it's past its range.
+func (s *subscription) end_replay(n_highest *uint64) {
+	if s.resume_after > *n_highest {
+		if e := s.set_highest_persist(s.resume_after); e != nil {
+			// We'll get the rest again, and persist_msg will skip what
+			// user code still has.
+			log.Printf("%s: %s", s.Name, e)
+		} else {
+			*n_highest = s.resume_after
+			s.consumer = nil
+			s.reset = true
+		}
+	}
+	log.Printf("%s: redelivered up to %d, back at %d", s.Name, s.replay_end, *n_highest)
+	s.replay_end, s.resume_after = 0, 0
+}
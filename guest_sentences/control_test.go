@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// replay starts over from a sequence, or from a time, whatever user code has
+// already taken.
+func TestReplay(t *testing.T) {
+	for _, consumer := range []string{EPHEMERAL, DURABLE} {
+		t.Run(consumer, func(t *testing.T) {
+			h := new_harness(t, map[string]any{"consumer": consumer, "delivery-mode": AT_LEAST_ONCE})
+			first := h.publish("first", 5)
+			time.Sleep(100 * time.Millisecond)
+			between := time.Now()
+			time.Sleep(100 * time.Millisecond)
+			second := h.publish("second", 5)
+			h.start()
+			wait_for(t, "10 sentences", 10*time.Second, func() bool { return len(h.files()) == 10 })
+			h.take_all()
+
+			r := h.control(fmt.Sprintf(`{"command":"replay","seq":%d}`, first[3]))
+			if !r.Ok || r.Seq != first[3] || r.Subscription != "sentences" {
+				t.Fatalf("replay by seq: %+v", r)
+			}
+			want := append(first[3:], second...)
+			wait_for(t, "the replay", 10*time.Second, func() bool { return same_seqs(h.files(), want) })
+			wait_for(t, "the marker", 10*time.Second, func() bool { return h.marker() == second[4] })
+			h.take_all()
+
+			j, _ := json.Marshal(between)
+			r = h.control(fmt.Sprintf(`{"command":"replay","time":%s}`, j))
+			if !r.Ok || r.Seq != second[0] {
+				t.Fatalf("replay by time: %+v", r)
+			}
+			wait_for(t, "the replay", 10*time.Second, func() bool { return same_seqs(h.files(), second) })
+		})
+	}
+}
+
+// redeliver sends a range again, then carries on from where we were without
+// repeating anything after it.
+func TestRedeliver(t *testing.T) {
+	h := new_harness(t, map[string]any{"delivery-mode": AT_LEAST_ONCE})
+	seqs := h.publish("m", 10)
+	h.start()
+	wait_for(t, "10 sentences", 10*time.Second, func() bool { return len(h.files()) == 10 })
+	wait_for(t, "the marker", 10*time.Second, func() bool { return h.marker() == seqs[9] })
+	h.take_all()
+
+	r := h.control(fmt.Sprintf(`{"command":"redeliver","seq":%d,"to_seq":%d}`, seqs[2], seqs[4]))
+	if !r.Ok || r.Seq != seqs[2] {
+		t.Fatalf("redeliver: %+v", r)
+	}
+	wait_for(t, "the redelivery", 10*time.Second, func() bool { return same_seqs(h.files(), seqs[2:5]) })
+	wait_for(t, "the marker back", 10*time.Second, func() bool { return h.marker() == seqs[9] })
+	time.Sleep(500 * time.Millisecond)
+	if !same_seqs(h.files(), seqs[2:5]) {
+		t.Fatalf("got %v, want %v", h.files(), seqs[2:5])
+	}
+	if got := h.read(seqs[3]); got != "m-3" {
+		t.Errorf("sentence %d is %q", seqs[3], got)
+	}
+
+	h.take_all()
+	more := h.publish("more", 2)
+	wait_for(t, "new sentences", 10*time.Second, func() bool { return len(h.files()) == 2 })
+	if !same_seqs(h.files(), more) {
+		t.Errorf("got %v, want %v", h.files(), more)
+	}
+
+	if r := h.control(`{"command":"redeliver","seq":5,"to_seq":4}`); r.Ok {
+		t.Errorf("backwards redeliver: %+v", r)
+	}
+	if r := h.control(`{"command":"rewind"}`); r.Ok {
+		t.Errorf("unknown command: %+v", r)
+	}
+	if r := h.control(`{"command":"skip","subscription":"nope"}`); r.Ok {
+		t.Errorf("unknown subscription: %+v", r)
+	}
+}
+
+// skip, over NATS, drops everything up to the head of the stream, even while
+// we're held off.
+func TestSkip(t *testing.T) {
+	h := new_harness(t, map[string]any{"max-files": 3, "delivery-mode": AT_LEAST_ONCE})
+	seqs := h.publish("m", 10)
+	h.start()
+	wait_for(t, "held off", 10*time.Second, func() bool { return h.status().HeldOff != "" })
+
+	m, e := h.nc.Request("firecracker.agent.t1.a1.sentences", []byte(`{"command":"skip"}`), CONTROL_TIMEOUT)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var r control_reply
+	if e := json.Unmarshal(m.Data, &r); e != nil || !r.Ok || r.Seq != seqs[9]+1 {
+		t.Fatalf("skip: %s", m.Data)
+	}
+
+	h.take_all()
+	more := h.publish("more", 2)
+	wait_for(t, "new sentences", 10*time.Second, func() bool { return len(h.files()) == 2 })
+	time.Sleep(500 * time.Millisecond)
+	if !same_seqs(h.files(), more) {
+		t.Errorf("got %v, want %v", h.files(), more)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+/* Compression and encryption at rest, see local_library for the file format
+ * and the decoding side.
+ *
+ * With "encryption" on, the host gives us a per-agent key in MMDS under
+ * "sentences-key". We keep it only in memory and in local_library.KEY_FILE,
+ * which is on tmpfs, so it never lands on the guest's disk next to the files it
+ * protects. The key file is 0640 with the agent group, or 0600 and root's alone
+ * without one. The encoding itself goes in
+ * local_library.ENCODING_FILE, since files carry no header when it's off.
+ */
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"guest_mmds"
+	"local_library"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	compression  byte
+	ciph         byte
+	sentence_key []byte
+)
+
+// setup_encoding checks the compression and encryption settings, and gets the key.
+func setup_encoding() error {
+	var ok bool
+	if compression, ok = local_library.COMPRESSIONS[sentences.Compression]; !ok {
+		return fmt.Errorf("unknown compression %q", sentences.Compression)
+	}
+	if ciph, ok = local_library.CIPHERS[sentences.Encryption]; !ok {
+		return fmt.Errorf("unknown encryption %q", sentences.Encryption)
+	}
+	if e := write_encoding_file(); e != nil {
+		return e
+	}
+	if ciph == local_library.CIPHER_NONE {
+		return nil
+	}
+
+	key := os.Getenv("SENTENCES_KEY")
+	if key == "" {
+		if e := guest_mmds.Get("/sentences-key", &key); e != nil && !errors.Is(e, guest_mmds.ErrNotFound) {
+			return fmt.Errorf("sentences key: %w", e)
+		}
+	}
+	k, e := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if e != nil || len(k) != 32 {
+		return fmt.Errorf("encryption is on, but there's no valid sentences key")
+	}
+	sentence_key = k
+
+	// The key file is for user code, so it gets the agent group. Without one,
+	// only root may read it.
+	mode := os.FileMode(0600)
+	if agent_gid >= 0 {
+		mode = 0640
+	}
+	if e := os.WriteFile(local_library.KEY_FILE, []byte(key+"\n"), 0600); e != nil {
+		return e
+	}
+	return set_perms(local_library.KEY_FILE, mode)
+}
+
+// write_encoding_file tells local_library how our files are encoded, or
+// removes the file if they're plain.
+func write_encoding_file() error {
+	name := encoding_name()
+	if name == "" {
+		if e := os.Remove(local_library.ENCODING_FILE); e != nil && !errors.Is(e, os.ErrNotExist) {
+			return e
+		}
+		return nil
+	}
+	if e := os.MkdirAll(filepath.Dir(local_library.ENCODING_FILE), 0755); e != nil {
+		return e
+	}
+	return os.WriteFile(local_library.ENCODING_FILE, []byte(name+"\n"), 0644)
+}
+
+// encode a payload for the file as configured.
+func encode(seq uint64, data []byte) ([]byte, error) {
+	return local_library.Encode(data, seq, compression, ciph, sentence_key)
+}
+
+// decode a payload from one of our files.
+func decode(seq uint64, data []byte) ([]byte, error) {
+	if compression == local_library.COMPRESS_NONE && ciph == local_library.CIPHER_NONE {
+		return data, nil
+	}
+	return local_library.Decode(data, seq, sentence_key)
+}
+
+// encoding_name is how a sidecar describes the file, "" for a plain payload.
+func encoding_name() string {
+	parts := []string{}
+	if compression != local_library.COMPRESS_NONE {
+		parts = append(parts, sentences.Compression)
+	}
+	if ciph != local_library.CIPHER_NONE {
+		parts = append(parts, sentences.Encryption)
+	}
+	return strings.Join(parts, "+")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"local_library"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Sentence files are written encoded as configured, say so in their sidecars,
+// and local_library reads them back.
+func TestEncoding(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	for _, c := range []struct{ compression, encryption, name string }{
+		{"gzip", "", "gzip"},
+		{"zstd", "aes-256-gcm", "zstd+aes-256-gcm"},
+		{"", "aes-256-gcm", "aes-256-gcm"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("SENTENCES_KEY", key)
+			h := new_harness(t, map[string]any{"compression": c.compression, "encryption": c.encryption})
+			seqs := h.publish("m", 3)
+			h.start()
+			wait_for(t, "3 sentences", 10*time.Second, func() bool { return len(h.files()) == 3 })
+
+			if enc, e := local_library.ReadEncoding(); enc != c.name || e != nil {
+				t.Errorf("encoding file says %q, %v", enc, e)
+			}
+			for i, seq := range seqs {
+				if raw := h.read(seq); raw == fmt.Sprintf("m-%d", i) {
+					t.Errorf("sentence %d isn't encoded", seq)
+				}
+				got, e := local_library.ReadSentence(filepath.Join(h.dir, fmt.Sprintf("as-%020d.bin", seq)))
+				if e != nil || string(got) != fmt.Sprintf("m-%d", i) {
+					t.Errorf("sentence %d reads as %q, %v", seq, got, e)
+				}
+			}
+
+			var sc sidecar
+			d, _ := os.ReadFile(filepath.Join(h.dir, fmt.Sprintf("as-%020d.json", seqs[0])))
+			if json.Unmarshal(d, &sc); sc.Encoding != c.name || sc.Size != 3 {
+				t.Errorf("sidecar %+v", sc)
+			}
+			if c.encryption != "" {
+				if fi, e := os.Stat(local_library.KEY_FILE); e != nil || fi.Mode().Perm() != 0600 {
+					t.Errorf("key file %v, %v", fi, e)
+				}
+			}
+		})
+	}
+}
+
+// With encoding off, the files are the payloads, and local_library leaves them
+// be, even one that looks encoded.
+func TestNoEncoding(t *testing.T) {
+	h := new_harness(t, nil)
+	os.WriteFile(local_library.ENCODING_FILE, []byte("gzip\n"), 0644)
+	ack, e := h.js.Publish(t.Context(), TEST_SUBJECT, []byte(local_library.MAGIC+"\x01\x00 plain"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	seq := ack.Sequence
+	h.start()
+	wait_for(t, "the sentence", 10*time.Second, func() bool { return len(h.files()) == 1 })
+
+	if file_exists(local_library.ENCODING_FILE) {
+		t.Errorf("the encoding file from before is still there")
+	}
+	got, e := local_library.ReadSentence(filepath.Join(h.dir, fmt.Sprintf("as-%020d.bin", seq)))
+	if e != nil || string(got) != local_library.MAGIC+"\x01\x00 plain" {
+		t.Errorf("got %q, %v", got, e)
+	}
+}
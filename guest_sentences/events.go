@@ -0,0 +1,198 @@
+package main
+
+/* Events for user code, so it doesn't have to poll the persist dir.
+ *
+ * We listen on a unix socket, by default .events.sock in PERSIST_DIR. Each
+ * client gets one JSON object per line:
+ *
+ *   {"event":"sentence","subscription":"sentences","seq":42,"file":"/opt/agentsentences/as-...42.bin"}
+ *
+ * as each sentence file lands, with "meta" naming the sidecar if there is one
+ * (metadata.go), and "count" with counter on (status.go). When a client
+ * connects we first send an event for every file already waiting, oldest first,
+ * so nothing falls between a directory listing and the connection. Their counts
+ * are the ones we gave them, or for files from before we started, the ones in
+ * their sidecars; without a sidecar we can't tell, and leave it out.
+ *
+ * A client that doesn't keep up is disconnected rather than allowed to hold us
+ * up: one that falls EVENTS_BUFFER events behind, or doesn't take a write
+ * within EVENTS_WRITE_TIMEOUT. It should reconnect, and will get the backlog
+ * again.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EVENTS_BUFFER is how many events a client may fall behind by.
+const EVENTS_BUFFER = 1024
+
+// EVENTS_WRITE_TIMEOUT is how long a client may take to read an event.
+var EVENTS_WRITE_TIMEOUT = 10 * time.Second
+
+// event
+type event struct {
+	Event        string `json:"event"`
+	Subscription string `json:"subscription"`
+	Seq          uint64 `json:"seq"`
+	Count        uint64 `json:"count,omitempty"`
+	File         string `json:"file"`
+	Meta         string `json:"meta,omitempty"`
+}
+
+var (
+	events_mu      sync.Mutex
+	events_clients = map[chan []byte]bool{}
+)
+
+// listen_events starts the events socket. Anything already at path is removed
+// first: a socket left behind by our last run would stop us binding.
+func listen_events(ctx context.Context, path string, subs []*subscription) error {
+	os.Remove(path)
+	l, e := net.Listen("unix", path)
+	if e != nil {
+		return e
+	}
+	if e := set_perms(path, SOCKET_MODE); e != nil {
+		return e
+	}
+	log.Printf("events on %s", path)
+
+	go close_on_done(ctx, l)
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				if ctx.Err() == nil {
+					log.Printf("events: %s", e)
+				}
+				return
+			}
+			go serve_events(conn, subs)
+		}
+	}()
+	return nil
+}
+
+// serve_events sends the backlog and then new events to one client until it
+// goes away or falls behind.
+func serve_events(conn net.Conn, subs []*subscription) {
+	defer conn.Close()
+
+	// Register before listing, so a file that lands in between is sent
+	// twice rather than not at all.
+	ch := make(chan []byte, EVENTS_BUFFER)
+	events_mu.Lock()
+	events_clients[ch] = true
+	events_mu.Unlock()
+	defer func() {
+		events_mu.Lock()
+		delete(events_clients, ch)
+		events_mu.Unlock()
+	}()
+
+	// The client never says anything, so a read returning means it's gone.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		close(gone)
+	}()
+
+	for _, s := range subs {
+		matches, _ := filepath.Glob(filepath.Join(s.Dir, PERSIST_PATTERN))
+		sort.Strings(matches)
+		for _, m := range matches {
+			seq, _ := persisted_seq(m)
+			ev := event{Event: "sentence", Subscription: s.Name, Seq: seq, Count: s.file_count(m), File: m}
+			if meta := strings.TrimSuffix(m, ".bin") + ".json"; file_exists(meta) {
+				ev.Meta = meta
+			}
+			if e := write_event(conn, event_line(ev)); e != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				log.Printf("events: client too slow, disconnecting")
+				return
+			}
+			if e := write_event(conn, line); e != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// write_event sends one line to a client, giving up on it after
+// EVENTS_WRITE_TIMEOUT.
+func write_event(conn net.Conn, line []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(EVENTS_WRITE_TIMEOUT))
+	_, e := conn.Write(line)
+	if errors.Is(e, os.ErrDeadlineExceeded) {
+		log.Printf("events: client not reading, disconnecting")
+	}
+	return e
+}
+
+// file_count is the count of a waiting sentence file, or 0 if counter is off or
+// we can't tell.
+func (s *subscription) file_count(fp string) uint64 {
+	if !sentences.Counter {
+		return 0
+	}
+	if count, ok := s.backlog.get_count(filepath.Base(fp)); ok {
+		return count
+	}
+	var sc sidecar
+	if f, _, e := open_plain_file(strings.TrimSuffix(fp, ".bin") + ".json"); e == nil {
+		json.NewDecoder(io.LimitReader(f, 1<<16)).Decode(&sc)
+		f.Close()
+	}
+	return sc.Count
+}
+
+// file_exists
+func file_exists(fp string) bool {
+	_, e := os.Stat(fp)
+	return e == nil
+}
+
+// event_line
+func event_line(ev event) []byte {
+	j, _ := json.Marshal(ev)
+	return append(j, '\n')
+}
+
+// send_event goes to every connected client. One whose buffer is full is
+// dropped.
+func send_event(ev event) {
+	line := event_line(ev)
+	events_mu.Lock()
+	defer events_mu.Unlock()
+	for ch := range events_clients {
+		select {
+		case ch <- line:
+		default:
+			delete(events_clients, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// next_event reads one event, or fails the test.
+func next_event(t *testing.T, conn net.Conn, r *bufio.Reader) event {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, e := r.ReadString('\n')
+	if e != nil {
+		t.Fatalf("reading an event: %s", e)
+	}
+	var ev event
+	if e := json.Unmarshal([]byte(line), &ev); e != nil {
+		t.Fatalf("bad event %q: %s", line, e)
+	}
+	return ev
+}
+
+// A client gets the files already waiting, oldest first, then each new one as
+// it lands.
+func TestEvents(t *testing.T) {
+	h := new_harness(t, map[string]any{"counter": true})
+	seqs := h.publish("m", 3)
+	h.start()
+	wait_for(t, "3 sentences", 10*time.Second, func() bool { return len(h.files()) == 3 })
+
+	conn, e := net.Dial("unix", filepath.Join(h.dir, ".events.sock"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i, seq := range seqs {
+		ev := next_event(t, conn, r)
+		if ev.Event != "sentence" || ev.Subscription != "sentences" || ev.Seq != seq || ev.Count != uint64(i+1) ||
+			filepath.Dir(ev.File) != h.dir || !strings.HasSuffix(ev.Meta, ".json") {
+			t.Errorf("backlog event %+v, want seq %d count %d", ev, seq, i+1)
+		}
+	}
+
+	more := h.publish("more", 1)
+	ev := next_event(t, conn, r)
+	if ev.Seq != more[0] || ev.Count != 4 || h.read(ev.Seq) != "more-0" {
+		t.Errorf("event %+v, want seq %d count 4", ev, more[0])
+	}
+}
+
+// After a restart, the backlog's counts come from the sidecars.
+func TestEventsAfterRestart(t *testing.T) {
+	h := new_harness(t, map[string]any{"counter": true})
+	h.publish("m", 2)
+	h.start()
+	wait_for(t, "2 sentences", 10*time.Second, func() bool { return len(h.files()) == 2 })
+	h.stop()
+	h.start()
+	wait_for(t, "the events socket", 10*time.Second, func() bool { return file_exists(filepath.Join(h.dir, ".events.sock")) })
+
+	conn, e := net.Dial("unix", filepath.Join(h.dir, ".events.sock"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := range 2 {
+		if ev := next_event(t, conn, r); ev.Count != uint64(i+1) {
+			t.Errorf("event %+v, want count %d", ev, i+1)
+		}
+	}
+}
+
+// A client that doesn't read is dropped after EVENTS_WRITE_TIMEOUT, rather than
+// holding its goroutine forever.
+func TestEventsWriteTimeout(t *testing.T) {
+	was := EVENTS_WRITE_TIMEOUT
+	EVENTS_WRITE_TIMEOUT = 100 * time.Millisecond
+	t.Cleanup(func() { EVENTS_WRITE_TIMEOUT = was })
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "as-00000000000000000001.bin"), []byte("m"), 0644)
+	s := new_subscription(subscription_config{Name: "sentences", Dir: dir})
+
+	// A pipe has no buffer, so the first write waits for a read that never comes.
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	done := make(chan struct{})
+	go func() {
+		serve_events(ours, []*subscription{s})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve_events is still waiting on a client that doesn't read")
+	}
+}
@@ -2,12 +2,33 @@ module guest_sentences
 
 go 1.25.4
 
-require github.com/nats-io/nats.go v1.47.0
+replace guest_mmds => ../guest_mmds
+
+replace nats_connect => ../nats_connect
+
+replace guest_identity => ../guest_identity
+
+replace local_library => ../local_library
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/nats-io/nats-server/v2 v2.12.1
+	github.com/nats-io/nats.go v1.47.0
+	guest_mmds v0.0.0-00010101000000-000000000000
+	local_library v0.0.0-00010101000000-000000000000
+	nats_connect v0.0.0-00010101000000-000000000000
+)
 
 require (
+	github.com/antithesishq/antithesis-sdk-go v0.4.3-default-no-op // indirect
+	github.com/google/go-tpm v0.9.6 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/minio/highwayhash v1.0.3 // indirect
+	github.com/nats-io/jwt/v2 v2.8.0 // indirect
 	github.com/nats-io/nkeys v0.4.11 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
-	golang.org/x/sys v0.32.0 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/time v0.14.0 // indirect
+	guest_identity v0.0.0-00010101000000-000000000000 // indirect
 )
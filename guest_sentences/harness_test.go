@@ -0,0 +1,335 @@
+package main
+
+/* The test harness. Each test gets its own in-process nats-server with
+ * JetStream, a fake MMDS that serves the sentences config, a kernel command
+ * line in a temp file that says who we are and where the server is, and a
+ * persist dir. Then it runs guest_sentences itself, with run, as many times
+ * as it likes. Nothing leaves the machine.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"guest_mmds"
+	"local_library"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_TENANT  = "t1"
+	TEST_AGENT   = "a1"
+	TEST_SUBJECT = "agent.sentences.t1.a1"
+	TEST_DURABLE = "sentences_t1_a1"
+)
+
+// harness
+type harness struct {
+	t      *testing.T
+	srv    *server.Server
+	port   int
+	store  string
+	dir    string
+	config map[string]any
+
+	nc *nats.Conn
+	js jetstream.JetStream
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// new_harness starts the server and creates AGENT_SENTENCES. config is served as
+// the sentences config, on top of some defaults that keep the tests quick.
+func new_harness(t *testing.T, config map[string]any) *harness {
+	h := &harness{
+		t:     t,
+		store: t.TempDir(),
+		dir:   t.TempDir(),
+		config: map[string]any{
+			"fetch-wait": "200ms",
+			"batch-size": 10,
+			"max-files":  100,
+			"metadata":   true,
+		},
+	}
+	for k, v := range config {
+		h.config[k] = v
+	}
+	h.start_server()
+
+	var e error
+	h.nc, e = nats.Connect(h.url(), nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(h.nc.Close)
+	if h.js, e = jetstream.New(h.nc); e != nil {
+		t.Fatal(e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, e := h.js.CreateStream(ctx, jetstream.StreamConfig{Name: "AGENT_SENTENCES", Subjects: []string{"agent.sentences.>"}}); e != nil {
+		t.Fatal(e)
+	}
+
+	mmds := httptest.NewServer(http.HandlerFunc(h.serve_mmds))
+	t.Cleanup(mmds.Close)
+
+	cmdline := filepath.Join(t.TempDir(), "cmdline")
+	line := fmt.Sprintf("console=ttyS0 agent=%s tenant=%s nats=%s\n", TEST_AGENT, TEST_TENANT, h.url())
+	if e := os.WriteFile(cmdline, []byte(line), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	was_addr, was_cmdline, was_ids, was_now := guest_mmds.MMDS_ADDR, guest_mmds.CMDLINE_PATH, guest_mmds.ID_FILES, now
+	guest_mmds.MMDS_ADDR = strings.TrimPrefix(mmds.URL, "http://")
+	guest_mmds.CMDLINE_PATH = cmdline
+	guest_mmds.ID_FILES = nil
+	t.Cleanup(func() {
+		guest_mmds.MMDS_ADDR, guest_mmds.CMDLINE_PATH, guest_mmds.ID_FILES, now = was_addr, was_cmdline, was_ids, was_now
+	})
+	run_dir := t.TempDir()
+	was_key, was_encoding := local_library.KEY_FILE, local_library.ENCODING_FILE
+	local_library.KEY_FILE = filepath.Join(run_dir, "sentences.key")
+	local_library.ENCODING_FILE = filepath.Join(run_dir, "sentences.encoding")
+	t.Cleanup(func() { local_library.KEY_FILE, local_library.ENCODING_FILE = was_key, was_encoding })
+	t.Setenv("PERSIST_DIR", h.dir)
+	t.Cleanup(h.stop)
+	return h
+}
+
+// serve_mmds is just enough of MMDS: a token, and the sentences config. The
+// document itself is missing, so our identity comes from the command line.
+func (h *harness) serve_mmds(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+		w.Write([]byte("token"))
+	case r.Method == "GET" && r.URL.Path == "/sentences":
+		json.NewEncoder(w).Encode(h.config)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// url
+func (h *harness) url() string {
+	return fmt.Sprintf("nats://127.0.0.1:%d", h.port)
+}
+
+// start_server starts nats-server, on the same port and store as last time if there
+// was a last time.
+func (h *harness) start_server() {
+	port := h.port
+	if port == 0 {
+		port = server.RANDOM_PORT
+	}
+	srv, e := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  h.store,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if e != nil {
+		h.t.Fatal(e)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		h.t.Fatal("nats-server didn't start")
+	}
+	h.srv = srv
+	h.port = srv.Addr().(*net.TCPAddr).Port
+	h.t.Cleanup(srv.Shutdown)
+}
+
+// stop_server
+func (h *harness) stop_server() {
+	h.srv.Shutdown()
+	h.srv.WaitForShutdown()
+}
+
+// start runs guest_sentences until stop.
+func (h *harness) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan error, 1)
+	go func() { h.done <- run(ctx, cancel) }()
+}
+
+// stop shuts guest_sentences down and waits for it, as SIGTERM would.
+func (h *harness) stop() {
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	select {
+	case e := <-h.done:
+		if e != nil {
+			h.t.Errorf("run: %s", e)
+		}
+	case <-time.After(SHUTDOWN_TIMEOUT + 5*time.Second):
+		h.t.Errorf("guest_sentences didn't shut down")
+	}
+	h.cancel = nil
+}
+
+// publish sends n sentences, "<prefix>-<i>", and returns their stream sequences.
+func (h *harness) publish(prefix string, n int) []uint64 {
+	h.t.Helper()
+	seqs := []uint64{}
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, e := h.js.Publish(ctx, TEST_SUBJECT, []byte(fmt.Sprintf("%s-%d", prefix, i)))
+		cancel()
+		if e != nil {
+			h.t.Fatalf("publish: %s", e)
+		}
+		seqs = append(seqs, ack.Sequence)
+	}
+	return seqs
+}
+
+// add_stream creates another stream, for what we publish.
+func (h *harness) add_stream(name string, subjects ...string) {
+	h.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, e := h.js.CreateStream(ctx, jetstream.StreamConfig{Name: name, Subjects: subjects}); e != nil {
+		h.t.Fatal(e)
+	}
+}
+
+// stream_msgs returns everything in a stream, oldest first.
+func (h *harness) stream_msgs(name string) []*jetstream.RawStreamMsg {
+	h.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, e := h.js.Stream(ctx, name)
+	if e != nil {
+		h.t.Fatal(e)
+	}
+	info, e := stream.Info(ctx)
+	if e != nil {
+		h.t.Fatal(e)
+	}
+	out := []*jetstream.RawStreamMsg{}
+	for seq := info.State.FirstSeq; info.State.Msgs > 0 && seq <= info.State.LastSeq; seq++ {
+		if m, e := stream.GetMsg(ctx, seq); e == nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// control sends a request to the control socket and returns the reply.
+func (h *harness) control(req string) control_reply {
+	h.t.Helper()
+	conn, e := net.Dial("unix", filepath.Join(h.dir, ".control.sock"))
+	if e != nil {
+		h.t.Fatal(e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT + 5*time.Second))
+	if _, e := conn.Write([]byte(req + "\n")); e != nil {
+		h.t.Fatal(e)
+	}
+	var r control_reply
+	if e := json.NewDecoder(conn).Decode(&r); e != nil {
+		h.t.Fatal(e)
+	}
+	return r
+}
+
+// files returns the sequences of the sentence files waiting in the persist dir, in order.
+func (h *harness) files() []uint64 {
+	matches, _ := filepath.Glob(filepath.Join(h.dir, PERSIST_PATTERN))
+	seqs := []uint64{}
+	for _, m := range matches {
+		if seq, ok := persisted_seq(filepath.Base(m)); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// read returns a sentence file's payload.
+func (h *harness) read(seq uint64) string {
+	d, e := os.ReadFile(filepath.Join(h.dir, fmt.Sprintf("as-%020d.bin", seq)))
+	if e != nil {
+		h.t.Fatal(e)
+	}
+	return string(d)
+}
+
+// take is user code: it reads a sentence and deletes it, and its sidecar.
+func (h *harness) take(seq uint64) (string, error) {
+	base := filepath.Join(h.dir, fmt.Sprintf("as-%020d", seq))
+	d, e := os.ReadFile(base + ".bin")
+	if e != nil {
+		return "", e
+	}
+	os.Remove(base + ".json")
+	return string(d), os.Remove(base + ".bin")
+}
+
+// take_all deletes every waiting sentence.
+func (h *harness) take_all() {
+	for _, seq := range h.files() {
+		h.take(seq)
+	}
+}
+
+// marker reads highest_persisted_sequence.
+func (h *harness) marker() uint64 {
+	s := &subscription{highest_persist_file: filepath.Join(h.dir, "highest_persisted_sequence")}
+	return s.get_highest_persist()
+}
+
+// status reads status.json.
+func (h *harness) status() sub_status {
+	var st sub_status
+	if d, e := os.ReadFile(filepath.Join(h.dir, STATUS_FILE)); e == nil {
+		json.Unmarshal(d, &st)
+	}
+	return st
+}
+
+// wait_for polls cond until it holds, or fails the test after timeout.
+func wait_for(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// seq_range is from..to inclusive.
+func seq_range(from, to uint64) []uint64 {
+	out := []uint64{}
+	for s := from; s <= to; s++ {
+		out = append(out, s)
+	}
+	return out
+}
+
+// same_seqs
+func same_seqs(a, b []uint64) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
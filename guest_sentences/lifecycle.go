@@ -0,0 +1,76 @@
+package main
+
+/* Starting and stopping.
+ *
+ * Everything long-running takes a context, which main cancels on SIGTERM or
+ * SIGINT, as when the guest powers off or systemd stops us. Then:
+ *
+ *   the subscriptions stop fetching, and persist and ack what they already
+ *   have, so a sentence is never left half written;
+ *   the outbox finishes the file it's publishing;
+ *   we drain NATS, so acks and reports in flight get out;
+ *   and we remove our sockets and exit.
+ *
+ * All that has SHUTDOWN_TIMEOUT, after which we close the connection and exit
+ * anyway. A second signal kills us straight away. guest_sentences.service
+ * gives us longer than SHUTDOWN_TIMEOUT before systemd sends SIGKILL.
+ */
+
+import (
+	"context"
+	"io"
+	"log"
+	"nats_connect"
+	"os"
+	"sync"
+	"time"
+)
+
+var SHUTDOWN_TIMEOUT = 15 * time.Second
+
+// close_on_done closes c when ctx is cancelled.
+func close_on_done(ctx context.Context, c io.Closer) {
+	<-ctx.Done()
+	c.Close()
+}
+
+// sleep waits for d, or until ctx is cancelled, and says whether it was the full d.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// shutdown waits for the workers in wg, then drains the connection and removes
+// the sockets, within SHUTDOWN_TIMEOUT overall.
+func shutdown(wg *sync.WaitGroup, sockets []string) {
+	log.Printf("shutting down")
+	deadline := time.Now().Add(SHUTDOWN_TIMEOUT)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("gave up waiting for work in progress after %s", SHUTDOWN_TIMEOUT)
+	}
+
+	conn_mu.Lock()
+	c := nc
+	conn_mu.Unlock()
+	if e := nats_connect.Drain(c, max(time.Until(deadline), time.Second)); e != nil {
+		log.Printf("%s", e)
+	}
+	for _, path := range sockets {
+		os.Remove(path)
+	}
+	log.Printf("stopped")
+}
@@ -0,0 +1,71 @@
+package main
+
+/* Metadata sidecars. The payload file has only the message body, so with
+ * "metadata" on we also write as-<seq>.json next to it with what NATS knew
+ * about the message. It's written before the payload, so when user code sees
+ * as-<seq>.bin the sidecar is already there. User code should delete both.
+ *
+ * The schema, with headers as NATS gives them (a list of values per name):
+ *
+ *   {
+ *     "subscription": "sentences",
+ *     "stream": "AGENT_SENTENCES",
+ *     "subject": "agent.sentences.acme.agent-7",
+ *     "seq": 42,             // stream sequence, as in the file name
+ *     "count": 17,           // with counter on, see status.go
+ *     "consumer_seq": 7,     // our consumer's sequence
+ *     "timestamp": "2026-01-02T03:04:05.123456789Z",
+ *     "delivered": 1,        // delivery count, more than 1 for a redelivery
+ *     "pending": 3,          // messages left for our consumer when this one came
+ *     "size": 120,           // bytes in the payload, before any encoding
+ *     "encoding": "zstd+aes-256-gcm", // left out for a plain payload
+ *     "headers": {"Nats-Msg-Id": ["..."]}
+ *   }
+ */
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go/jetstream"
+	"time"
+)
+
+// META_PATTERN matches sidecar files, as PERSIST_PATTERN matches payloads.
+const META_PATTERN = "as-*.json"
+
+// sidecar
+type sidecar struct {
+	Subscription string              `json:"subscription"`
+	Stream       string              `json:"stream"`
+	Subject      string              `json:"subject"`
+	Seq          uint64              `json:"seq"`
+	Count        uint64              `json:"count,omitempty"`
+	ConsumerSeq  uint64              `json:"consumer_seq"`
+	Timestamp    time.Time           `json:"timestamp"`
+	Delivered    uint64              `json:"delivered"`
+	Pending      uint64              `json:"pending"`
+	Size         int                 `json:"size"`
+	Encoding     string              `json:"encoding,omitempty"`
+	Headers      map[string][]string `json:"headers,omitempty"`
+}
+
+// make_sidecar returns the sidecar for m, or nil if metadata is off.
+func (s *subscription) make_sidecar(m jetstream.Msg, meta *jetstream.MsgMetadata) []byte {
+	if !sentences.Metadata {
+		return nil
+	}
+	j, _ := json.MarshalIndent(sidecar{
+		Subscription: s.Name,
+		Stream:       meta.Stream,
+		Subject:      m.Subject(),
+		Seq:          meta.Sequence.Stream,
+		Count:        s.next_count(),
+		ConsumerSeq:  meta.Sequence.Consumer,
+		Timestamp:    meta.Timestamp.UTC(),
+		Delivered:    meta.NumDelivered,
+		Pending:      meta.NumPending,
+		Size:         len(m.Data()),
+		Encoding:     encoding_name(),
+		Headers:      m.Headers(),
+	}, "", "  ")
+	return append(j, '\n')
+}
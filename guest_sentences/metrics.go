@@ -0,0 +1,138 @@
+package main
+
+/* An optional HTTP endpoint for the same things as status.json, for Prometheus
+ * or anything else that would rather scrape than read files. With
+ * metrics-listen set (say "127.0.0.1:9464", or ":9464" to let the host reach
+ * it over the guest network) we serve:
+ *
+ *   /metrics   the Prometheus text format, one series per subscription
+ *   /status    every subscription's status.json, as a JSON list
+ *
+ * The numbers are those of the last status.json, which is at most
+ * STATUS_INTERVAL old. The connection state and time since the last message
+ * are worked out when asked.
+ *
+ * There's no client library here: the text format is simple, and we don't
+ * want its dependencies in every guest.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"nats_connect"
+	"net/http"
+	"strings"
+)
+
+// metric is one series of the text format.
+type metric struct {
+	name string
+	kind string // gauge or counter
+	help string
+	get  func(st *sub_status) float64
+}
+
+var sub_metrics = []metric{
+	{"guest_sentences_highest_persisted_sequence", "gauge", "Stream sequence of the last sentence persisted.",
+		func(st *sub_status) float64 { return float64(st.HighestPersisted) }},
+	{"guest_sentences_last_fetched_sequence", "gauge", "Stream sequence of the last message fetched.",
+		func(st *sub_status) float64 { return float64(st.LastFetched) }},
+	{"guest_sentences_count", "gauge", "Count of the last sentence persisted, with counter on.",
+		func(st *sub_status) float64 { return float64(st.Count) }},
+	{"guest_sentences_num_pending", "gauge", "Messages for us still in the stream, -1 if unknown.",
+		func(st *sub_status) float64 { return float64(st.NumPending) }},
+	{"guest_sentences_backlog_files", "gauge", "Sentence files waiting for user code.",
+		func(st *sub_status) float64 { return float64(st.BacklogFiles) }},
+	{"guest_sentences_backlog_bytes", "gauge", "Bytes in sentence files waiting for user code.",
+		func(st *sub_status) float64 { return float64(st.BacklogBytes) }},
+	{"guest_sentences_held_off", "gauge", "1 while backpressure has stopped fetching.",
+		func(st *sub_status) float64 { return bool_metric(st.HeldOff != "") }},
+	{"guest_sentences_fetch_errors_total", "counter", "Failed fetches and subscribes.",
+		func(st *sub_status) float64 { return float64(st.FetchErrors) }},
+	{"guest_sentences_gaps_total", "counter", "Jumps in the consumer sequence.",
+		func(st *sub_status) float64 { return float64(st.Gaps) }},
+	{"guest_sentences_redelivered_total", "counter", "Messages delivered more than once.",
+		func(st *sub_status) float64 { return float64(st.Redelivered) }},
+	{"guest_sentences_duplicates_total", "counter", "Messages at or below the marker, not written again.",
+		func(st *sub_status) float64 { return float64(st.Duplicates) }},
+	{"guest_sentences_seconds_since_last_message", "gauge", "Seconds since the last message fetched, -1 if none yet.",
+		func(st *sub_status) float64 {
+			if st.LastMessage.IsZero() {
+				return -1
+			}
+			return now().Sub(st.LastMessage).Seconds()
+		}},
+}
+
+// bool_metric
+func bool_metric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// listen_metrics starts the metrics endpoint, which stops when ctx is cancelled.
+func listen_metrics(ctx context.Context, addr string, subs []*subscription) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(format_metrics(subs)))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		out := []sub_status{}
+		for _, s := range subs {
+			out = append(out, s.get_status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	log.Printf("metrics on %s", addr)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go close_on_done(ctx, srv)
+	go func() {
+		if e := srv.ListenAndServe(); ctx.Err() == nil {
+			log.Printf("metrics: %s", e)
+		}
+	}()
+}
+
+// format_metrics
+func format_metrics(subs []*subscription) string {
+	var b strings.Builder
+	series := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	series("guest_sentences_nats_connected", "gauge", "1 while connected to NATS.")
+	fmt.Fprintf(&b, "guest_sentences_nats_connected %g\n", bool_metric(connection_state() == "connected"))
+	ns := nats_connect.GetStats()
+	for _, c := range []struct {
+		name string
+		n    uint64
+	}{
+		{"connects", ns.Connects},
+		{"disconnects", ns.Disconnects},
+		{"reconnects", ns.Reconnects},
+		{"errors", ns.Errors},
+	} {
+		name := "guest_sentences_nats_" + c.name + "_total"
+		series(name, "counter", "NATS connection "+c.name+".")
+		fmt.Fprintf(&b, "%s %d\n", name, c.n)
+	}
+
+	statuses := make([]sub_status, len(subs))
+	for i, s := range subs {
+		statuses[i] = s.get_status()
+	}
+	for _, m := range sub_metrics {
+		series(m.name, m.kind, m.help)
+		for i, s := range subs {
+			fmt.Fprintf(&b, "%s{subscription=%q,stream=%q} %g\n", m.name, s.Name, s.Stream, m.get(&statuses[i]))
+		}
+	}
+	return b.String()
+}
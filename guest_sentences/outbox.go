@@ -0,0 +1,256 @@
+package main
+
+/* The outbox: sentences going the other way.
+ *
+ * User code that wants to send something back writes it to a file in the
+ * outbox directory, and we publish it to the agent's outbox subject on
+ * JetStream, by default agent.outbox.<tenant>.<agent>. That way agents don't
+ * need their own NATS client or credentials.
+ *
+ * User code must write each file under a name starting with a dot and then
+ * rename it, so we never pick up half a file. We publish files in name order,
+ * one at a time, with a Nats-Msg-Id made from the file's name and contents so
+ * the server drops a duplicate if we publish again after losing an ack. The
+ * message is signed with our identity (guest_mmds.SignMsg) when we have one. Once the server has
+ * acked it, the file is deleted, or moved to sent-dir if that's configured.
+ * If publishing fails we try again with backoff. User code owns the directory,
+ * so we never follow a symlink in it, and only send plain files with one link:
+ * anything else is moved to failed/.
+ *
+ * Limits: a file bigger than max-file-bytes can't be sent, and is moved to the
+ * failed/ directory. When the outbox holds max-files files or max-bytes bytes,
+ * which happens if we can't publish, we create a ".full" file in it, and user
+ * code should stop writing until it's gone.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"guest_mmds"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	OUTBOX_POLL      = time.Second
+	OUTBOX_RETRY_MIN = time.Second
+	OUTBOX_RETRY_MAX = time.Minute
+	OUTBOX_FULL      = ".full"
+	OUTBOX_FAILED    = "failed"
+)
+
+// outbox_config is the "outbox" section of the sentences config.
+// Zero or empty fields get the defaults in new_outbox.
+type outbox_config struct {
+	Dir     string `json:"dir"`
+	Subject string `json:"subject"` // may contain {tenant} and {agent}
+
+	// SentDir keeps sent files, up to SentMaxFiles of them, the oldest
+	// going first. Without it, sent files are deleted.
+	SentDir      string `json:"sent-dir"`
+	SentMaxFiles int    `json:"sent-max-files"`
+
+	MaxFileBytes int64 `json:"max-file-bytes"`
+	MaxFiles     int   `json:"max-files"`
+	MaxBytes     int64 `json:"max-bytes"`
+}
+
+// outbox
+type outbox struct {
+	outbox_config
+	retry time.Duration
+	full  bool
+}
+
+// new_outbox fills in the defaults and creates the directories, open to user code
+// (perms.go) so it can write into them.
+func new_outbox(c outbox_config) (*outbox, error) {
+	if c.Dir == "" {
+		c.Dir = "/opt/agentoutbox"
+	}
+	if c.Subject == "" {
+		c.Subject = "agent.outbox.{tenant}.{agent}"
+	}
+	c.Subject = strings.NewReplacer("{tenant}", tenant_id, "{agent}", agent_id).Replace(c.Subject)
+	if c.SentMaxFiles <= 0 {
+		c.SentMaxFiles = 1000
+	}
+	if c.MaxFileBytes <= 0 {
+		c.MaxFileBytes = 1 << 20
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = 1000
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 256 << 20
+	}
+
+	dirs := []string{c.Dir, filepath.Join(c.Dir, OUTBOX_FAILED)}
+	if c.SentDir != "" {
+		dirs = append(dirs, c.SentDir)
+	}
+	for _, d := range dirs {
+		if e := make_dir(d); e != nil {
+			return nil, e
+		}
+	}
+	log.Printf("outbox: %s to %s", c.Dir, c.Subject)
+	return &outbox{outbox_config: c, retry: OUTBOX_RETRY_MIN}, nil
+}
+
+// run publishes until ctx is cancelled, finishing the file it's on.
+func (o *outbox) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		files := o.scan()
+		if len(files) == 0 {
+			sleep(ctx, OUTBOX_POLL)
+			continue
+		}
+		for _, f := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			if e := o.send(f); e != nil {
+				log.Printf("outbox: failed to send %s, retrying in %s: %s", f, o.retry, e)
+				sleep(ctx, o.retry)
+				o.retry = min(o.retry*2, OUTBOX_RETRY_MAX)
+				break
+			}
+			o.retry = OUTBOX_RETRY_MIN
+		}
+	}
+}
+
+// scan returns the files waiting to be sent, in name order, and raises or
+// lowers the .full flag.
+func (o *outbox) scan() []string {
+	entries, e := os.ReadDir(o.Dir)
+	if e != nil {
+		log.Printf("outbox: %s", e)
+		return nil
+	}
+	files := []string{}
+	var bytes int64
+	for _, de := range entries {
+		if strings.HasPrefix(de.Name(), ".") || !de.Type().IsRegular() {
+			continue
+		}
+		if fi, e := de.Info(); e == nil {
+			files = append(files, de.Name())
+			bytes += fi.Size()
+		}
+	}
+	sort.Strings(files)
+
+	full := len(files) >= o.MaxFiles || bytes >= o.MaxBytes
+	if full != o.full {
+		flag := filepath.Join(o.Dir, OUTBOX_FULL)
+		if full {
+			log.Printf("outbox: full, %d files, %d bytes", len(files), bytes)
+			// Always a new file, so we never change the perms of a link user
+			// code left there, or of what it points to.
+			os.Remove(flag)
+			if f, e := os.OpenFile(flag, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600); e != nil {
+				log.Printf("outbox: raising %s: %s", OUTBOX_FULL, e)
+			} else {
+				set_file_perms(f, FILE_MODE)
+				f.Close()
+			}
+		} else {
+			log.Printf("outbox: no longer full")
+			os.Remove(flag)
+		}
+		o.full = full
+	}
+	return files
+}
+
+// send publishes one file and waits for the server to have it.
+func (o *outbox) send(name string) error {
+	fp := filepath.Join(o.Dir, name)
+	f, fi, e := open_plain_file(fp)
+	switch {
+	case os.IsNotExist(e):
+		return nil // user code took it back
+	case errors.Is(e, ERR_NOT_PLAIN) || errors.Is(e, syscall.ELOOP):
+		log.Printf("outbox: %s is not a plain file, moving it to %s", name, OUTBOX_FAILED)
+		return os.Rename(fp, filepath.Join(o.Dir, OUTBOX_FAILED, name))
+	case e != nil:
+		return e
+	}
+	defer f.Close()
+	if fi.Size() > o.MaxFileBytes {
+		log.Printf("outbox: %s is %d bytes, over the limit of %d, moving it to %s", name, fi.Size(), o.MaxFileBytes, OUTBOX_FAILED)
+		return os.Rename(fp, filepath.Join(o.Dir, OUTBOX_FAILED, name))
+	}
+	data, e := io.ReadAll(io.LimitReader(f, o.MaxFileBytes+1))
+	if e != nil {
+		return e
+	}
+	if int64(len(data)) > o.MaxFileBytes {
+		log.Printf("outbox: %s grew over the limit of %d, moving it to %s", name, o.MaxFileBytes, OUTBOX_FAILED)
+		return os.Rename(fp, filepath.Join(o.Dir, OUTBOX_FAILED, name))
+	}
+
+	sum := sha256.Sum256(data)
+	m := nats.NewMsg(o.Subject)
+	m.Data = data
+	m.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s.%s.%s.%s", tenant_id, agent_id, name, hex.EncodeToString(sum[:8])))
+	m.Header.Set("Ngen-Filename", name)
+	if e := guest_mmds.SignMsg(m); e != nil {
+		return e
+	}
+
+	_, js := get_js()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ack, e := js.PublishMsg(ctx, m)
+	if e != nil {
+		return e
+	}
+	if ack.Duplicate {
+		log.Printf("outbox: %s was already sent, seq %d", name, ack.Sequence)
+	}
+	return o.done(name, f)
+}
+
+// done removes a sent file from the outbox, keeping it in SentDir if we have one.
+// f is the file we sent, which gets the time it was sent.
+func (o *outbox) done(name string, f *os.File) error {
+	fp := filepath.Join(o.Dir, name)
+	if o.SentDir == "" {
+		return os.Remove(fp)
+	}
+	sent := filepath.Join(o.SentDir, name)
+	if e := os.Rename(fp, sent); e != nil {
+		return e
+	}
+	now := syscall.NsecToTimeval(time.Now().UnixNano())
+	syscall.Futimes(int(f.Fd()), []syscall.Timeval{now, now})
+
+	entries, e := os.ReadDir(o.SentDir)
+	if e != nil || len(entries) <= o.SentMaxFiles {
+		return nil
+	}
+	// Oldest first, by when they were sent.
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := entries[i].Info()
+		b, _ := entries[j].Info()
+		return a != nil && b != nil && a.ModTime().Before(b.ModTime())
+	})
+	for _, de := range entries[:len(entries)-o.SentMaxFiles] {
+		os.Remove(filepath.Join(o.SentDir, de.Name()))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// put writes a file into the outbox the way user code should.
+func put(t *testing.T, dir, name, data string) {
+	t.Helper()
+	tmp := filepath.Join(dir, "."+name)
+	if e := os.WriteFile(tmp, []byte(data), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Rename(tmp, filepath.Join(dir, name)); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// Files are published in name order and kept in sent-dir. Ones that are too
+// big, or aren't plain files, go to failed/.
+func TestOutbox(t *testing.T) {
+	dir, sent := t.TempDir(), t.TempDir()
+	h := new_harness(t, map[string]any{"outbox": map[string]any{"dir": dir, "sent-dir": sent, "max-file-bytes": 20}})
+	h.add_stream("AGENT_OUTBOX", "agent.outbox.>")
+
+	put(t, dir, "2-second", "second")
+	put(t, dir, "1-first", "first")
+	put(t, dir, "3-big", strings.Repeat("x", 21))
+	elsewhere := filepath.Join(t.TempDir(), "elsewhere")
+	os.WriteFile(elsewhere, []byte("not for sending"), 0600)
+	if e := os.Link(elsewhere, filepath.Join(dir, "4-link")); e != nil {
+		t.Fatal(e)
+	}
+	h.start()
+
+	wait_for(t, "the outbox to empty", 10*time.Second, func() bool {
+		entries, _ := os.ReadDir(dir)
+		for _, de := range entries {
+			if de.Name() != OUTBOX_FAILED {
+				return false
+			}
+		}
+		return true
+	})
+
+	msgs := h.stream_msgs("AGENT_OUTBOX")
+	got := []string{}
+	for _, m := range msgs {
+		if m.Subject != "agent.outbox.t1.a1" {
+			t.Errorf("published on %s", m.Subject)
+		}
+		got = append(got, m.Header.Get("Ngen-Filename")+"="+string(m.Data))
+	}
+	if strings.Join(got, " ") != "1-first=first 2-second=second" {
+		t.Errorf("published %v", got)
+	}
+	for _, name := range []string{"1-first", "2-second"} {
+		if !file_exists(filepath.Join(sent, name)) {
+			t.Errorf("%s isn't in sent-dir", name)
+		}
+	}
+	for _, name := range []string{"3-big", "4-link"} {
+		if !file_exists(filepath.Join(dir, OUTBOX_FAILED, name)) {
+			t.Errorf("%s isn't in failed", name)
+		}
+	}
+}
+
+// While we can't publish, files pile up and .full goes up at max-files. Once we
+// can, they're sent and it comes down. A .full user code left there is
+// replaced, not changed.
+func TestOutboxFull(t *testing.T) {
+	dir := t.TempDir()
+	h := new_harness(t, map[string]any{"outbox": map[string]any{"dir": dir, "max-files": 3}})
+	for _, name := range []string{"a", "b", "c"} {
+		put(t, dir, name, name)
+	}
+	flag := filepath.Join(dir, OUTBOX_FULL)
+	elsewhere := filepath.Join(t.TempDir(), "elsewhere")
+	os.WriteFile(elsewhere, []byte("not ours"), 0600)
+	if e := os.Link(elsewhere, flag); e != nil {
+		t.Fatal(e)
+	}
+	before, _ := os.Stat(elsewhere)
+	h.start()
+	wait_for(t, ".full", 10*time.Second, func() bool {
+		fi, e := os.Stat(flag)
+		return e == nil && !os.SameFile(fi, before)
+	})
+	if fi, e := os.Stat(elsewhere); e != nil || fi.Mode() != before.Mode() {
+		t.Errorf("the file linked to .full is now %v, %v", fi.Mode(), e)
+	}
+
+	h.add_stream("AGENT_OUTBOX", "agent.outbox.>")
+	wait_for(t, "them to be sent", 20*time.Second, func() bool { return len(h.stream_msgs("AGENT_OUTBOX")) == 3 })
+	wait_for(t, ".full to go", 10*time.Second, func() bool { return !file_exists(flag) })
+}
@@ -0,0 +1,131 @@
+package main
+
+/* Who can touch our files.
+ *
+ * Originally everything was open to every process in the guest: 0666 files in
+ * 0777 directories. With agent-group set, sentence files are 0640 and the
+ * directories 0770, owned by root and that group, so only user code running in
+ * the group can read sentences and take them, and it can't change them. The
+ * events socket and the outbox are limited to the group the same way.
+ *
+ * User code can write to those directories, and we run as root, so a name in
+ * one may be swapped for a link to anything at any moment. We only read what
+ * user code leaves us through open_plain_file, and keep what only we should
+ * touch, like the quarantine, in a directory of our own (make_private_dir).
+ */
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var (
+	FILE_MODE   os.FileMode = 0666
+	DIR_MODE    os.FileMode = 0777
+	SOCKET_MODE os.FileMode = 0666
+
+	// agent_gid is the agent group, or -1 for none.
+	agent_gid = -1
+)
+
+// setup_agent_group tightens the modes for the named group, which may also be
+// a numeric gid.
+func setup_agent_group(name string) error {
+	if name == "" {
+		return nil
+	}
+	gid, e := strconv.Atoi(name)
+	if e != nil {
+		g, e := user.LookupGroup(name)
+		if e != nil {
+			return fmt.Errorf("agent-group: %w", e)
+		}
+		if gid, e = strconv.Atoi(g.Gid); e != nil {
+			return fmt.Errorf("agent-group %s has gid %q", name, g.Gid)
+		}
+	}
+	agent_gid = gid
+	FILE_MODE, DIR_MODE, SOCKET_MODE = 0640, 0770, 0660
+	return nil
+}
+
+// set_perms sets the mode, and the group if we have one. The process umask
+// applies to file creation, so this is how files get the modes we want.
+func set_perms(fp string, mode os.FileMode) error {
+	if e := os.Chmod(fp, mode); e != nil {
+		return e
+	}
+	if agent_gid >= 0 {
+		return os.Lchown(fp, -1, agent_gid)
+	}
+	return nil
+}
+
+// set_file_perms is set_perms for a file we have open, which is the one to use
+// in a directory user code can write to, where the name may not stay ours.
+func set_file_perms(f *os.File, mode os.FileMode) error {
+	if e := f.Chmod(mode); e != nil {
+		return e
+	}
+	if agent_gid >= 0 {
+		return f.Chown(-1, agent_gid)
+	}
+	return nil
+}
+
+// make_dir creates dir if need be, and sets its mode and group either way.
+func make_dir(dir string) error {
+	if e := os.MkdirAll(dir, DIR_MODE); e != nil {
+		return e
+	}
+	return set_perms(dir, DIR_MODE)
+}
+
+// ERR_NOT_PLAIN is for a file user code left us that isn't a plain file.
+var ERR_NOT_PLAIN = errors.New("not a plain file")
+
+// open_plain_file opens a file user code left us, without following a symlink,
+// and makes sure it's a plain file of its own: not a device or a FIFO, and not
+// a hard link to something else. The name can change under us, so it's what we
+// have open that we check, and that the caller should read.
+func open_plain_file(fp string) (*os.File, os.FileInfo, error) {
+	f, e := os.OpenFile(fp, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if e != nil {
+		return nil, nil, e
+	}
+	fi, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || !ok || st.Nlink != 1 {
+		f.Close()
+		return nil, nil, ERR_NOT_PLAIN
+	}
+	return f, fi, nil
+}
+
+// make_private_dir creates dir for us alone, in a directory user code can
+// write to. Whatever user code may have put there first, a symlink or a
+// directory of its own, is removed.
+func make_private_dir(dir string) error {
+	fi, e := os.Lstat(dir)
+	if e == nil {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if fi.IsDir() && ok && int(st.Uid) == os.Getuid() {
+			return os.Chmod(dir, 0700)
+		}
+		if e := os.RemoveAll(dir); e != nil {
+			return e
+		}
+	}
+	if e := os.Mkdir(dir, 0700); e != nil {
+		return e
+	}
+	return os.Chmod(dir, 0700)
+}
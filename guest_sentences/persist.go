@@ -0,0 +1,134 @@
+package main
+
+/* Crash-safe writes into the persist dir.
+ *
+ * User code polls the directory for as-*.bin files and reads whatever it finds,
+ * so a file must never be visible half-written. Every file we write goes to a
+ * temp name first, outside PERSIST_PATTERN, is synced, and is then renamed into
+ * place, and the rename is made durable by syncing the directory.
+ *
+ * persist_msg writes the message file before the marker, so after a crash the
+ * marker can be behind the files but never ahead of them. recover_dir
+ * fixes the first case at startup. A marker ahead of the files is normal: user
+ * code deletes files once it has them.
+ */
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TEMP_PREFIX starts the names of files we're still writing. Nothing user code
+// looks for starts with a dot.
+const TEMP_PREFIX = ".tmp-"
+
+// write_persist_file atomically replaces fp with data, with FILE_MODE and the agent
+// group (perms.go). The process umask applies to file creation, so we have to set
+// the perms after the file exists.
+func write_persist_file(fp string, data []byte) error {
+	dir := filepath.Dir(fp)
+	tmp := filepath.Join(dir, TEMP_PREFIX+filepath.Base(fp))
+
+	f, e := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if e != nil {
+		return e
+	}
+	_, e = f.Write(data)
+	if e == nil {
+		e = f.Chmod(FILE_MODE)
+	}
+	if e == nil && agent_gid >= 0 {
+		e = f.Chown(-1, agent_gid)
+	}
+	if e == nil {
+		e = f.Sync()
+	}
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	if e == nil {
+		e = os.Rename(tmp, fp)
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	persist_renamed(fp)
+	return sync_dir(dir)
+}
+
+// persist_renamed is called once a file is in place, for tests to play user
+// code that takes it straight away.
+var persist_renamed = func(fp string) {}
+
+// sync_dir makes renames and removals in dir durable.
+func sync_dir(dir string) error {
+	d, e := os.Open(dir)
+	if e != nil {
+		return e
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// persisted_seq returns the sequence number in an as-<seq>.bin name.
+func persisted_seq(name string) (uint64, bool) {
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, "as-") || !strings.HasSuffix(base, ".bin") {
+		return 0, false
+	}
+	n, e := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(base, "as-"), ".bin"), 10, 64)
+	return n, e == nil
+}
+
+// recover_dir runs at startup, before we fetch anything. It removes temp
+// files left by a crash, and moves the marker up to the highest message file
+// present if a crash came between writing the file and the marker. Without that
+// we would fetch and write that message again. It also picks up the count, see status.go.
+func (s *subscription) recover_dir() error {
+	temps, _ := filepath.Glob(filepath.Join(s.Dir, TEMP_PREFIX+"*"))
+	for _, t := range temps {
+		log.Printf("removing unfinished %s", t)
+		if e := os.Remove(t); e != nil {
+			return e
+		}
+	}
+
+	matches, e := filepath.Glob(filepath.Join(s.Dir, PERSIST_PATTERN))
+	if e != nil {
+		return e
+	}
+	var highest_file uint64
+	for _, m := range matches {
+		if n, ok := persisted_seq(m); ok && n > highest_file {
+			highest_file = n
+		}
+	}
+
+	// A sidecar newer than the marker and any message file lost its message
+	// to a crash. Older ones were left behind by user code, and are its business.
+	metas, _ := filepath.Glob(filepath.Join(s.Dir, META_PATTERN))
+	for _, m := range metas {
+		if n, ok := persisted_seq(strings.TrimSuffix(m, ".json") + ".bin"); ok && n > max(highest_file, s.get_highest_persist()) {
+			log.Printf("removing %s, its sentence was never written", m)
+			os.Remove(m)
+		}
+	}
+
+	marker, count := s.read_marker()
+	s.count = count
+	if highest_file > marker {
+		log.Printf("marker at %d but found sentence %d, moving marker up", marker, highest_file)
+		// That sentence got the next count, but the marker never did.
+		if sentences.Counter {
+			s.count++
+		}
+		if e := s.set_highest_persist(highest_file); e != nil {
+			return e
+		}
+	}
+	return nil
+}
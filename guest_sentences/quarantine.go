@@ -0,0 +1,289 @@
+package main
+
+/* Poison messages.
+ *
+ * A sentence we can't persist, after max-persist-failures tries, or at once if
+ * it's over max-sentence-bytes, is quarantined rather than lost or retried
+ * forever. So is one user code gives up on and rejects, by renaming
+ * as-<seq>.bin to as-<seq>.rejected. Quarantining moves the payload into
+ * .quarantine in the subscription's dir, with as-<seq>.error.json saying what
+ * went wrong, and publishes it to the dead-letter subject with the error in its
+ * headers. Then we carry on with the next sentence.
+ *
+ * .quarantine is ours alone, and only a plain file user code rejected is taken
+ * into it, so nothing but sentences ends up on the dead-letter subject.
+ *
+ * Either copy is enough to move on. A dead letter that couldn't be published is
+ * retried from the quarantine dir, which keeps the newest
+ * quarantine-max-files entries.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"guest_mmds"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	QUARANTINE_DIR   = ".quarantine"
+	REJECT_PATTERN   = "as-*.rejected"
+	ENTRY_PATTERN    = "as-*.error.json"
+	QUARANTINE_RETRY = 30 * time.Second
+)
+
+// Why a sentence was quarantined.
+const (
+	REASON_FAILED    = "failed"
+	REASON_TOO_LARGE = "too-large"
+	REASON_REJECTED  = "rejected"
+)
+
+// quarantine_entry is as-<seq>.error.json.
+type quarantine_entry struct {
+	Subscription string    `json:"subscription"`
+	Seq          uint64    `json:"seq"`
+	Count        uint64    `json:"count,omitempty"`
+	Subject      string    `json:"subject,omitempty"`
+	Reason       string    `json:"reason"`
+	Error        string    `json:"error,omitempty"`
+	Failures     int       `json:"failures,omitempty"`
+	Time         time.Time `json:"time"`
+
+	// DeadLetter is whether it has been published to the dead-letter subject.
+	DeadLetter bool `json:"dead_letter"`
+}
+
+// dead_letter_subject is where quarantined sentences are published, or "" for nowhere.
+func dead_letter_subject() string {
+	switch sentences.DeadLetterSubject {
+	case "off":
+		return ""
+	case "":
+		return fmt.Sprintf("agent.deadletter.%s.%s", tenant_id, agent_id)
+	}
+	return strings.NewReplacer("{tenant}", tenant_id, "{agent}", agent_id).Replace(sentences.DeadLetterSubject)
+}
+
+// quarantine_path
+func (s *subscription) quarantine_path(seq uint64, ext string) string {
+	return filepath.Join(s.Dir, QUARANTINE_DIR, fmt.Sprintf("as-%020d%s", seq, ext))
+}
+
+// quarantine_msg quarantines a message we failed to persist. The payload is stored
+// encoded, like any other sentence file.
+func (s *subscription) quarantine_msg(m jetstream.Msg, seq uint64, reason string, cause error, failures int) error {
+	qe := &quarantine_entry{
+		Subscription: s.Name,
+		Seq:          seq,
+		Count:        s.next_count(),
+		Subject:      m.Subject(),
+		Reason:       reason,
+		Error:        cause.Error(),
+		Failures:     failures,
+		Time:         now().UTC(),
+	}
+	log.Printf("%s: quarantining sentence %d, %s: %s", s.Name, seq, reason, cause)
+
+	saved := false
+	data, e := encode(seq, m.Data())
+	if e == nil {
+		e = write_persist_file(s.quarantine_path(seq, ".bin"), data)
+	}
+	if e == nil {
+		e = s.write_entry(qe)
+	}
+	if e == nil {
+		saved = true
+	} else {
+		log.Printf("%s: can't keep sentence %d in quarantine: %s", s.Name, seq, e)
+	}
+
+	if e := s.dead_letter(qe, m.Data()); e != nil {
+		log.Printf("%s: can't publish dead letter %d: %s", s.Name, seq, e)
+		if !saved {
+			return e
+		}
+	}
+	s.stats.quarantined.Add(1)
+	s.prune_quarantine()
+	return nil
+}
+
+// quarantine_rejected moves a file user code rejected, and its sidecar, into quarantine.
+func (s *subscription) quarantine_rejected(fp string) error {
+	base := filepath.Base(fp)
+	seq, e := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(base, "as-"), ".rejected"), 10, 64)
+	if e != nil {
+		return fmt.Errorf("can't tell the sequence of rejected file %s", base)
+	}
+	qe := &quarantine_entry{
+		Subscription: s.Name,
+		Seq:          seq,
+		Reason:       REASON_REJECTED,
+		Error:        "rejected by user code",
+		Time:         now().UTC(),
+	}
+	// Only a plain file goes in: user code could have left a link to
+	// anything, for us to publish. We look before we move it, and look again
+	// at what we've moved before we read it, see retry_dead_letter.
+	if fi, e := os.Lstat(fp); e != nil {
+		return e
+	} else if st, ok := fi.Sys().(*syscall.Stat_t); !fi.Mode().IsRegular() || !ok || st.Nlink != 1 {
+		os.Remove(fp)
+		return fmt.Errorf("rejected file %s is not a plain file, removed it", base)
+	}
+	side := strings.TrimSuffix(fp, ".rejected") + ".json"
+	if f, _, e := open_plain_file(side); e == nil {
+		var sc sidecar
+		if json.NewDecoder(io.LimitReader(f, 1<<16)).Decode(&sc) == nil {
+			qe.Subject = sc.Subject
+		}
+		f.Close()
+		os.Rename(side, s.quarantine_path(seq, ".json"))
+	}
+	log.Printf("%s: user code rejected sentence %d", s.Name, seq)
+
+	if e := os.Rename(fp, s.quarantine_path(seq, ".bin")); e != nil {
+		return e
+	}
+	if e := s.write_entry(qe); e != nil {
+		return e
+	}
+	s.stats.rejected.Add(1)
+	s.retry_dead_letter(qe)
+	s.prune_quarantine()
+	return nil
+}
+
+// write_entry
+func (s *subscription) write_entry(qe *quarantine_entry) error {
+	j, _ := json.MarshalIndent(qe, "", "  ")
+	return write_persist_file(s.quarantine_path(qe.Seq, ".error.json"), append(j, '\n'))
+}
+
+// dead_letter publishes a quarantined payload, and records that it did.
+func (s *subscription) dead_letter(qe *quarantine_entry, payload []byte) error {
+	subject := dead_letter_subject()
+	if subject == "" {
+		return nil
+	}
+	m := nats.NewMsg(subject)
+	m.Data = payload
+	m.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s.%s.%s.%d", tenant_id, agent_id, s.Name, qe.Seq))
+	m.Header.Set("Ngen-Subscription", s.Name)
+	m.Header.Set("Ngen-Seq", strconv.FormatUint(qe.Seq, 10))
+	m.Header.Set("Ngen-Subject", qe.Subject)
+	m.Header.Set("Ngen-Reason", qe.Reason)
+	m.Header.Set("Ngen-Error", qe.Error)
+	if e := guest_mmds.SignMsg(m); e != nil {
+		return e
+	}
+
+	_, js := get_js()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, e := js.PublishMsg(ctx, m); e != nil {
+		return e
+	}
+	qe.DeadLetter = true
+	if e := s.write_entry(qe); e != nil && !os.IsNotExist(e) {
+		log.Printf("%s: %s", s.Name, e)
+	}
+	return nil
+}
+
+// retry_dead_letter publishes a quarantined sentence from its file.
+func (s *subscription) retry_dead_letter(qe *quarantine_entry) {
+	if qe.DeadLetter || dead_letter_subject() == "" {
+		return
+	}
+	var data []byte
+	f, _, e := open_plain_file(s.quarantine_path(qe.Seq, ".bin"))
+	if e == nil {
+		data, e = io.ReadAll(f)
+		f.Close()
+	}
+	if e == nil {
+		data, e = decode(qe.Seq, data)
+	}
+	if e == nil {
+		e = s.dead_letter(qe, data)
+	}
+	if e != nil {
+		log.Printf("%s: can't publish dead letter %d: %s", s.Name, qe.Seq, e)
+	}
+}
+
+// quarantine_depth counts the quarantined sentences, and those of them that still
+// have to go to the dead-letter subject.
+func (s *subscription) quarantine_depth() (depth int, pending int) {
+	matches, _ := filepath.Glob(filepath.Join(s.Dir, QUARANTINE_DIR, ENTRY_PATTERN))
+	for _, fp := range matches {
+		depth++
+		var qe quarantine_entry
+		if d, e := os.ReadFile(fp); e == nil && json.Unmarshal(d, &qe) == nil && !qe.DeadLetter {
+			pending++
+		}
+	}
+	if dead_letter_subject() == "" {
+		pending = 0
+	}
+	return
+}
+
+// prune_quarantine keeps the newest QuarantineMaxFiles entries.
+func (s *subscription) prune_quarantine() {
+	matches, _ := filepath.Glob(filepath.Join(s.Dir, QUARANTINE_DIR, ENTRY_PATTERN))
+	if len(matches) <= sentences.QuarantineMaxFiles {
+		return
+	}
+	sort.Strings(matches)
+	for _, fp := range matches[:len(matches)-sentences.QuarantineMaxFiles] {
+		base := strings.TrimSuffix(fp, ".error.json")
+		for _, ext := range []string{".bin", ".json", ".error.json"} {
+			os.Remove(base + ext)
+		}
+	}
+}
+
+// run_quarantine takes in rejected files and retries dead letters, until ctx is
+// cancelled. The watcher pokes s.rejects when a file is rejected.
+func (s *subscription) run_quarantine(ctx context.Context) {
+	tick := time.NewTicker(QUARANTINE_RETRY)
+	defer tick.Stop()
+	for {
+		matches, _ := filepath.Glob(filepath.Join(s.Dir, REJECT_PATTERN))
+		sort.Strings(matches)
+		for _, fp := range matches {
+			if e := s.quarantine_rejected(fp); e != nil {
+				log.Printf("%s: %s", s.Name, e)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.rejects:
+		case <-tick.C:
+			entries, _ := filepath.Glob(filepath.Join(s.Dir, QUARANTINE_DIR, ENTRY_PATTERN))
+			for _, fp := range entries {
+				var qe quarantine_entry
+				if d, e := os.ReadFile(fp); e == nil && json.Unmarshal(d, &qe) == nil {
+					s.retry_dead_letter(&qe)
+				}
+			}
+		}
+	}
+}
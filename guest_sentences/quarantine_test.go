@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// entry reads a quarantine entry, or returns nil if there isn't one.
+func (h *harness) entry(seq uint64) *quarantine_entry {
+	d, e := os.ReadFile(filepath.Join(h.dir, QUARANTINE_DIR, fmt.Sprintf("as-%020d.error.json", seq)))
+	if e != nil {
+		return nil
+	}
+	var qe quarantine_entry
+	if json.Unmarshal(d, &qe) != nil {
+		return nil
+	}
+	return &qe
+}
+
+// A sentence over max-sentence-bytes goes to quarantine and the dead-letter
+// subject, and the ones around it are delivered as usual.
+func TestTooLarge(t *testing.T) {
+	h := new_harness(t, map[string]any{"max-sentence-bytes": 10, "delivery-mode": AT_LEAST_ONCE})
+	h.add_stream("DEAD_LETTERS", "agent.deadletter.>")
+	before := h.publish("m", 2)
+	big := h.publish("much-too-long-for-us", 1)
+	after := h.publish("m", 2)
+	h.start()
+
+	wait_for(t, "the small ones", 10*time.Second, func() bool { return len(h.files()) == 4 })
+	wait_for(t, "the marker", 10*time.Second, func() bool { return h.marker() == after[1] })
+	if want := append(before, after...); !same_seqs(h.files(), want) {
+		t.Fatalf("got %v, want %v", h.files(), want)
+	}
+
+	qe := h.entry(big[0])
+	if qe == nil || qe.Reason != REASON_TOO_LARGE || !qe.DeadLetter || qe.Subject != TEST_SUBJECT {
+		t.Fatalf("quarantine entry %+v", qe)
+	}
+	d, e := os.ReadFile(filepath.Join(h.dir, QUARANTINE_DIR, fmt.Sprintf("as-%020d.bin", big[0])))
+	if e != nil || string(d) != "much-too-long-for-us-0" {
+		t.Errorf("quarantined payload %q, %v", d, e)
+	}
+
+	dead := h.stream_msgs("DEAD_LETTERS")
+	if len(dead) != 1 {
+		t.Fatalf("%d dead letters", len(dead))
+	}
+	m := dead[0]
+	if m.Subject != "agent.deadletter.t1.a1" || string(m.Data) != "much-too-long-for-us-0" ||
+		m.Header.Get("Ngen-Reason") != REASON_TOO_LARGE || m.Header.Get("Ngen-Seq") != fmt.Sprint(big[0]) {
+		t.Errorf("dead letter %s %q %v", m.Subject, m.Data, m.Header)
+	}
+}
+
+// User code rejects a sentence by renaming it. It goes to quarantine and the
+// dead-letter subject, with its sidecar. A rejected link goes nowhere.
+func TestRejected(t *testing.T) {
+	h := new_harness(t, map[string]any{"delivery-mode": AT_LEAST_ONCE})
+	h.add_stream("DEAD_LETTERS", "agent.deadletter.>")
+	seqs := h.publish("m", 3)
+	h.start()
+	wait_for(t, "3 sentences", 10*time.Second, func() bool { return len(h.files()) == 3 })
+
+	base := filepath.Join(h.dir, fmt.Sprintf("as-%020d", seqs[1]))
+	if e := os.Rename(base+".bin", base+".rejected"); e != nil {
+		t.Fatal(e)
+	}
+	wait_for(t, "the rejected sentence in quarantine", 10*time.Second, func() bool {
+		qe := h.entry(seqs[1])
+		return qe != nil && qe.DeadLetter
+	})
+	if qe := h.entry(seqs[1]); qe.Reason != REASON_REJECTED || qe.Subject != TEST_SUBJECT {
+		t.Errorf("quarantine entry %+v", qe)
+	}
+	if file_exists(base+".rejected") || file_exists(base+".json") {
+		t.Errorf("rejected files left behind")
+	}
+	if !file_exists(filepath.Join(h.dir, QUARANTINE_DIR, fmt.Sprintf("as-%020d.json", seqs[1]))) {
+		t.Errorf("sidecar not quarantined")
+	}
+	if fi, e := os.Stat(filepath.Join(h.dir, QUARANTINE_DIR)); e != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("quarantine dir %v, %v", fi, e)
+	}
+
+	// A link to something of ours isn't followed.
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("secret"), 0600)
+	link := filepath.Join(h.dir, fmt.Sprintf("as-%020d.rejected", seqs[2]))
+	os.Remove(filepath.Join(h.dir, fmt.Sprintf("as-%020d.bin", seqs[2])))
+	if e := os.Symlink(secret, link); e != nil {
+		t.Fatal(e)
+	}
+	wait_for(t, "the link to go", 10*time.Second, func() bool {
+		_, e := os.Lstat(link)
+		return os.IsNotExist(e)
+	})
+
+	dead := h.stream_msgs("DEAD_LETTERS")
+	if len(dead) != 1 || string(dead[0].Data) != "m-1" || dead[0].Header.Get("Ngen-Reason") != REASON_REJECTED {
+		t.Errorf("dead letters %v", dead)
+	}
+	if h.entry(seqs[2]) != nil {
+		t.Errorf("the link was quarantined")
+	}
+}
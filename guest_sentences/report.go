@@ -0,0 +1,107 @@
+package main
+
+/* Reports to the host, so it can see how an agent is doing with its sentences
+ * without logging in.
+ *
+ * Every REPORT_INTERVAL we send host_daemon a "sentences" report with, for each
+ * subscription, how many sentences were persisted, failed to persist, were
+ * quarantined and were rejected by user code in that interval, how many are
+ * in quarantine, and not yet published as dead letters, and its latest status
+ * (status.go), so the host can tell a slow agent from a broken pipeline.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"guest_mmds"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// REPORT_INTERVAL
+var REPORT_INTERVAL = 60 * time.Second
+
+// sub_stats counts what happens to a subscription's sentences between reports.
+type sub_stats struct {
+	persisted   atomic.Int64
+	failed      atomic.Int64
+	quarantined atomic.Int64
+	rejected    atomic.Int64
+}
+
+// sentences_report
+type sentences_report struct {
+	Type          string                `json:"type"`
+	Agent         string                `json:"agent"`
+	Tenant        string                `json:"tenant"`
+	Interval      float64               `json:"interval"` // seconds
+	Subscriptions []subscription_report `json:"subscriptions"`
+}
+
+// subscription_report
+type subscription_report struct {
+	Name              string     `json:"name"`
+	Persisted         int64      `json:"persisted"`
+	Failed            int64      `json:"failed"`
+	Quarantined       int64      `json:"quarantined"`
+	Rejected          int64      `json:"rejected"`
+	QuarantineDepth   int        `json:"quarantine_depth"`
+	DeadLetterPending int        `json:"dead_letter_pending"`
+	Status            sub_status `json:"status"`
+}
+
+// report_loop runs until ctx is cancelled.
+func report_loop(ctx context.Context, subs []*subscription) {
+	tick := time.NewTicker(REPORT_INTERVAL)
+	defer tick.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		r := sentences_report{
+			Type:          "sentences",
+			Agent:         agent_id,
+			Tenant:        tenant_id,
+			Interval:      time.Since(last).Seconds(),
+			Subscriptions: []subscription_report{},
+		}
+		last = time.Now()
+		for _, s := range subs {
+			sr := subscription_report{
+				Name:        s.Name,
+				Persisted:   s.stats.persisted.Swap(0),
+				Failed:      s.stats.failed.Swap(0),
+				Quarantined: s.stats.quarantined.Swap(0),
+				Rejected:    s.stats.rejected.Swap(0),
+				Status:      s.get_status(),
+			}
+			sr.QuarantineDepth, sr.DeadLetterPending = s.quarantine_depth()
+			r.Subscriptions = append(r.Subscriptions, sr)
+		}
+		if e := send_report(r); e != nil {
+			log.Printf("failed to report to host: %s", e)
+		}
+	}
+}
+
+// send_report goes to our host, signed if we have an identity.
+func send_report(r sentences_report) error {
+	if guest_id.Host == "" {
+		return nil
+	}
+	j, _ := json.Marshal(r)
+	m := &nats.Msg{Subject: fmt.Sprintf("firecracker.host.%s", guest_id.Host), Data: j}
+	if e := guest_mmds.SignMsg(m); e != nil {
+		return e
+	}
+	conn_mu.Lock()
+	c := nc
+	conn_mu.Unlock()
+	return c.PublishMsg(m)
+}
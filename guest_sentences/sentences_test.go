@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Everything in the stream lands as files, in order, with the right payloads,
+// in both delivery modes.
+func TestInitialDelivery(t *testing.T) {
+	for _, mode := range []string{AT_MOST_ONCE, AT_LEAST_ONCE} {
+		t.Run(mode, func(t *testing.T) {
+			h := new_harness(t, map[string]any{"delivery-mode": mode})
+			seqs := h.publish("m", 25)
+
+			// The clock is ours: it starts in 2001 and runs at the usual speed.
+			base, started := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), time.Now()
+			now = func() time.Time { return base.Add(time.Since(started)) }
+
+			h.start()
+			wait_for(t, "25 sentences", 10*time.Second, func() bool { return len(h.files()) == 25 })
+			if !same_seqs(h.files(), seqs) {
+				t.Fatalf("got %v, want %v", h.files(), seqs)
+			}
+			if got := h.read(seqs[7]); got != "m-7" {
+				t.Errorf("sentence %d is %q", seqs[7], got)
+			}
+			// The marker is written after the last file lands.
+			wait_for(t, "the marker", 10*time.Second, func() bool { return h.marker() == seqs[24] })
+
+			// A sentence that arrives while we're running.
+			more := h.publish("late", 1)
+			wait_for(t, "the late sentence", 10*time.Second, func() bool { return len(h.files()) == 26 })
+			if got := h.read(more[0]); got != "late-0" {
+				t.Errorf("late sentence is %q", got)
+			}
+
+			wait_for(t, "status", 10*time.Second, func() bool { return h.status().HighestPersisted == more[0] })
+			st := h.status()
+			if st.Updated.Year() != 2001 || st.LastMessage.Year() != 2001 {
+				t.Errorf("status times %s and %s aren't on our clock", st.Updated, st.LastMessage)
+			}
+			if st.Connection != "connected" || st.BacklogFiles != 26 {
+				t.Errorf("status %+v", st)
+			}
+		})
+	}
+}
+
+// A restart carries on after highest_persisted_sequence, whatever the consumer.
+func TestResume(t *testing.T) {
+	for _, consumer := range []string{EPHEMERAL, DURABLE} {
+		t.Run(consumer, func(t *testing.T) {
+			h := new_harness(t, map[string]any{"consumer": consumer, "delivery-mode": AT_LEAST_ONCE})
+			first := h.publish("first", 10)
+			h.start()
+			wait_for(t, "the first 10", 10*time.Second, func() bool { return len(h.files()) == 10 })
+			h.stop()
+
+			// User code takes them while we're down, and more come in.
+			h.take_all()
+			second := h.publish("second", 5)
+			if consumer == DURABLE {
+				// Even without the consumer, the marker says where we were.
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				stream, _ := h.js.Stream(ctx, "AGENT_SENTENCES")
+				if e := stream.DeleteConsumer(ctx, TEST_DURABLE); e != nil {
+					t.Fatal(e)
+				}
+				cancel()
+			}
+
+			h.start()
+			wait_for(t, "the next 5", 10*time.Second, func() bool { return len(h.files()) == 5 })
+			time.Sleep(500 * time.Millisecond)
+			if !same_seqs(h.files(), second) {
+				t.Fatalf("after restart got %v, want %v (first run had %v)", h.files(), second, first)
+			}
+			if h.marker() != second[4] {
+				t.Errorf("marker at %d, want %d", h.marker(), second[4])
+			}
+		})
+	}
+}
+
+// We stop at max-files waiting, and pick up as user code makes room.
+func TestBackpressure(t *testing.T) {
+	h := new_harness(t, map[string]any{"max-files": 5, "batch-size": 10, "delivery-mode": AT_LEAST_ONCE})
+	seqs := h.publish("m", 20)
+	h.start()
+
+	wait_for(t, "5 sentences", 10*time.Second, func() bool { return len(h.files()) == 5 })
+	wait_for(t, "held off", 10*time.Second, func() bool { return h.status().HeldOff != "" })
+	time.Sleep(500 * time.Millisecond)
+	if !same_seqs(h.files(), seqs[:5]) {
+		t.Fatalf("held off with %v, want %v", h.files(), seqs[:5])
+	}
+	if h.marker() != seqs[4] {
+		t.Errorf("marker at %d, want %d", h.marker(), seqs[4])
+	}
+
+	for _, seq := range seqs[:3] {
+		h.take(seq)
+	}
+	wait_for(t, "3 more", 10*time.Second, func() bool { return same_seqs(h.files(), seqs[3:8]) })
+	time.Sleep(500 * time.Millisecond)
+	if len(h.files()) != 5 {
+		t.Fatalf("past max-files: %v", h.files())
+	}
+
+	wait_for(t, "the rest", 10*time.Second, func() bool {
+		h.take_all()
+		return h.marker() == seqs[19]
+	})
+}
+
+// The server goes away and comes back, with its store, and we carry on.
+func TestServerRestart(t *testing.T) {
+	h := new_harness(t, map[string]any{"consumer": DURABLE, "delivery-mode": AT_LEAST_ONCE})
+	first := h.publish("first", 10)
+	h.start()
+	wait_for(t, "the first 10", 10*time.Second, func() bool { return len(h.files()) == 10 })
+
+	h.stop_server()
+	time.Sleep(500 * time.Millisecond)
+	h.start_server()
+	wait_for(t, "our client to reconnect", 10*time.Second, func() bool { return h.nc.IsConnected() })
+
+	second := h.publish("second", 10)
+	want := append(first, second...)
+	wait_for(t, "all 20", 20*time.Second, func() bool { return len(h.files()) == 20 })
+	time.Sleep(500 * time.Millisecond)
+	if !same_seqs(h.files(), want) {
+		t.Fatalf("got %v, want %v", h.files(), want)
+	}
+	wait_for(t, "a status that shows the reconnect", 20*time.Second, func() bool {
+		st := h.status()
+		return st.Connection == "connected" && st.Reconnects > 0
+	})
+}
+
+// Someone deletes our durable consumer while we're using it. We make another from
+// the marker, and lose and repeat nothing.
+func TestConsumerDeleted(t *testing.T) {
+	h := new_harness(t, map[string]any{"consumer": DURABLE, "delivery-mode": AT_LEAST_ONCE})
+	first := h.publish("first", 10)
+	h.start()
+	wait_for(t, "the first 10", 10*time.Second, func() bool { return len(h.files()) == 10 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, e := h.js.Stream(ctx, "AGENT_SENTENCES")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := stream.DeleteConsumer(ctx, TEST_DURABLE); e != nil {
+		t.Fatal(e)
+	}
+
+	second := h.publish("second", 10)
+	want := append(first, second...)
+	wait_for(t, "all 20", 20*time.Second, func() bool { return len(h.files()) == 20 })
+	time.Sleep(500 * time.Millisecond)
+	if !same_seqs(h.files(), want) {
+		t.Fatalf("got %v, want %v", h.files(), want)
+	}
+	if _, e := stream.Consumer(ctx, TEST_DURABLE); e != nil {
+		t.Errorf("consumer wasn't recreated: %s", e)
+	}
+	if h.status().Duplicates != 0 {
+		t.Errorf("%d duplicates", h.status().Duplicates)
+	}
+}
+
+// User code takes sentences as fast as they come while we write them, with
+// backpressure coming and going. It sees every one, once, in order.
+func TestConcurrentUserDeletion(t *testing.T) {
+	h := new_harness(t, map[string]any{"max-files": 10, "batch-size": 4, "delivery-mode": AT_LEAST_ONCE})
+	h.start()
+
+	const N = 300
+	var wg sync.WaitGroup
+	var seqs []uint64
+	wg.Go(func() { seqs = h.publish("m", N) })
+
+	seen := []uint64{}
+	payloads := map[uint64]string{}
+	deadline := time.Now().Add(60 * time.Second)
+	for len(seen) < N && time.Now().Before(deadline) {
+		for _, seq := range h.files() {
+			p, e := h.take(seq)
+			if e != nil {
+				t.Fatalf("taking %d: %s", seq, e)
+			}
+			seen = append(seen, seq)
+			payloads[seq] = p
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	if !same_seqs(seen, seqs) {
+		t.Fatalf("user code saw %d sentences, want %d, in order: %v", len(seen), N, seen)
+	}
+	for i, seq := range seqs {
+		if want := fmt.Sprintf("m-%d", i); payloads[seq] != want {
+			t.Errorf("sentence %d is %q, want %q", seq, payloads[seq], want)
+		}
+	}
+	if h.marker() != seqs[N-1] {
+		t.Errorf("marker at %d, want %d", h.marker(), seqs[N-1])
+	}
+}
+
+// User code takes each file the moment it's renamed into place, before we've
+// gone on to anything else. None of them stays in the backlog, so we never hold
+// off.
+func TestTakenOnRename(t *testing.T) {
+	persist_renamed = func(fp string) {
+		base := filepath.Base(fp)
+		bin, _ := filepath.Match(PERSIST_PATTERN, base)
+		meta, _ := filepath.Match(META_PATTERN, base)
+		if bin || meta {
+			os.Remove(fp)
+			// Long enough for the watch to see it go.
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	t.Cleanup(func() { persist_renamed = func(string) {} })
+
+	h := new_harness(t, map[string]any{"max-files": 3, "batch-size": 2})
+	seqs := h.publish("m", 10)
+	h.start()
+	wait_for(t, "the marker", 10*time.Second, func() bool { return h.marker() == seqs[9] })
+	wait_for(t, "an empty backlog", 10*time.Second, func() bool {
+		st := h.status()
+		return st.HighestPersisted == seqs[9] && st.BacklogFiles == 0 && st.BacklogBytes == 0 && st.HeldOff == ""
+	})
+}
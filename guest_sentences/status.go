@@ -0,0 +1,161 @@
+package main
+
+/* Where each subscription is at, for user code that wants to know whether it
+ * has everything.
+ *
+ * With a subject filter, stream sequences have gaps that are nobody's fault, so
+ * user code can't tell from the file names whether something went missing. We
+ * can: every delivery on a consumer gets the next consumer sequence, so a jump
+ * in those means deliveries that never reached us. When we see one we stop and
+ * start the consumer again from the marker, rather than persist past what's
+ * missing (see handle_msg). With "counter" on, every sentence also gets a
+ * count, one more than the last, so user code can check there are no holes.
+ * The count goes in the marker after the sequence, so the two move together.
+ *
+ * status.json in the subscription's dir is rewritten at most every second while
+ * things are changing, and every STATUS_INTERVAL otherwise, so user code and
+ * whoever is looking after the agent can tell a slow agent (held off, files
+ * piling up) from a broken pipeline (not connected, fetch errors, messages
+ * pending and nothing arriving):
+ *
+ *   {
+ *     "subscription": "sentences",
+ *     "stream": "AGENT_SENTENCES",
+ *     "consumer": "sentences_acme_agent-7",
+ *     "connection": "connected",  // or reconnecting, closed...
+ *     "reconnects": 0,            // of this process's NATS connection
+ *     "highest_persisted": 42,
+ *     "last_fetched": 42,         // stream sequence of the last message fetched
+ *     "count": 17,                // with counter on
+ *     "num_pending": 3,           // messages for us still in the stream, -1 if we can't tell
+ *     "backlog_files": 5,         // sentences waiting for user code
+ *     "backlog_bytes": 1234,
+ *     "held_off": "",             // why we've stopped fetching, see backpressure.go
+ *     "fetch_errors": 0,          // failed fetches and subscribes, since we started
+ *     "gaps": 0,                  // since we started
+ *     "redelivered": 0,
+ *     "duplicates": 0,
+ *     "last_message": "2026-01-02T03:04:00Z",
+ *     "updated": "2026-01-02T03:04:05Z"
+ *   }
+ *
+ * The same goes to the host in our reports, and to the metrics endpoint, see
+ * metrics.go.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"nats_connect"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const STATUS_FILE = "status.json"
+
+var STATUS_INTERVAL = 10 * time.Second
+
+// sub_status is status.json.
+type sub_status struct {
+	Subscription     string    `json:"subscription"`
+	Stream           string    `json:"stream"`
+	Consumer         string    `json:"consumer"`
+	Connection       string    `json:"connection"`
+	Reconnects       uint64    `json:"reconnects"`
+	HighestPersisted uint64    `json:"highest_persisted"`
+	LastFetched      uint64    `json:"last_fetched"`
+	Count            uint64    `json:"count,omitempty"`
+	NumPending       int64     `json:"num_pending"`
+	BacklogFiles     int       `json:"backlog_files"`
+	BacklogBytes     int64     `json:"backlog_bytes"`
+	HeldOff          string    `json:"held_off"`
+	FetchErrors      uint64    `json:"fetch_errors"`
+	Gaps             uint64    `json:"gaps"`
+	Redelivered      uint64    `json:"redelivered"`
+	Duplicates       uint64    `json:"duplicates"`
+	LastMessage      time.Time `json:"last_message,omitzero"`
+	Updated          time.Time `json:"updated"`
+}
+
+// next_count is the count the next sentence gets, or 0 with counter off.
+func (s *subscription) next_count() uint64 {
+	if !sentences.Counter {
+		return 0
+	}
+	return s.count + 1
+}
+
+// connection_state is our NATS connection's state, in lower case.
+func connection_state() string {
+	conn_mu.Lock()
+	c := nc
+	conn_mu.Unlock()
+	if c == nil {
+		return "none"
+	}
+	return strings.ToLower(c.Status().String())
+}
+
+// write_status rewrites status.json if it's due: at most every second if anything has
+// changed, and every STATUS_INTERVAL regardless. got_msgs says whether the last fetch
+// brought anything; if not, we ask the server how much is pending, since no message
+// told us.
+func (s *subscription) write_status(got_msgs bool) {
+	st := sub_status{
+		Subscription:     s.Name,
+		Stream:           s.Stream,
+		Connection:       connection_state(),
+		Reconnects:       nats_connect.GetStats().Reconnects,
+		HighestPersisted: s.get_highest_persist(),
+		LastFetched:      s.last_fetched,
+		Count:            s.count,
+		HeldOff:          s.held_off,
+		FetchErrors:      s.fetch_errors,
+		Gaps:             s.gaps,
+		Redelivered:      s.redelivered,
+		Duplicates:       s.duplicates,
+		LastMessage:      s.last_message,
+	}
+	st.BacklogFiles, st.BacklogBytes = s.backlog.get()
+	if s.consumer != nil {
+		st.Consumer = s.consumer.CachedInfo().Name
+	}
+
+	s.status_mu.Lock()
+	prev := s.status
+	s.status_mu.Unlock()
+	since := now().Sub(prev.Updated)
+	prev.NumPending, prev.Updated = 0, time.Time{}
+	if since < time.Second || (!got_msgs && st == prev && since < STATUS_INTERVAL) {
+		return
+	}
+
+	if s.consumer != nil && !got_msgs {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if info, e := s.consumer.Info(ctx); e == nil {
+			s.pending = int64(info.NumPending)
+		} else {
+			s.pending = -1
+		}
+		cancel()
+	}
+	st.NumPending = s.pending
+	st.Updated = now().UTC()
+	s.status_mu.Lock()
+	s.status = st
+	s.status_mu.Unlock()
+
+	j, _ := json.MarshalIndent(st, "", "  ")
+	if e := write_persist_file(filepath.Join(s.Dir, STATUS_FILE), append(j, '\n')); e != nil {
+		log.Printf("%s: %s", s.Name, e)
+	}
+}
+
+// get_status returns the status last written, for other goroutines.
+func (s *subscription) get_status() sub_status {
+	s.status_mu.Lock()
+	defer s.status_mu.Unlock()
+	return s.status
+}
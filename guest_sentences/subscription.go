@@ -0,0 +1,536 @@
+package main
+
+/* One subscription: a stream consumer and the directory it persists into.
+ *
+ * Each subscription runs in its own goroutine with its own consumer, its own
+ * highest_persisted_sequence marker and its own backpressure, so a broadcast
+ * subject that user code ignores can't hold up the agent's own sentences. They
+ * share the NATS connection.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DELIVER_POLICIES maps the deliver-policy setting to where a brand-new
+// consumer starts. Empty means all, as it always did.
+var DELIVER_POLICIES = map[string]jetstream.DeliverPolicy{
+	"":                 jetstream.DeliverAllPolicy,
+	"all":              jetstream.DeliverAllPolicy,
+	"new":              jetstream.DeliverNewPolicy,
+	"last":             jetstream.DeliverLastPolicy,
+	"last-per-subject": jetstream.DeliverLastPerSubjectPolicy,
+}
+
+// subscription
+type subscription struct {
+	subscription_config
+	highest_persist_file string
+
+	consumer jetstream.Consumer
+	conn_gen uint64 // the connection consumer was made on, see connect_nats
+
+	// Replay and rewind, see control.go. reset has pull_subscribe replace a
+	// durable consumer rather than resume it. During a redeliver, replay_end
+	// is the end of the range and resume_after the marker from before it.
+	control      chan *control_request
+	reset        bool
+	replay_end   uint64
+	resume_after uint64
+
+	// nak_floor is the sequence of a message we failed to persist in
+	// at-least-once mode, or 0. Until it's been redelivered and persisted, we
+	// NAK anything after it: persisting a later message would move the marker
+	// past it, and then we'd take it for a duplicate.
+	nak_floor uint64
+
+	// failures counts failed tries to persist each sentence, and rejects is
+	// poked when user code rejects one. See quarantine.go.
+	failures map[uint64]int
+	rejects  chan struct{}
+	stats    sub_stats
+
+	// Sequencing, see status.go. last_cseq is the consumer sequence of the
+	// last delivery on this consumer, and resync is set when we find a gap
+	// after it. count is the last count we gave out.
+	last_cseq   uint64
+	resync      bool
+	count       uint64
+	pending     int64
+	gaps        uint64
+	redelivered uint64
+	duplicates  uint64
+
+	// For status.go: status is what we last wrote, which other goroutines
+	// read under status_mu.
+	last_fetched uint64
+	last_message time.Time
+	fetch_errors uint64
+	status_mu    sync.Mutex
+	status       sub_status
+
+	// backpressure state, see backpressure.go
+	backlog   *backlog
+	room_wait time.Duration
+	held_off  string
+}
+
+// new_subscription
+func new_subscription(c subscription_config) *subscription {
+	return &subscription{
+		subscription_config:  c,
+		highest_persist_file: filepath.Join(c.Dir, "highest_persisted_sequence"),
+		backlog:              new_backlog(c.Dir),
+		control:              make(chan *control_request),
+		failures:             map[uint64]int{},
+		rejects:              make(chan struct{}, 1),
+		room_wait:            ROOM_WAIT_MIN,
+	}
+}
+
+// setup_dir creates the directory so user code can access it (perms.go), and cleans up
+// after a crash.
+func (s *subscription) setup_dir() error {
+	if e := make_dir(s.Dir); e != nil {
+		return e
+	}
+	if e := make_private_dir(filepath.Join(s.Dir, QUARANTINE_DIR)); e != nil {
+		return e
+	}
+	return s.recover_dir()
+}
+
+// run fetches and persists until ctx is cancelled. A batch we're in the middle of is
+// finished first, so nothing is left half written.
+func (s *subscription) run(ctx context.Context) {
+	tick := time.NewTicker(60 * time.Second)
+	defer tick.Stop()
+	tick2 := time.NewTicker(10 * time.Second)
+	defer tick2.Stop()
+	if s.Consumer == DURABLE {
+		// A durable consumer doesn't time out on us, so there's nothing to
+		// work around.
+		tick2.Stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			// After a new connection, or if we couldn't subscribe last
+			// time, resubscribe before fetching.
+			if s.consumer == nil || s.conn_gen != conn_gen.Load() {
+				if e := s.pull_subscribe(); e != nil {
+					log.Printf("%s: nat subscribe error %v", s.Name, e)
+					s.fetch_errors++
+					s.write_status(false)
+					sleep(ctx, time.Second)
+					continue
+				}
+			}
+			s.get_messages(ctx)
+
+		case r := <-s.control:
+			s.apply_control(r)
+
+		case <-tick.C:
+			// For a durable consumer this is just a lookup, and it catches
+			// the consumer having been deleted on the server.
+			if s.Consumer == DURABLE {
+				if e := s.pull_subscribe(); e != nil {
+					log.Printf("%s: nat subscribe error %v", s.Name, e)
+				}
+			}
+
+		case <-tick2.C:
+			// Re-subscribe. This works around possible instabilities related to
+			// the subscription inactivity timer running out on us. We set it to
+			// 20 minutes, but it's possible that unexpected user-code behavior
+			// will fail to drain the locally persisted messages and hit the
+			// inactivity timer.
+			if e := s.pull_subscribe(); e != nil {
+				log.Printf("%s: nat subscribe error %v", s.Name, e)
+			}
+		}
+	}
+}
+
+// pull_subscribe
+func (s *subscription) pull_subscribe() error {
+	last_persisted := s.get_highest_persist()
+	gen, js := get_js()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stream, e := js.Stream(ctx, s.Stream)
+	if e != nil {
+		return e
+	}
+
+	// A new consumer, or one we have lost track of, starts a new run of
+	// consumer sequences.
+	fresh := s.consumer == nil || s.conn_gen != gen || s.Consumer == EPHEMERAL
+
+	var cons jetstream.Consumer
+	if s.Consumer == DURABLE {
+		if s.reset {
+			e = stream.DeleteConsumer(ctx, s.durable_name())
+			if e != nil && !errors.Is(e, jetstream.ErrConsumerNotFound) {
+				return e
+			}
+		}
+		cons, e = s.durable_consumer(ctx, stream, last_persisted, fresh)
+	} else {
+		// The same name every time, so the host can hold us to it. The old
+		// one goes first, since a consumer's start can't be changed.
+		name := s.ephemeral_name()
+		if e := stream.DeleteConsumer(ctx, name); e != nil && !errors.Is(e, jetstream.ErrConsumerNotFound) {
+			return e
+		}
+		c := s.consumer_config(last_persisted)
+		c.Name = name
+		cons, e = stream.CreateConsumer(ctx, c)
+	}
+	if e != nil {
+		return e
+	}
+
+	s.consumer = cons
+	s.conn_gen = gen
+	s.reset = false
+	if fresh {
+		s.last_cseq = 0
+	}
+	return nil
+}
+
+// consumer_config starts after the marker, or per DeliverPolicy if we have nothing yet.
+// A marker of 0 is there because of a replay from the start, see control.go.
+// Nats is persnickety about OptStartSeq: 0 gives an error.
+// A single FilterSubject (rather than FilterSubjects) puts the filter into the
+// consumer-create API subject, which is what lets our NATS permissions limit
+// us to our own sentences.
+func (s *subscription) consumer_config(last_persisted uint64) jetstream.ConsumerConfig {
+	c := jetstream.ConsumerConfig{
+		DeliverPolicy: jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:   last_persisted + 1,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	}
+	if last_persisted == 0 && !file_exists(s.highest_persist_file) {
+		c.DeliverPolicy = DELIVER_POLICIES[s.DeliverPolicy]
+		c.OptStartSeq = 0
+	}
+	if len(s.FilterSubjects) == 1 {
+		c.FilterSubject = s.FilterSubjects[0]
+	} else {
+		c.FilterSubjects = s.FilterSubjects
+	}
+	return c
+}
+
+// durable_consumer returns our durable consumer, creating it if this is our first run or
+// if it has been deleted on the server. A new one starts after the local marker. An
+// existing one resumes from its own position; if that's behind the marker, the messages
+// in between come again and handle_msg acks them without writing them. If it's past the
+// marker, and we're not already fetching from it, it delivered messages we never
+// persisted, which would only come back after the ones that followed them, and be taken
+// for duplicates. So we start it again from the marker.
+func (s *subscription) durable_consumer(ctx context.Context, stream jetstream.Stream, last_persisted uint64, fresh bool) (jetstream.Consumer, error) {
+	name := s.durable_name()
+	cons, e := stream.Consumer(ctx, name)
+	switch {
+	case e == nil && !fresh:
+		return cons, nil
+	case e == nil && cons.CachedInfo().Delivered.Stream <= last_persisted:
+		log.Printf("%s: resuming durable consumer %s", s.Name, name)
+		return cons, nil
+	case e == nil:
+		log.Printf("%s: durable consumer %s delivered up to %d, past the marker", s.Name, name, cons.CachedInfo().Delivered.Stream)
+		if e := stream.DeleteConsumer(ctx, name); e != nil && !errors.Is(e, jetstream.ErrConsumerNotFound) {
+			return nil, e
+		}
+	case !errors.Is(e, jetstream.ErrConsumerNotFound):
+		return nil, e
+	}
+
+	log.Printf("%s: creating durable consumer %s from %d", s.Name, name, last_persisted+1)
+	c := s.consumer_config(last_persisted)
+	c.Durable = name
+	c.InactiveThreshold = sentences.inactive_threshold
+	return stream.CreateConsumer(ctx, c)
+}
+
+// durable_name is unique per subscription, tenant and agent. All three are valid
+// subject tokens, which makes them valid in a consumer name too. With per-agent
+// NATS credentials, the host only lets us use this name, ephemeral_name and
+// lookup_name (see host_daemon/creds.go).
+func (s *subscription) durable_name() string {
+	return fmt.Sprintf("%s_%s_%s", s.Name, tenant_id, agent_id)
+}
+
+// ephemeral_name is what our ephemeral consumer is called.
+func (s *subscription) ephemeral_name() string {
+	return s.durable_name() + "_ephemeral"
+}
+
+// lookup_name is what seq_at_time's throwaway consumer is called.
+func (s *subscription) lookup_name() string {
+	return s.durable_name() + "_lookup"
+}
+
+// get_messages fetches a batch of messages, as many as we have room for, and persists
+// them. With nothing in the stream for us, the fetch waits up to FETCH_WAIT, or until
+// ctx is cancelled. Messages we already have are persisted even then.
+func (s *subscription) get_messages(ctx context.Context) {
+	n := s.fetch_size()
+	if n == 0 {
+		s.wait_for_room(ctx)
+		s.write_status(false)
+		return
+	}
+
+	got_msgs := false
+	fctx, cancel := context.WithTimeout(ctx, FETCH_WAIT)
+	defer cancel()
+	batch, e := s.consumer.Fetch(n, jetstream.FetchContext(fctx))
+	if e == nil {
+		n_highest := s.get_highest_persist()
+		was := n_highest
+		for m := range batch.Messages() {
+			got_msgs = true
+			s.handle_msg(m, &n_highest)
+		}
+		if s.replay_end != 0 && n_highest >= s.replay_end {
+			s.end_replay(&n_highest)
+		}
+		if s.resync {
+			s.resync = false
+			s.consumer = nil
+			s.reset = true
+		}
+		if n_highest != was {
+			log.Printf("%s: persisted up to %d", s.Name, n_highest)
+		}
+		e = batch.Error()
+	}
+	s.write_status(got_msgs)
+	if ctx.Err() != nil {
+		return
+	}
+	if e != nil && !errors.Is(e, nats.ErrTimeout) && !errors.Is(e, context.DeadlineExceeded) {
+		s.fetch_errors++
+		log.Printf("%s: %v", s.Name, e)
+		if errors.Is(e, jetstream.ErrConsumerDeleted) || errors.Is(e, jetstream.ErrConsumerNotFound) {
+			if e := s.pull_subscribe(); e != nil {
+				log.Printf("%s: nat subscribe error %v", s.Name, e)
+			}
+		}
+		sleep(ctx, 100*time.Millisecond)
+	}
+}
+
+// handle_msg persists one message and acks it, in the order the delivery mode calls for.
+// n_highest is the marker, which we keep up to date through the batch.
+func (s *subscription) handle_msg(m jetstream.Msg, n_highest *uint64) {
+	meta, e := m.Metadata()
+	if e != nil {
+		// Not a JetStream message, so there's nothing to persist or ack.
+		log.Printf("%s: %v", s.Name, e)
+		return
+	}
+	ss := meta.Sequence.Stream
+
+	// Deliveries that never reached us will come again only after this one,
+	// and if we persisted this one first we'd take them for duplicates. Leave
+	// this and the rest of the batch, and start over from the marker.
+	if s.resync {
+		return
+	}
+	if cs := meta.Sequence.Consumer; s.last_cseq != 0 && cs > s.last_cseq+1 {
+		log.Printf("%s: gap, deliveries %d to %d never reached us; starting again after %d", s.Name, s.last_cseq+1, cs-1, *n_highest)
+		s.gaps++
+		s.resync = true
+		return
+	}
+	s.last_cseq = meta.Sequence.Consumer
+	s.last_fetched = ss
+	s.last_message = now()
+	s.pending = int64(meta.NumPending)
+	if meta.NumDelivered > 1 {
+		s.redelivered++
+	}
+	if ss <= *n_highest {
+		s.duplicates++
+	}
+
+	side := s.make_sidecar(m, meta)
+	if s.replay_end != 0 && ss > s.replay_end {
+		s.end_replay(n_highest)
+	}
+
+	if sentences.DeliveryMode == AT_MOST_ONCE {
+		m.Ack()
+		if ss > *n_highest {
+			// persist and store new highest
+			if e := s.save(m, ss, side); e != nil {
+				log.Printf("%s: LOST sentence %d: %s", s.Name, ss, e)
+				return
+			}
+			*n_highest = ss
+		}
+		return
+	}
+
+	if s.nak_floor != 0 && ss > s.nak_floor {
+		m.NakWithDelay(sentences.nak_delay)
+		return
+	}
+	// Anything at or below the marker is a redelivery of something we
+	// already have, because our ack went missing. Just ack it again.
+	if ss > *n_highest {
+		if e := s.save(m, ss, side); e != nil {
+			log.Printf("%s: failed to persist sentence %d, redelivering in %s: %s", s.Name, ss, sentences.nak_delay, e)
+			m.NakWithDelay(sentences.nak_delay)
+			if s.nak_floor == 0 || ss < s.nak_floor {
+				s.nak_floor = ss
+			}
+			return
+		}
+		*n_highest = ss
+		if ss == s.nak_floor {
+			s.nak_floor = 0
+		}
+	}
+	if e := m.Ack(); e != nil {
+		log.Printf("%s: failed to ack sentence %d: %s", s.Name, ss, e)
+	}
+}
+
+// save persists a message, or quarantines it if it's too big to, or if we've failed
+// to too often. With at-most-once, that's after one failure, since there's no
+// second try. An error means it's neither, and needs another try.
+func (s *subscription) save(m jetstream.Msg, ss uint64, side []byte) error {
+	reason := REASON_FAILED
+	var e error
+	if sentences.MaxSentenceBytes > 0 && int64(len(m.Data())) > sentences.MaxSentenceBytes {
+		reason = REASON_TOO_LARGE
+		e = fmt.Errorf("%d bytes, over max-sentence-bytes", len(m.Data()))
+	} else if e = s.persist_msg(ss, m.Data(), side); e == nil {
+		delete(s.failures, ss)
+		s.stats.persisted.Add(1)
+		return nil
+	}
+	s.stats.failed.Add(1)
+	s.failures[ss]++
+	n := s.failures[ss]
+	if reason == REASON_FAILED && sentences.DeliveryMode == AT_LEAST_ONCE && n < sentences.MaxPersistFailures {
+		return e
+	}
+
+	delete(s.failures, ss)
+	if qe := s.quarantine_msg(m, ss, reason, e, n); qe != nil {
+		return fmt.Errorf("%w, and quarantine failed: %w", e, qe)
+	}
+	// Quarantined counts as persisted, as far as the marker and the count go.
+	if sentences.Counter {
+		s.count++
+	}
+	if e := s.set_highest_persist(ss); e != nil {
+		log.Printf("%s: %s", s.Name, e)
+	}
+	return nil
+}
+
+// set_highest_persist writes the marker, with the count after it if counter is on, so
+// the two always agree.
+func (s *subscription) set_highest_persist(seq uint64) error {
+	marker := fmt.Sprintf("%020d", seq)
+	if sentences.Counter {
+		marker += fmt.Sprintf(" %d", s.count)
+	}
+	return write_persist_file(s.highest_persist_file, []byte(marker))
+}
+
+// get_highest_persist reads a file containing the stream-sequence number
+// of the last message to be persisted. If there is no last-persisted sequence,
+// the return value is 0.
+func (s *subscription) get_highest_persist() uint64 {
+	seq, _ := s.read_marker()
+	return seq
+}
+
+// read_marker returns the sequence in the marker file, and the count if there is one.
+func (s *subscription) read_marker() (seq uint64, count uint64) {
+	if d, e := os.ReadFile(s.highest_persist_file); e == nil {
+		f := strings.Fields(string(d))
+		if len(f) > 0 {
+			seq, _ = strconv.ParseUint(f[0], 10, 64)
+		}
+		if len(f) > 1 {
+			count, _ = strconv.ParseUint(f[1], 10, 64)
+		}
+	}
+	return
+}
+
+// persist_msg writes a message as a file, encoded as configured, so user code can read and delete it,
+// then records its sequence as the highest persisted. The marker is only written once the
+// message file is on disk, so it never claims something we don't have. See persist.go.
+// A metadata sidecar, if there is one, goes first, so it's there when the message file appears.
+// After a replay, user code may still have the file from last time, and we leave it be.
+func (s *subscription) persist_msg(seq uint64, data []byte, side []byte) error {
+	seqstr := fmt.Sprintf("%020d", seq)
+	if file_exists(filepath.Join(s.Dir, fmt.Sprintf("as-%s.bin", seqstr))) {
+		return s.set_highest_persist(seq)
+	}
+
+	// Each file goes into the backlog before it's renamed into place. User code
+	// can take it as soon as it's there, and the removal has to find it.
+	ev := event{Event: "sentence", Subscription: s.Name, Seq: seq, Count: s.next_count()}
+	if side != nil {
+		name := fmt.Sprintf("as-%s.json", seqstr)
+		ev.Meta = filepath.Join(s.Dir, name)
+		s.backlog.add(name, int64(len(side)))
+		if e := write_persist_file(ev.Meta, side); e != nil {
+			s.backlog.remove(name)
+			return e
+		}
+	}
+
+	data, e := encode(seq, data)
+	if e != nil {
+		return e
+	}
+	name := fmt.Sprintf("as-%s.bin", seqstr)
+	ev.File = filepath.Join(s.Dir, name)
+	s.backlog.add(name, int64(len(data)))
+	if sentences.Counter {
+		s.backlog.set_count(name, ev.Count)
+	}
+	if e := write_persist_file(ev.File, data); e != nil {
+		s.backlog.remove(name)
+		return e
+	}
+	if sentences.Counter {
+		s.count++
+	}
+	if e := s.set_highest_persist(seq); e != nil {
+		return e
+	}
+	send_event(ev)
+	return nil
+}
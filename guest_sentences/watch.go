@@ -0,0 +1,208 @@
+package main
+
+/* Keeping count of the files user code hasn't taken yet, without globbing the
+ * directory before every fetch.
+ *
+ * Each subscription's backlog is counted once at startup. After that we add
+ * the files we write, just before they appear, and an inotify watch on the
+ * directory tells us when user code deletes or renames them, which also wakes
+ * a subscription that's held off for lack of room. If inotify isn't available,
+ * or its queue overflows, we fall back to counting the directory.
+ */
+
+import (
+	"context"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// backlog
+type backlog struct {
+	dir string
+
+	mu       sync.Mutex
+	files    map[string]int64  // base name to size, payloads and sidecars
+	counts   map[string]uint64 // payload base name to count, with counter on
+	bytes    int64
+	watching bool // false means counts are stale, count the directory instead
+
+	// drained gets a token when a file goes away.
+	drained chan struct{}
+}
+
+// new_backlog
+func new_backlog(dir string) *backlog {
+	return &backlog{dir: dir, files: map[string]int64{}, counts: map[string]uint64{}, drained: make(chan struct{}, 1)}
+}
+
+// rescan counts the directory from scratch.
+func (b *backlog) rescan() {
+	matches, _ := filepath.Glob(filepath.Join(b.dir, PERSIST_PATTERN))
+	metas, _ := filepath.Glob(filepath.Join(b.dir, META_PATTERN))
+	matches = append(matches, metas...)
+	files := map[string]int64{}
+	var bytes int64
+	for _, m := range matches {
+		// A file that's gone by the time we look has just been taken.
+		if fi, e := os.Stat(m); e == nil {
+			files[filepath.Base(m)] = fi.Size()
+			bytes += fi.Size()
+		}
+	}
+	b.mu.Lock()
+	b.files, b.bytes = files, bytes
+	for name := range b.counts {
+		if _, ok := files[name]; !ok {
+			delete(b.counts, name)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// get returns the number of sentences user code hasn't taken yet, and their total
+// size including sidecars. A sidecar left behind after its sentence is taken
+// still counts its bytes.
+func (b *backlog) get() (files int, bytes int64) {
+	b.mu.Lock()
+	watching := b.watching
+	b.mu.Unlock()
+	if !watching {
+		b.rescan()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name := range b.files {
+		if strings.HasSuffix(name, ".bin") {
+			files++
+		}
+	}
+	return files, b.bytes
+}
+
+// add records a file we've written.
+func (b *backlog) add(name string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.files[name]; ok {
+		b.bytes -= old
+	}
+	b.files[name] = size
+	b.bytes += size
+}
+
+// set_count records the count of a payload we've written.
+func (b *backlog) set_count(name string, count uint64) {
+	b.mu.Lock()
+	b.counts[name] = count
+	b.mu.Unlock()
+}
+
+// get_count returns the count of a payload we wrote, if we remember it.
+func (b *backlog) get_count(name string) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count, ok := b.counts[name]
+	return count, ok
+}
+
+// remove records a file going away.
+func (b *backlog) remove(name string) {
+	b.mu.Lock()
+	if size, ok := b.files[name]; ok {
+		delete(b.files, name)
+		b.bytes -= size
+	}
+	delete(b.counts, name)
+	b.mu.Unlock()
+	b.poke()
+}
+
+// poke wakes a subscription waiting in wait_for_room.
+func (b *backlog) poke() {
+	select {
+	case b.drained <- struct{}{}:
+	default:
+	}
+}
+
+// set_watching
+func (b *backlog) set_watching(w bool) {
+	b.mu.Lock()
+	b.watching = w
+	b.mu.Unlock()
+}
+
+// watch_backlogs watches the subscriptions' directories until ctx is cancelled.
+// It returns straight away if inotify can't be set up, and leaves the backlogs
+// counting directories.
+func watch_backlogs(ctx context.Context, subs []*subscription) {
+	w, e := fsnotify.NewWatcher()
+	if e != nil {
+		log.Printf("no inotify, counting files instead: %s", e)
+		return
+	}
+	by_dir := map[string]*subscription{}
+	for _, s := range subs {
+		if e := w.Add(s.Dir); e != nil {
+			log.Printf("%s: no inotify, counting files instead: %s", s.Name, e)
+			continue
+		}
+		by_dir[filepath.Clean(s.Dir)] = s
+		// Count after the watch is in place, so we can't miss a removal.
+		s.backlog.rescan()
+		s.backlog.set_watching(true)
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				s := by_dir[filepath.Dir(ev.Name)]
+				if s == nil {
+					continue
+				}
+				base := filepath.Base(ev.Name)
+				if rejected, _ := filepath.Match(REJECT_PATTERN, base); rejected && ev.Has(fsnotify.Create) {
+					// see quarantine.go
+					select {
+					case s.rejects <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				bin, _ := filepath.Match(PERSIST_PATTERN, base)
+				meta, _ := filepath.Match(META_PATTERN, base)
+				if !bin && !meta {
+					continue
+				}
+				if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+					s.backlog.remove(base)
+				}
+
+			case e, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("inotify: %s", e)
+				if errors.Is(e, fsnotify.ErrEventOverflow) {
+					for _, s := range by_dir {
+						s.backlog.rescan()
+						s.backlog.poke()
+					}
+				}
+			}
+		}
+	}()
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/segmentio/kafka-go"
 	"io"
 	"log"
+	"nats_connect"
 	"ngen/config"
 	"os"
 	"os/exec"
@@ -46,6 +47,68 @@ var cfg struct {
 
 		RootFilesystemDir string `json:"root-fs-dir"`
 		VmlinuxLocation   string `json:"vmlinux-location"`
+
+		// Tenants maps tenant ids to their limits on this host.
+		// Tenants that aren't listed get DefaultTenantLimits.
+		Tenants             map[string]tenant_limits `json:"tenants"`
+		DefaultTenantLimits tenant_limits            `json:"default-tenant-limits"`
+
+		// TenantFirewall turns on maintenance of the FC-TENANTS iptables chain.
+		// IptablesRestoreCommand defaults to ["iptables-restore"].
+		TenantFirewall         bool     `json:"tenant-firewall"`
+		IptablesRestoreCommand []string `json:"iptables-restore-command"`
+
+		// NatsConnection configures our own NATS connection: TLS, creds and
+		// reconnect behavior. GuestNatsConnection is passed to the guests through
+		// MMDS; its CA file is read here and sent inline, and any client
+		// certificate is left out.
+		NatsConnection      nats_connect.Config `json:"nats-connection"`
+		GuestNatsConnection nats_connect.Config `json:"guest-nats-connection"`
+
+		// With NatsAccountSeedFile set, each guest gets its own NATS user JWT
+		// and nkey, scoped to its own subjects. NatsIssuerAccount is the account
+		// public key, needed only when the seed is an account signing key.
+		// NatsCredsTtl is a Go duration and defaults to 24h.
+		NatsAccountSeedFile string `json:"nats-account-seed-file"`
+		NatsIssuerAccount   string `json:"nats-issuer-account"`
+		NatsCredsTtl        string `json:"nats-creds-ttl"`
+
+		// HostKeySeedFile holds this host's nkey seed (a server key, SN...).
+		// With it, guests get signed identity documents. See identity.go.
+		HostKeySeedFile string `json:"host-key-seed-file"`
+
+		// SshKeysFile is a JSON list of operator SSH keys to install in guests.
+		// See ssh_keys.go.
+		SshKeysFile string `json:"ssh-keys-file"`
+
+		// ExecKeysFile is the same for operators' nkeys, which may run
+		// commands in guests through guest_daemon. See exec_keys.go.
+		ExecKeysFile string `json:"exec-keys-file"`
+
+		// SentenceKeyFile holds a secret that guests' keys for encrypting
+		// sentences at rest are derived from. See sentence_keys.go.
+		SentenceKeyFile string `json:"sentence-key-file"`
+
+		// GuestNetwork is handed to each guest through MMDS. The guest derives
+		// its own address from the MAC if this is missing.
+		GuestNetwork struct {
+			PrefixLen int      `json:"prefix-len"`
+			Gateway   string   `json:"gateway"`
+			Dns       []string `json:"dns"`
+		} `json:"guest-network"`
+
+		// GuestSentences is handed to guest_sentences in each guest through
+		// MMDS as is. See guest_sentences/README.md for the settings.
+		GuestSentences map[string]any `json:"guest-sentences"`
+
+		// GuestFiles says where operators may put and get files in guests,
+		// and how big they may be. It goes to guest_daemon through MMDS as is.
+		GuestFiles map[string]any `json:"guest-files"`
+
+		// GuestHeartbeat changes how often guest_daemon sends heartbeats, and
+		// which app units and disks it reports on. It goes to guest_daemon
+		// through MMDS as is.
+		GuestHeartbeat map[string]any `json:"guest-heartbeat"`
 	} `json:"firecracker"`
 }
 
@@ -76,6 +139,9 @@ func main() {
 	}
 
 	log.Printf("Firecracker host daemon id: %s", cfg.Firecracker.HostId)
+	if g := cfg.Firecracker.GuestNatsConnection; g.Cert != "" || g.CertFile != "" || g.Key != "" || g.KeyFile != "" {
+		log.Printf("guest-nats-connection has a client certificate, which guests don't get")
+	}
 
 	if s, e := datamodel.New(&datamodel.Config{
 		Host:   cfg.Db.Host,
@@ -97,7 +163,11 @@ func main() {
 	defer firecracker_log_producer.Close()
 
 	var e error
-	nc, e = nats.Connect(fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port))
+	nc, e = nats_connect.Connect(
+		fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port),
+		&cfg.Firecracker.NatsConnection,
+		fmt.Sprintf("host_daemon %s", cfg.Firecracker.HostId),
+	)
 	if e != nil {
 		panic(e)
 	}
@@ -110,6 +180,12 @@ func main() {
 	}
 	defer sub.Unsubscribe()
 
+	hb_sub, e := nc.Subscribe(fmt.Sprintf("firecracker.heartbeat.%s.>", cfg.Firecracker.HostId), process_heartbeat)
+	if e != nil {
+		panic(e)
+	}
+	defer hb_sub.Unsubscribe()
+
 	// This is too frequently to be hitting postgres.
 	// Improve the fanout someday by caching this in a Nats subject.
 	ticker := time.NewTicker(15 * time.Second)
@@ -132,16 +208,67 @@ func main() {
 }
 
 // process_msg runs on a goroutine and receives a message from this host's NATS channel.
+// Guests report in here with JSON messages carrying a "type" field.
 func process_msg(m *nats.Msg) {
+	var t struct {
+		Type  string `json:"type"`
+		Agent string `json:"agent"`
+	}
+	if e := json.Unmarshal(m.Data, &t); e == nil && t.Type != "" {
+		if e := verify_guest_report(m, t.Agent); e != nil {
+			log.Printf("REJECTED %s report claiming agent %s: %s", t.Type, t.Agent, e)
+			return
+		}
+		process_guest_report(t.Type, m.Data)
+		return
+	}
+
 	log.Printf("received %s", string(m.Data))
 	if m.Reply != "" {
 		nc.Publish(m.Reply, []byte("why did you call me?"))
 	}
 }
 
+// process_guest_report handles the typed reports that guests send us.
+// By the time we get here, the report's signature has been checked.
+func process_guest_report(typ string, data []byte) {
+	switch typ {
+	case "network":
+		var r struct {
+			Agent   string `json:"agent"`
+			Ok      bool   `json:"ok"`
+			Source  string `json:"source"`
+			Address string `json:"address"`
+			Error   string `json:"error"`
+		}
+		if e := json.Unmarshal(data, &r); e != nil {
+			log.Printf("bad network report: %s", e)
+			return
+		}
+		if r.Ok {
+			log.Printf("agent %s network up, %s from %s", r.Agent, r.Address, r.Source)
+		} else {
+			log.Printf("agent %s network FAILED, %s (%s from %s)", r.Agent, r.Error, r.Address, r.Source)
+		}
+	case "ssh-key":
+		process_ssh_key_audit(data)
+	case "exec":
+		process_exec_audit(data)
+	case "file":
+		process_file_audit(data)
+	case "sentences":
+		process_sentences_report(data)
+	default:
+		log.Printf("unknown guest report type %s: %s", typ, string(data))
+	}
+}
+
 type lifecycle_status struct {
-	Tasks         []string `json:"tasks"`
-	RunningAgents []string `json:"running_agents"`
+	Tasks         []string                    `json:"tasks"`
+	RunningAgents []string                    `json:"running_agents"`
+	Nats          nats_connect.Stats          `json:"nats"`
+	Sentences     map[string]sentences_report `json:"sentences"`
+	Heartbeats    map[string]agent_heartbeat  `json:"heartbeats"`
 }
 
 func new_lifecycle_status() *lifecycle_status {
@@ -163,8 +290,9 @@ func run_guest_lifecycle() {
 	if e != nil {
 		panic(e)
 	}
+	default_tenants(defined_slots)
 	for _, s := range defined_slots {
-		log.Printf("Slot defined: %s, %d, %v", s.Agent, s.Slot, s.Enabled)
+		log.Printf("Slot defined: %s, %s, %d, %v", s.Tenant, s.Agent, s.Slot, s.Enabled)
 	}
 
 	// which slots are currently running?
@@ -175,7 +303,10 @@ func run_guest_lifecycle() {
 		status.RunningAgents = append(status.RunningAgents, agent_slot)
 	}
 
-	// which of the defined slots from the database are not currently running? START THEM.
+	// which of the defined slots from the database are not currently running? START THEM,
+	// as long as their tenant is within its limits.
+	usage := get_tenant_usage(defined_slots, running_slots)
+	firewall_guests := tenant_firewall_guests(defined_slots, running_slots)
 	for _, m := range defined_slots {
 		runs := false
 		for _, n := range running_slots {
@@ -188,6 +319,21 @@ func run_guest_lifecycle() {
 			status_line := fmt.Sprintf("NEED TO START SLOT %d", m.Slot)
 			log.Print(status_line)
 			status.Tasks = append(status.Tasks, status_line)
+			if e := admit_slot(&m, usage); e != nil {
+				status_line = fmt.Sprintf("REFUSED TO START SLOT %d, %s", m.Slot, e)
+				log.Print(status_line)
+				status.Tasks = append(status.Tasks, status_line)
+				continue
+			}
+			// Its tap must be walled off before the guest can send anything.
+			firewall_guests[m.Slot] = m.Tenant
+			if e := apply_tenant_firewall(firewall_guests); e != nil {
+				delete(firewall_guests, m.Slot)
+				status_line = fmt.Sprintf("REFUSED TO START SLOT %d, %s", m.Slot, e)
+				log.Print(status_line)
+				status.Tasks = append(status.Tasks, status_line)
+				continue
+			}
 			if e := start_vm(&m); e != nil {
 				log.Printf("failed to start slot %d, %s", m.Slot, e)
 			}
@@ -213,7 +359,21 @@ func run_guest_lifecycle() {
 		}
 	}
 
+	// Keep the tenants apart, and keep the guests' credentials and keys fresh.
+	if running_slots, e := ListFirecrackerProcessesWithID(); e == nil {
+		if e := apply_tenant_firewall(tenant_firewall_guests(defined_slots, running_slots)); e != nil {
+			log.Printf("FAILED to update the tenant firewall, %s", e)
+		}
+		rotate_agent_creds(defined_slots, running_slots)
+		rotate_agent_identities(defined_slots, running_slots)
+		sync_agent_ssh_keys(defined_slots, running_slots)
+		sync_agent_exec_keys(defined_slots, running_slots)
+	}
+
 	// Now write a status entry
+	status.Nats = nats_connect.GetStats()
+	status.Sentences = agent_sentences_status()
+	status.Heartbeats = agent_heartbeat_status(running_slots)
 	j, _ := json.MarshalIndent(status, "", " ")
 	msg := kafka.Message{
 		Key:   []byte(cfg.Firecracker.HostId),
@@ -357,9 +517,34 @@ func start_vm(slot *datamodel.FirecrackerSlot) error {
 		return e
 	}
 
+	guest_nats_connection, e := generate_guest_nats_connection()
+	if e != nil {
+		return e
+	}
+
+	identity, e := guest_identity_mmds(slot, time.Now().UTC())
+	if e != nil {
+		return fmt.Errorf("identity document: %w", e)
+	}
+	sentences_key, e := agent_sentence_key(slot)
+	if e != nil {
+		return fmt.Errorf("sentences key: %w", e)
+	}
+
+	// Don't boot a guest we can't give credentials to.
+	secrets, e := agent_creds_mmds(slot)
+	if e != nil {
+		return fmt.Errorf("nats credentials: %w", e)
+	}
+	secrets["nats-server"] = fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port)
+	secrets["tenant"] = slot.Tenant
+	secrets["agent"] = slot.Agent
+	secrets["host"] = cfg.Firecracker.HostId
+	secrets["slot"] = slot.Slot
+
 	api_sock := fmt.Sprintf("%s.%d", cfg.Firecracker.UnixSocketPrefix, slot.Slot)
 	os.Remove(api_sock) // this is for safety in case we left a zombie on a prior run
-	log.Printf("Starting agent %s, slot %d, socket %s, rootfs %s", slot.Agent, slot.Slot, api_sock, rootfs_file)
+	log.Printf("Starting agent %s, tenant %s, slot %d, socket %s, rootfs %s", slot.Agent, slot.Tenant, slot.Slot, api_sock, rootfs_file)
 
 	args := []string{
 		cfg.Firecracker.FirecrackerBinary,
@@ -411,7 +596,7 @@ func start_vm(slot *datamodel.FirecrackerSlot) error {
 	// TODO, REPORT ERRORS OUT
 	_, _, _, _ = CurlPutJSONMap("http://localhost/boot-source", api_sock, map[string]any{
 		"kernel_image_path": cfg.Firecracker.VmlinuxLocation,
-		"boot_args":         fmt.Sprintf("reboot=k panic=1 agent=%s tenant=0 slot=%d nats=%s", slot.Agent, slot.Slot, fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port)),
+		"boot_args":         fmt.Sprintf("reboot=k panic=1 agent=%s tenant=%s slot=%d nats=%s", slot.Agent, slot.Tenant, slot.Slot, fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port)),
 	})
 	_, _, _, _ = CurlPutJSONMap("http://localhost/drives/rootfs", api_sock, map[string]any{
 		"drive_id":       "rootfs",
@@ -419,9 +604,10 @@ func start_vm(slot *datamodel.FirecrackerSlot) error {
 		"is_root_device": true,
 		"is_read_only":   false,
 	})
+	limits := get_tenant_limits(slot.Tenant)
 	_, _, _, _ = CurlPutJSONMap("http://localhost/machine-config", api_sock, map[string]any{
-		"vcpu_count":        2,
-		"mem_size_mib":      512,
+		"vcpu_count":        limits.Vcpus,
+		"mem_size_mib":      limits.MemMib,
 		"smt":               false,
 		"track_dirty_pages": false,
 		"huge_pages":        "None",
@@ -437,11 +623,16 @@ func start_vm(slot *datamodel.FirecrackerSlot) error {
 		"network_interfaces": []string{"eth0"},
 	})
 	_, _, _, _ = CurlPutJSONMap("http://localhost/mmds", api_sock, map[string]any{
-		"secrets": map[string]any{
-			"nats-server": fmt.Sprintf("nats://%s:%d", cfg.Nats.Host, cfg.Nats.Port),
-			"tenant":      "0",
-			"agent":       slot.Agent,
-		},
+		"secrets":         secrets,
+		"network":         generate_guest_network(slot),
+		"nats-connection": guest_nats_connection,
+		"ssh-keys":        agent_ssh_keys_mmds(slot),
+		"exec-keys":       agent_exec_keys_mmds(slot),
+		"identity":        identity,
+		"sentences":       generate_guest_sentences(),
+		"sentences-key":   sentences_key,
+		"files":           generate_guest_files(),
+		"heartbeat":       generate_guest_heartbeat(),
 	})
 	_, _, _, _ = CurlPutJSONMap("http://localhost/actions", api_sock, map[string]any{
 		"action_type": "InstanceStart",
@@ -468,6 +659,83 @@ func generate_guest_mac(slot int) string {
 	return mac
 }
 
+// generate_guest_sentences
+func generate_guest_sentences() map[string]any {
+	if cfg.Firecracker.GuestSentences == nil {
+		return map[string]any{}
+	}
+	return cfg.Firecracker.GuestSentences
+}
+
+// generate_guest_files
+func generate_guest_files() map[string]any {
+	if cfg.Firecracker.GuestFiles == nil {
+		return map[string]any{}
+	}
+	return cfg.Firecracker.GuestFiles
+}
+
+// generate_guest_heartbeat
+func generate_guest_heartbeat() map[string]any {
+	if cfg.Firecracker.GuestHeartbeat == nil {
+		return map[string]any{}
+	}
+	return cfg.Firecracker.GuestHeartbeat
+}
+
+// generate_guest_nats_connection is the nats-connection config we give guests.
+// They can't see our filesystem, so the CA goes in as PEM text. No client
+// certificate or key goes in at all: one key shared by every guest would let
+// any of them pass for the others, or for us. Guests authenticate with the
+// per-agent credentials from creds.go instead.
+func generate_guest_nats_connection() (*nats_connect.Config, error) {
+	g := cfg.Firecracker.GuestNatsConnection
+	out := &nats_connect.Config{
+		Ca:               g.Ca,
+		ReconnectWaitMin: g.ReconnectWaitMin,
+		ReconnectWaitMax: g.ReconnectWaitMax,
+		MaxReconnects:    g.MaxReconnects,
+	}
+	if g.CaFile != "" {
+		d, e := os.ReadFile(g.CaFile)
+		if e != nil {
+			return nil, fmt.Errorf("guest nats connection: %w", e)
+		}
+		out.Ca = string(d)
+	}
+	return out, nil
+}
+
+// generate_guest_ip is the address that generate_guest_mac encodes into the MAC.
+func generate_guest_ip(slot int) string {
+	return fmt.Sprintf("10.0.%d.%d", slot/100, (slot%100)+100)
+}
+
+// generate_guest_network is the network setup we publish into MMDS for the guest.
+// The guest's guest_network component reads it at boot. Without it, the guest
+// falls back to deriving everything from its MAC with a /16 and 10.0.0.1.
+func generate_guest_network(slot *datamodel.FirecrackerSlot) map[string]any {
+	gn := cfg.Firecracker.GuestNetwork
+	prefix_len := gn.PrefixLen
+	if prefix_len == 0 {
+		prefix_len = 16
+	}
+	gateway := gn.Gateway
+	if gateway == "" {
+		gateway = "10.0.0.1"
+	}
+	dns := gn.Dns
+	if dns == nil {
+		dns = []string{}
+	}
+	return map[string]any{
+		"address":  fmt.Sprintf("%s/%d", generate_guest_ip(slot.Slot), prefix_len),
+		"gateway":  gateway,
+		"dns":      dns,
+		"hostname": fmt.Sprintf("agent-%d", slot.Slot),
+	}
+}
+
 /*
 type RunningSlot struct {
 	Agent string
@@ -597,15 +865,26 @@ func CurlPutJSONMap(url string, unixsocket string, data map[string]any) (string,
 	return CurlPutJSON(url, unixsocket, j)
 }
 
+// CurlPatchJSONMap
+func CurlPatchJSONMap(url string, unixsocket string, data map[string]any) (string, string, int, error) {
+	j, _ := json.Marshal(data)
+	return CurlSendJSON("PATCH", url, unixsocket, j)
+}
+
 // CurlPutJSON
 func CurlPutJSON(url string, unixsocket string, jsonData []byte) (stdout, stderr string, exitCode int, err error) {
+	return CurlSendJSON("PUT", url, unixsocket, jsonData)
+}
+
+// CurlSendJSON
+func CurlSendJSON(method string, url string, unixsocket string, jsonData []byte) (stdout, stderr string, exitCode int, err error) {
 	// Build the curl command:
-	// curl -X PUT -H "Content-Type: application/json" -d '<json>' <url>
+	// curl -X <method> -H "Content-Type: application/json" -d '<json>' <url>
 	cmd := exec.Command(
 		"curl",
 		"--unix-socket", unixsocket,
 		"-s", // silent but still show output
-		"-X", "PUT",
+		"-X", method,
 		"-H", "Content-Type: application/json",
 		"-d", string(jsonData),
 		url,
@@ -0,0 +1,309 @@
+package main
+
+/* Per-agent NATS credentials.
+ *
+ * Left to themselves, guests connect to NATS anonymously, and any agent could
+ * subscribe to any other agent's sentences or to our control subjects. When the
+ * config gives us an account signing key, we mint a user JWT and nkey for each
+ * guest, scoped to that agent's own subjects, and hand both to the guest through
+ * MMDS at boot.
+ *
+ * The JWTs expire. run_guest_lifecycle calls rotate_agent_creds, which issues
+ * fresh credentials and patches them into MMDS well before the old ones run
+ * out. The guest picks them up the next time it (re)connects; the server drops
+ * connections whose JWT has expired, so that happens by itself at the latest.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"log"
+	"os"
+	"sdp/datamodel"
+	"strings"
+	"time"
+)
+
+// agent_creds_expiry remembers, per slot, when the credentials we last gave
+// that guest expire. After a restart we know nothing, so everything gets
+// reissued on the first lifecycle pass.
+var agent_creds_expiry = map[int]time.Time{}
+
+// nats_creds_enabled
+func nats_creds_enabled() bool {
+	return cfg.Firecracker.NatsAccountSeedFile != ""
+}
+
+// nats_creds_ttl defaults to a day.
+func nats_creds_ttl() time.Duration {
+	if d, e := time.ParseDuration(cfg.Firecracker.NatsCredsTtl); e == nil && d > 0 {
+		return d
+	}
+	return 24 * time.Hour
+}
+
+// read_account_key loads the account (or account signing) key we sign user JWTs with.
+func read_account_key() (nkeys.KeyPair, error) {
+	d, e := os.ReadFile(cfg.Firecracker.NatsAccountSeedFile)
+	if e != nil {
+		return nil, e
+	}
+	return nkeys.FromSeed([]byte(strings.TrimSpace(string(d))))
+}
+
+// agent_inbox_prefix is the reply-subject prefix a guest must use. A shared
+// _INBOX would let one agent read another's replies.
+func agent_inbox_prefix(tenant, agent string) string {
+	return fmt.Sprintf("_INBOX_%s_%s", tenant, agent)
+}
+
+// agent_permissions lists what a guest may publish and subscribe to. Everything
+// else is denied by the server.
+func agent_permissions(tenant, agent string) jwt.Permissions {
+	p := jwt.Permissions{}
+	for _, sub := range guest_subscriptions(tenant, agent) {
+		// guest_sentences' pull consumers. Only with a single filter subject is
+		// the filter in the create subject, where we can hold the guest to it;
+		// with more, it could create a consumer on the whole stream.
+		if len(sub.FilterSubjects) != 1 {
+			log.Printf("agent %s, tenant %s: subscription %s needs exactly one filter subject with per-agent credentials, not granting it",
+				agent, tenant, sub.Name)
+			continue
+		}
+		p.Pub.Allow.Add("$JS.API.STREAM.INFO." + sub.Stream)
+		for _, name := range guest_consumer_names(sub.Name, tenant, agent) {
+			p.Pub.Allow.Add(
+				"$JS.API.CONSUMER.CREATE."+sub.Stream+"."+name+"."+sub.FilterSubjects[0],
+				// replays and restarts delete and recreate the consumer
+				"$JS.API.CONSUMER.DELETE."+sub.Stream+"."+name,
+				"$JS.API.CONSUMER.INFO."+sub.Stream+"."+name,
+				"$JS.API.CONSUMER.MSG.NEXT."+sub.Stream+"."+name,
+				"$JS.ACK."+sub.Stream+"."+name+".>",
+			)
+		}
+	}
+	if outbox := guest_outbox_subject(tenant, agent); outbox != "" {
+		// guest_sentences' outbox
+		p.Pub.Allow.Add(outbox)
+	}
+	if dead := guest_dead_letter_subject(tenant, agent); dead != "" {
+		// guest_sentences' quarantine
+		p.Pub.Allow.Add(dead)
+	}
+	p.Pub.Allow.Add(
+		// reports to this host
+		fmt.Sprintf("firecracker.host.%s", cfg.Firecracker.HostId),
+		// guest_daemon's exec output and heartbeats
+		fmt.Sprintf("firecracker.exec.%s.%s.*.out", tenant, agent),
+		fmt.Sprintf("firecracker.heartbeat.%s.%s.%s", cfg.Firecracker.HostId, tenant, agent),
+	)
+	p.Sub.Allow.Add(
+		fmt.Sprintf("firecracker.agent.%s.%s", tenant, agent),
+		agent_inbox_prefix(tenant, agent)+".>",
+		// and its exec input and file chunks
+		fmt.Sprintf("firecracker.exec.%s.%s.*.in", tenant, agent),
+		fmt.Sprintf("firecracker.file.%s.%s.*.in", tenant, agent),
+	)
+	if control := guest_control_subject(tenant, agent); control != "" {
+		// guest_sentences' replay requests
+		p.Sub.Allow.Add(control)
+	}
+	// guest_daemon and guest_sentences answer requests on their control subjects
+	p.Resp = &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}
+	return p
+}
+
+// guest_consumer_names are the only consumers a guest may use on a
+// subscription's stream: its durable, its ephemeral and its lookup consumer, see
+// durable_name in guest_sentences/subscription.go.
+func guest_consumer_names(sub, tenant, agent string) []string {
+	durable := sub + "_" + tenant + "_" + agent
+	return []string{durable, durable + "_ephemeral", durable + "_lookup"}
+}
+
+// guest_subscription is the part of a guest_sentences subscription we need
+// for permissions. See guest_sentences/config.go.
+type guest_subscription struct {
+	Name           string   `json:"name"`
+	Stream         string   `json:"stream"`
+	FilterSubjects []string `json:"filter-subjects"`
+}
+
+// guest_subscriptions returns the streams and subjects guest_sentences will read for
+// an agent, according to the guest-sentences config we hand it.
+func guest_subscriptions(tenant, agent string) []guest_subscription {
+	var gs struct {
+		Subscriptions []guest_subscription `json:"subscriptions"`
+	}
+	read_guest_sentences(&gs)
+	if len(gs.Subscriptions) == 0 {
+		gs.Subscriptions = []guest_subscription{{
+			Name:           "sentences",
+			Stream:         "AGENT_SENTENCES",
+			FilterSubjects: []string{"agent.sentences.{tenant}.{agent}"},
+		}}
+	}
+
+	r := strings.NewReplacer("{tenant}", tenant, "{agent}", agent)
+	out := []guest_subscription{}
+	for _, sub := range gs.Subscriptions {
+		filters := []string{}
+		for _, f := range sub.FilterSubjects {
+			filters = append(filters, r.Replace(f))
+		}
+		out = append(out, guest_subscription{sub.Name, sub.Stream, filters})
+	}
+	return out
+}
+
+// read_guest_sentences decodes the parts of guest-sentences that v asks for.
+func read_guest_sentences(v any) {
+	if j, e := json.Marshal(cfg.Firecracker.GuestSentences); e == nil {
+		json.Unmarshal(j, v)
+	}
+}
+
+// guest_sentences_subject fills in a subject setting from guest-sentences the way
+// guest_sentences does: empty means the default, and "off" means none.
+func guest_sentences_subject(subject, def, tenant, agent string) string {
+	switch subject {
+	case "off":
+		return ""
+	case "":
+		subject = def
+	}
+	return strings.NewReplacer("{tenant}", tenant, "{agent}", agent).Replace(subject)
+}
+
+// guest_outbox_subject is where guest_sentences publishes the agent's outbox, or ""
+// if the outbox isn't turned on in guest-sentences.
+func guest_outbox_subject(tenant, agent string) string {
+	var gs struct {
+		Outbox *struct {
+			Subject string `json:"subject"`
+		} `json:"outbox"`
+	}
+	read_guest_sentences(&gs)
+	if gs.Outbox == nil {
+		return ""
+	}
+	return guest_sentences_subject(gs.Outbox.Subject, "agent.outbox.{tenant}.{agent}", tenant, agent)
+}
+
+// guest_control_subject is where guest_sentences takes replay requests, or "" if
+// that's turned off in guest-sentences.
+func guest_control_subject(tenant, agent string) string {
+	var gs struct {
+		ControlSubject string `json:"control-subject"`
+	}
+	read_guest_sentences(&gs)
+	return guest_sentences_subject(gs.ControlSubject, "firecracker.agent.{tenant}.{agent}.sentences", tenant, agent)
+}
+
+// guest_dead_letter_subject is where guest_sentences publishes quarantined sentences,
+// or "" if that's turned off in guest-sentences.
+func guest_dead_letter_subject(tenant, agent string) string {
+	var gs struct {
+		DeadLetterSubject string `json:"dead-letter-subject"`
+	}
+	read_guest_sentences(&gs)
+	return guest_sentences_subject(gs.DeadLetterSubject, "agent.deadletter.{tenant}.{agent}", tenant, agent)
+}
+
+// mint_agent_creds creates a new user nkey for the agent and a JWT for it,
+// signed by the account key.
+func mint_agent_creds(tenant, agent string) (user_jwt string, user_seed string, expires time.Time, e error) {
+	account, e := read_account_key()
+	if e != nil {
+		return
+	}
+	user, e := nkeys.CreateUser()
+	if e != nil {
+		return
+	}
+	pub, e := user.PublicKey()
+	if e != nil {
+		return
+	}
+	seed, e := user.Seed()
+	if e != nil {
+		return
+	}
+
+	expires = time.Now().Add(nats_creds_ttl())
+	claims := jwt.NewUserClaims(pub)
+	claims.Name = fmt.Sprintf("agent.%s.%s", tenant, agent)
+	claims.Expires = expires.Unix()
+	claims.Permissions = agent_permissions(tenant, agent)
+	// When we sign with an account signing key rather than the account key
+	// itself, the JWT has to say which account it's for.
+	claims.IssuerAccount = cfg.Firecracker.NatsIssuerAccount
+
+	if user_jwt, e = claims.Encode(account); e != nil {
+		return
+	}
+	user_seed = string(seed)
+	return
+}
+
+// agent_creds_mmds returns the MMDS secrets entries for a freshly minted set of
+// credentials, or nothing if credentials aren't configured.
+func agent_creds_mmds(slot *datamodel.FirecrackerSlot) (map[string]any, error) {
+	if !nats_creds_enabled() {
+		return map[string]any{}, nil
+	}
+	user_jwt, user_seed, expires, e := mint_agent_creds(slot.Tenant, slot.Agent)
+	if e != nil {
+		return nil, e
+	}
+	agent_creds_expiry[slot.Slot] = expires
+	return map[string]any{
+		"nats-jwt":          user_jwt,
+		"nats-seed":         user_seed,
+		"nats-inbox-prefix": agent_inbox_prefix(slot.Tenant, slot.Agent),
+		"nats-creds-expire": expires.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// rotate_agent_creds reissues credentials for running guests whose current
+// ones are in the last third of their lifetime.
+func rotate_agent_creds(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) {
+	if !nats_creds_enabled() {
+		return
+	}
+	renew_before := nats_creds_ttl() / 3
+
+	for _, d := range defined {
+		runs := false
+		for _, r := range running {
+			if d.Slot == r.Slot {
+				runs = true
+				break
+			}
+		}
+		if !runs {
+			delete(agent_creds_expiry, d.Slot)
+			continue
+		}
+		if exp, ok := agent_creds_expiry[d.Slot]; ok && time.Until(exp) > renew_before {
+			continue
+		}
+
+		secrets, e := agent_creds_mmds(&d)
+		if e != nil {
+			log.Printf("FAILED to mint nats credentials for slot %d, %s", d.Slot, e)
+			continue
+		}
+		api_sock := fmt.Sprintf("%s.%d", cfg.Firecracker.UnixSocketPrefix, d.Slot)
+		if _, _, _, e := CurlPatchJSONMap("http://localhost/mmds", api_sock, map[string]any{
+			"secrets": secrets,
+		}); e != nil {
+			log.Printf("FAILED to rotate nats credentials for slot %d, %s", d.Slot, e)
+			delete(agent_creds_expiry, d.Slot)
+			continue
+		}
+		log.Printf("rotated nats credentials for slot %d, agent %s", d.Slot, d.Agent)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sdp/datamodel"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// creds_server is a nats-server in operator mode, trusting one account, whose
+// seed is where mint_agent_creds looks for it. The observer is a user of that
+// account who may do anything.
+type creds_server struct {
+	t        *testing.T
+	srv      *server.Server
+	observer *nats.Conn
+}
+
+// new_creds_server
+func new_creds_server(t *testing.T) *creds_server {
+	t.Helper()
+	op, _ := nkeys.CreateOperator()
+	op_pub, _ := op.PublicKey()
+	op_jwt, e := jwt.NewOperatorClaims(op_pub).Encode(op)
+	if e != nil {
+		t.Fatal(e)
+	}
+	op_claims, e := jwt.DecodeOperatorClaims(op_jwt)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	account, _ := nkeys.CreateAccount()
+	account_pub, _ := account.PublicKey()
+	account_seed, _ := account.Seed()
+	account_jwt, e := jwt.NewAccountClaims(account_pub).Encode(op)
+	if e != nil {
+		t.Fatal(e)
+	}
+	resolver := &server.MemAccResolver{}
+	resolver.Store(account_pub, account_jwt)
+
+	seed_file := filepath.Join(t.TempDir(), "account.nk")
+	os.WriteFile(seed_file, account_seed, 0600)
+	was := cfg.Firecracker
+	t.Cleanup(func() { cfg.Firecracker = was })
+	cfg.Firecracker.HostId = "h1"
+	cfg.Firecracker.NatsAccountSeedFile = seed_file
+	cfg.Firecracker.NatsIssuerAccount = ""
+
+	srv, e := server.NewServer(&server.Options{
+		Host:             "127.0.0.1",
+		Port:             -1,
+		NoLog:            true,
+		NoSigs:           true,
+		TrustedOperators: []*jwt.OperatorClaims{op_claims},
+		AccountResolver:  resolver,
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats-server didn't start")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	user, _ := nkeys.CreateUser()
+	user_pub, _ := user.PublicKey()
+	user_seed, _ := user.Seed()
+	user_jwt, e := jwt.NewUserClaims(user_pub).Encode(account)
+	if e != nil {
+		t.Fatal(e)
+	}
+	observer, e := nats.Connect(srv.ClientURL(), nats.UserJWTAndSeed(user_jwt, string(user_seed)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(observer.Close)
+	return &creds_server{t: t, srv: srv, observer: observer}
+}
+
+// agent_conn is a connection with an agent's minted credentials, which keeps
+// the permission violations the server tells it about.
+type agent_conn struct {
+	t          *testing.T
+	nc         *nats.Conn
+	violations chan string
+}
+
+// connect_agent connects with credentials minted for the agent.
+func (cs *creds_server) connect_agent(tenant, agent string) *agent_conn {
+	cs.t.Helper()
+	user_jwt, user_seed, _, e := mint_agent_creds(tenant, agent)
+	if e != nil {
+		cs.t.Fatal(e)
+	}
+	return cs.connect(user_jwt, user_seed, agent_inbox_prefix(tenant, agent))
+}
+
+// connect
+func (cs *creds_server) connect(user_jwt, user_seed, inbox_prefix string) *agent_conn {
+	cs.t.Helper()
+	a := &agent_conn{t: cs.t, violations: make(chan string, 100)}
+	nc, e := nats.Connect(cs.srv.ClientURL(),
+		nats.UserJWTAndSeed(user_jwt, user_seed),
+		nats.CustomInboxPrefix(inbox_prefix),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, e error) {
+			a.violations <- e.Error()
+		}))
+	if e != nil {
+		cs.t.Fatal(e)
+	}
+	cs.t.Cleanup(nc.Close)
+	a.nc = nc
+	return a
+}
+
+// can_publish reports whether the observer gets what the agent publishes on
+// subject, or the server refuses it.
+func (cs *creds_server) can_publish(a *agent_conn, subject string) bool {
+	cs.t.Helper()
+	got := make(chan *nats.Msg, 1)
+	sub, e := cs.observer.ChanSubscribe(subject, got)
+	if e != nil {
+		cs.t.Fatal(e)
+	}
+	defer sub.Unsubscribe()
+	cs.observer.Flush()
+	a.nc.Publish(subject, []byte("x"))
+	return a.outcome("publish", subject, got)
+}
+
+// can_subscribe reports whether the agent gets what the observer publishes on
+// subject, or the server refuses the subscription.
+func (cs *creds_server) can_subscribe(a *agent_conn, subject string) bool {
+	cs.t.Helper()
+	got := make(chan *nats.Msg, 1)
+	sub, e := a.nc.ChanSubscribe(subject, got)
+	if e != nil {
+		cs.t.Fatal(e)
+	}
+	defer sub.Unsubscribe()
+	a.nc.Flush()
+	cs.observer.Publish(subject, []byte("x"))
+	return a.outcome("subscription", subject, got)
+}
+
+// outcome waits for the message to get through, or for the server to say it
+// refused what on subject. Neither is a failure of the test.
+func (a *agent_conn) outcome(what, subject string, got chan *nats.Msg) bool {
+	a.t.Helper()
+	refused := strings.ToLower(fmt.Sprintf("permissions violation for %s to %q", what, subject))
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-got:
+			return true
+		case v := <-a.violations:
+			if strings.Contains(strings.ToLower(v), refused) {
+				return false
+			}
+		case <-deadline:
+			a.t.Fatalf("%s to %s neither got through nor was refused", what, subject)
+		}
+	}
+}
+
+// An agent's minted credentials let it use its own subjects, consumers and
+// inbox, and nobody else's.
+func TestAgentPermissions(t *testing.T) {
+	cs := new_creds_server(t)
+	a := cs.connect_agent("t1", "a1")
+
+	for _, c := range []struct {
+		subject string
+		want    bool
+	}{
+		{"firecracker.host.h1", true},
+		{"firecracker.heartbeat.h1.t1.a1", true},
+		{"firecracker.exec.t1.a1.d41f09c2.out", true},
+		{"$JS.API.STREAM.INFO.AGENT_SENTENCES", true},
+		{"$JS.API.CONSUMER.CREATE.AGENT_SENTENCES.sentences_t1_a1.agent.sentences.t1.a1", true},
+		{"$JS.API.CONSUMER.CREATE.AGENT_SENTENCES.sentences_t1_a1_ephemeral.agent.sentences.t1.a1", true},
+		{"$JS.API.CONSUMER.MSG.NEXT.AGENT_SENTENCES.sentences_t1_a1", true},
+		{"$JS.ACK.AGENT_SENTENCES.sentences_t1_a1.1.5.5.1700000000000000000.0", true},
+		{"agent.deadletter.t1.a1", true},
+
+		{"firecracker.host.h2", false},
+		{"firecracker.heartbeat.h1.t1.a2", false},
+		{"firecracker.heartbeat.h2.t1.a1", false},
+		{"firecracker.exec.t1.a2.d41f09c2.out", false},
+		{"firecracker.agent.t1.a2", false},
+		{"agent.sentences.t1.a2", false},
+		{"$JS.API.CONSUMER.CREATE.AGENT_SENTENCES.sentences_t1_a2.agent.sentences.t1.a2", false},
+		{"$JS.API.CONSUMER.CREATE.AGENT_SENTENCES.sentences_t1_a1.agent.sentences.>", false},
+		{"$JS.API.CONSUMER.CREATE.AGENT_SENTENCES.sentences_t1_a1", false},
+		{"$JS.API.CONSUMER.MSG.NEXT.AGENT_SENTENCES.sentences_t1_a2", false},
+		{"$JS.API.CONSUMER.DELETE.AGENT_SENTENCES.sentences_t1_a2", false},
+		{"$JS.ACK.AGENT_SENTENCES.sentences_t1_a2.1.5.5.1700000000000000000.0", false},
+		{"$JS.API.STREAM.DELETE.AGENT_SENTENCES", false},
+		{"agent.deadletter.t1.a2", false},
+	} {
+		if got := cs.can_publish(a, c.subject); got != c.want {
+			t.Errorf("publish to %s: %v, want %v", c.subject, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		subject string
+		want    bool
+	}{
+		{"firecracker.agent.t1.a1", true},
+		{"firecracker.agent.t1.a1.sentences", true},
+		{"_INBOX_t1_a1.abc", true},
+		{"firecracker.exec.t1.a1.d41f09c2.in", true},
+		{"firecracker.file.t1.a1.9a0b77cc.in", true},
+
+		{"firecracker.agent.t1.a2", false},
+		{"firecracker.agent.t1.*", false},
+		{"_INBOX_t1_a2.abc", false},
+		{"_INBOX.abc", false},
+		{"firecracker.exec.t1.a2.d41f09c2.in", false},
+		{"firecracker.host.h1", false},
+		{"firecracker.host.*", false},
+		{"firecracker.heartbeat.h1.t1.a2", false},
+		{"agent.sentences.t1.a1", false},
+	} {
+		if got := cs.can_subscribe(a, c.subject); got != c.want {
+			t.Errorf("subscribe to %s: %v, want %v", c.subject, got, c.want)
+		}
+	}
+
+	// A request through its own inbox gets its answer.
+	cs.observer.Subscribe("firecracker.host.h1", func(m *nats.Msg) { m.Respond([]byte("pong")) })
+	cs.observer.Flush()
+	if m, e := a.nc.Request("firecracker.host.h1", []byte("ping"), 2*time.Second); e != nil || string(m.Data) != "pong" {
+		t.Errorf("request through the agent's inbox: %v", e)
+	}
+}
+
+// Running guests get new credentials once theirs are in the last third of their
+// lifetime, while the old ones still work, and not before.
+func TestRotateAgentCreds(t *testing.T) {
+	cs := new_creds_server(t)
+	cfg.Firecracker.NatsCredsTtl = "1h"
+	cfg.Firecracker.UnixSocketPrefix = filepath.Join(t.TempDir(), "fc.sock")
+	t.Cleanup(func() { clear(agent_creds_expiry) })
+
+	// The guest's MMDS, which only takes patches.
+	var mu sync.Mutex
+	patches := []map[string]any{}
+	l, e := net.Listen("unix", cfg.Firecracker.UnixSocketPrefix+".3")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Secrets map[string]any `json:"secrets"`
+		}
+		if r.Method != "PATCH" || r.URL.Path != "/mmds" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(400)
+			return
+		}
+		mu.Lock()
+		patches = append(patches, body.Secrets)
+		mu.Unlock()
+		w.WriteHeader(204)
+	}))
+	t.Cleanup(func() { l.Close() })
+	got := func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]any{}, patches...)
+	}
+
+	defined := []datamodel.FirecrackerSlot{{Tenant: "t1", Agent: "a1", Slot: 3}, {Tenant: "t1", Agent: "a2", Slot: 4}}
+	running := []FirecrackerProc{{Slot: 3}}
+
+	// After a restart we don't know what the guest has, so it gets new ones.
+	rotate_agent_creds(defined, running)
+	if len(got()) != 1 {
+		t.Fatalf("%d patches", len(got()))
+	}
+	if _, ok := agent_creds_expiry[4]; ok {
+		t.Errorf("minted credentials for a slot that isn't running")
+	}
+	first, _ := got()[0]["nats-jwt"].(string)
+	rotate_agent_creds(defined, running)
+	if len(got()) != 1 {
+		t.Fatalf("rotated credentials with most of their life left")
+	}
+
+	// Near the end of their life, they're swapped while they still work.
+	agent_creds_expiry[3] = time.Now().Add(10 * time.Minute)
+	rotate_agent_creds(defined, running)
+	if len(got()) != 2 {
+		t.Fatalf("%d patches", len(got()))
+	}
+	p := got()[1]
+	second, _ := p["nats-jwt"].(string)
+	seed, _ := p["nats-seed"].(string)
+	if second == first || p["nats-inbox-prefix"] != "_INBOX_t1_a1" {
+		t.Errorf("patch %v", p)
+	}
+	claims, e := jwt.DecodeUserClaims(second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if exp := time.Unix(claims.Expires, 0); time.Until(exp) < 59*time.Minute || !exp.Equal(agent_creds_expiry[3].Truncate(time.Second)) {
+		t.Errorf("new credentials expire at %s, recorded %s", exp, agent_creds_expiry[3])
+	}
+	if exp, _ := time.Parse(time.RFC3339, p["nats-creds-expire"].(string)); exp.Unix() != claims.Expires {
+		t.Errorf("nats-creds-expire is %s", p["nats-creds-expire"])
+	}
+
+	// and they work.
+	a := cs.connect(second, seed, "_INBOX_t1_a1")
+	if !cs.can_publish(a, "firecracker.heartbeat.h1.t1.a1") {
+		t.Errorf("the new credentials don't work")
+	}
+
+	// A guest that's stopped is forgotten.
+	rotate_agent_creds(defined, nil)
+	if _, ok := agent_creds_expiry[3]; ok {
+		t.Errorf("still remembers a stopped guest")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+/* Operator keys for remote exec and file transfers in guests.
+ *
+ * exec-keys-file works like ssh-keys-file (see ssh_keys.go), except that the
+ * keys are operators' user nkeys (U...). Each guest gets the unexpired ones
+ * that apply to it in MMDS under "exec-keys", and guest_daemon runs commands,
+ * and moves files where guest-files allows, for requests signed with one of
+ * them. It reports every request it starts, finishes or turns away as an
+ * "exec" or "file" audit event.
+ */
+
+import (
+	"encoding/json"
+	"log"
+	"sdp/datamodel"
+)
+
+// agent_exec_keys_sent remembers, per slot, the key list we last put into MMDS.
+var agent_exec_keys_sent = map[int]string{}
+
+// agent_exec_keys_mmds is the "exec-keys" list for a guest we're about to boot.
+func agent_exec_keys_mmds(slot *datamodel.FirecrackerSlot) []guest_key {
+	return agent_keys_mmds(cfg.Firecracker.ExecKeysFile, agent_exec_keys_sent, slot)
+}
+
+// sync_agent_exec_keys patches MMDS for every running guest whose key list has
+// changed.
+func sync_agent_exec_keys(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) {
+	sync_agent_keys("exec-keys", cfg.Firecracker.ExecKeysFile, agent_exec_keys_sent, defined, running)
+}
+
+// process_exec_audit logs a guest's report of an exec request and forwards it to
+// the firecracker log topic.
+func process_exec_audit(data []byte) {
+	var a struct {
+		Agent    string   `json:"agent"`
+		Tenant   string   `json:"tenant"`
+		Action   string   `json:"action"`
+		Id       string   `json:"id"`
+		Operator string   `json:"operator"`
+		Command  string   `json:"command"`
+		Args     []string `json:"args"`
+		Status   int      `json:"status"`
+		Error    string   `json:"error"`
+	}
+	if e := json.Unmarshal(data, &a); e != nil {
+		log.Printf("bad exec report: %s", e)
+		return
+	}
+	switch {
+	case a.Action == "finished":
+		log.Printf("AUDIT agent %s, tenant %s: exec %s by %s finished, status %d %s", a.Agent, a.Tenant, a.Id, a.Operator, a.Status, a.Error)
+	case a.Error != "":
+		log.Printf("AUDIT agent %s, tenant %s: exec %s %s, %s", a.Agent, a.Tenant, a.Id, a.Action, a.Error)
+	default:
+		log.Printf("AUDIT agent %s, tenant %s: exec %s %s by %s: %s %q", a.Agent, a.Tenant, a.Id, a.Action, a.Operator, a.Command, a.Args)
+	}
+	forward_audit(data)
+}
+
+// process_file_audit logs a guest's report of a file transfer and forwards it to
+// the firecracker log topic.
+func process_file_audit(data []byte) {
+	var a struct {
+		Agent     string `json:"agent"`
+		Tenant    string `json:"tenant"`
+		Action    string `json:"action"`
+		Id        string `json:"id"`
+		Operator  string `json:"operator"`
+		Direction string `json:"direction"`
+		Path      string `json:"path"`
+		Size      int64  `json:"size"`
+		Sha256    string `json:"sha256"`
+		Error     string `json:"error"`
+	}
+	if e := json.Unmarshal(data, &a); e != nil {
+		log.Printf("bad file report: %s", e)
+		return
+	}
+	if a.Error != "" {
+		log.Printf("AUDIT agent %s, tenant %s: file %s %s %s by %s, %s: %s", a.Agent, a.Tenant, a.Id, a.Direction, a.Action, a.Operator, a.Path, a.Error)
+	} else {
+		log.Printf("AUDIT agent %s, tenant %s: file %s %s %s by %s, %s, %d bytes %s", a.Agent, a.Tenant, a.Id, a.Direction, a.Action, a.Operator, a.Path, a.Size, a.Sha256)
+	}
+	forward_audit(data)
+}
@@ -0,0 +1,211 @@
+package main
+
+/* Heartbeats from our guests.
+ *
+ * guest_daemon in each guest publishes a heartbeat on
+ * firecracker.heartbeat.<host>.<tenant>.<agent> every 30 seconds or so: uptime,
+ * load, memory, disks, the state of the app's systemd units, guest_sentences'
+ * backlog and its own version (see guest_daemon/heartbeat.go). We only
+ * subscribe to our own host's. We keep the latest from each of our guests for
+ * the lifecycle status, and judge the agent's health from it:
+ *
+ *   ok          the app is running and there's room
+ *   stopping    guest_daemon said it was shutting down
+ *   app-down    one of the app's units isn't active, or doesn't exist
+ *   disk-full   a disk has less than HEARTBEAT_LOW_DISK of its space left
+ *   low-memory  less than HEARTBEAT_LOW_MEMORY of memory is available
+ *   missing     the guest is running but no heartbeat has come for three
+ *               intervals, or ever, HEARTBEAT_GRACE after it started
+ *
+ * We log whenever an agent's health changes.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	HEARTBEAT_LOW_DISK   = 0.05
+	HEARTBEAT_LOW_MEMORY = 0.05
+	HEARTBEAT_GRACE      = 2 * time.Minute
+
+	// HEARTBEAT_DEFAULT_INTERVAL is for a heartbeat that doesn't say.
+	HEARTBEAT_DEFAULT_INTERVAL = 30 * time.Second
+)
+
+// agent_heartbeat is the part of a guest's heartbeat we look at, plus our
+// judgement of it.
+type agent_heartbeat struct {
+	Agent    string    `json:"agent"`
+	Tenant   string    `json:"tenant"`
+	Host     string    `json:"host"`
+	Version  string    `json:"version"`
+	State    string    `json:"state"`
+	Interval float64   `json:"interval"`
+	Uptime   float64   `json:"uptime"`
+	Load     []float64 `json:"load"`
+	Memory   struct {
+		Total     int64 `json:"total"`
+		Available int64 `json:"available"`
+	} `json:"memory"`
+	Disks []struct {
+		Path      string `json:"path"`
+		Total     int64  `json:"total"`
+		Available int64  `json:"available"`
+	} `json:"disks"`
+	Apps []struct {
+		Unit     string `json:"unit"`
+		Load     string `json:"load"`
+		Active   string `json:"active"`
+		Sub      string `json:"sub"`
+		Restarts int    `json:"restarts"`
+	} `json:"apps"`
+	Sentences []struct {
+		Subscription string `json:"subscription"`
+		BacklogFiles int    `json:"backlog_files"`
+		BacklogBytes int64  `json:"backlog_bytes"`
+		HeldOff      string `json:"held_off"`
+	} `json:"sentences"`
+	Errors []string  `json:"errors,omitempty"`
+	Time   time.Time `json:"time"`
+
+	// These are ours.
+	Received time.Time `json:"received"`
+	Health   string    `json:"health"`
+	Why      string    `json:"why,omitempty"`
+}
+
+var (
+	agent_heartbeats_mu sync.Mutex
+	agent_heartbeats    = map[string]agent_heartbeat{}
+	agent_health        = map[string]string{}
+	agent_first_running = map[string]time.Time{}
+)
+
+// process_heartbeat runs on the subscription's goroutine, for each heartbeat
+// from a guest on this host. What it says about itself has to match the subject.
+func process_heartbeat(m *nats.Msg) {
+	var h agent_heartbeat
+	if e := json.Unmarshal(m.Data, &h); e != nil {
+		log.Printf("bad heartbeat on %s: %s", m.Subject, e)
+		return
+	}
+	want := fmt.Sprintf("firecracker.heartbeat.%s.%s.%s", cfg.Firecracker.HostId, h.Tenant, h.Agent)
+	if m.Subject != want || h.Host != cfg.Firecracker.HostId {
+		log.Printf("REJECTED heartbeat on %s from agent %s, tenant %s, host %s", m.Subject, h.Agent, h.Tenant, h.Host)
+		return
+	}
+	if e := verify_guest_report(m, h.Agent); e != nil {
+		log.Printf("REJECTED heartbeat claiming agent %s: %s", h.Agent, e)
+		return
+	}
+	h.Received = time.Now().UTC()
+	h.Health, h.Why = heartbeat_health(&h)
+
+	agent_heartbeats_mu.Lock()
+	defer agent_heartbeats_mu.Unlock()
+	agent_heartbeats[h.Agent] = h
+	note_agent_health(h.Agent, h.Tenant, h.Health, h.Why)
+}
+
+// heartbeat_health judges an agent from its heartbeat, and says why.
+func heartbeat_health(h *agent_heartbeat) (string, string) {
+	if h.State == "stopping" {
+		return "stopping", ""
+	}
+	for _, a := range h.Apps {
+		if a.Load == "unknown" {
+			// guest_daemon couldn't ask systemd; it says why in Errors
+			continue
+		}
+		if a.Load != "loaded" || (a.Active != "active" && a.Active != "reloading") {
+			return "app-down", a.Unit + " is " + a.Load + ", " + a.Active + ", " + a.Sub
+		}
+	}
+	for _, d := range h.Disks {
+		if d.Total > 0 && float64(d.Available) < HEARTBEAT_LOW_DISK*float64(d.Total) {
+			return "disk-full", d.Path
+		}
+	}
+	if h.Memory.Total > 0 && float64(h.Memory.Available) < HEARTBEAT_LOW_MEMORY*float64(h.Memory.Total) {
+		return "low-memory", ""
+	}
+	return "ok", ""
+}
+
+// note_agent_health logs an agent's health if it has changed. Call it with
+// agent_heartbeats_mu held.
+func note_agent_health(agent, tenant, health, why string) {
+	if agent_health[agent] == health {
+		return
+	}
+	agent_health[agent] = health
+	who := "agent " + agent
+	if tenant != "" {
+		who += ", tenant " + tenant
+	}
+	if why != "" {
+		log.Printf("%s: health %s, %s", who, health, why)
+	} else {
+		log.Printf("%s: health %s", who, health)
+	}
+}
+
+// agent_heartbeat_status returns the latest heartbeat from each running agent,
+// and a "missing" one for each running agent that has gone quiet. It forgets
+// the agents that aren't running.
+func agent_heartbeat_status(running []FirecrackerProc) map[string]agent_heartbeat {
+	agent_heartbeats_mu.Lock()
+	defer agent_heartbeats_mu.Unlock()
+
+	now := time.Now()
+	is_running := map[string]bool{}
+	out := map[string]agent_heartbeat{}
+	for _, p := range running {
+		if p.Agent == "" {
+			continue
+		}
+		is_running[p.Agent] = true
+		if _, ok := agent_first_running[p.Agent]; !ok {
+			agent_first_running[p.Agent] = now
+		}
+
+		h, ok := agent_heartbeats[p.Agent]
+		interval := HEARTBEAT_DEFAULT_INTERVAL
+		if h.Interval > 0 {
+			interval = time.Duration(h.Interval * float64(time.Second))
+		}
+		switch {
+		case ok && now.Sub(h.Received) <= 3*interval:
+		case !ok && now.Sub(agent_first_running[p.Agent]) <= HEARTBEAT_GRACE:
+			continue
+		default:
+			h.Agent = p.Agent
+			h.Health, h.Why = "missing", ""
+			note_agent_health(h.Agent, h.Tenant, h.Health, h.Why)
+		}
+		out[p.Agent] = h
+	}
+
+	for agent := range agent_first_running {
+		if !is_running[agent] {
+			delete(agent_first_running, agent)
+		}
+	}
+	for agent := range agent_heartbeats {
+		if !is_running[agent] {
+			delete(agent_heartbeats, agent)
+		}
+	}
+	for agent := range agent_health {
+		if !is_running[agent] {
+			delete(agent_health, agent)
+		}
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package main
+
+/* Signed identity documents for guests, see guest_identity.
+ *
+ * With host-key-seed-file configured, every guest we boot gets a document
+ * signed with this host's nkey, plus the seed of a key pair made for that boot,
+ * in MMDS under "identity". Services that trust our public key can then verify
+ * that a message came from a particular guest on this host.
+ *
+ * We use it ourselves: reports that guests send to our subject have to carry a
+ * valid signature from one of our guests, and the agent in the report has to
+ * match the agent in the document.
+ *
+ * Documents expire, so while a guest runs we give it a new one, and a new boot
+ * key, through MMDS when a third of the old one's life is left.
+ */
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"guest_identity"
+	"log"
+	"os"
+	"sdp/datamodel"
+	"strings"
+	"time"
+)
+
+// identity_enabled
+func identity_enabled() bool {
+	return cfg.Firecracker.HostKeySeedFile != ""
+}
+
+// read_host_key loads this host's signing key, a server nkey.
+func read_host_key() (nkeys.KeyPair, error) {
+	d, e := os.ReadFile(cfg.Firecracker.HostKeySeedFile)
+	if e != nil {
+		return nil, e
+	}
+	return nkeys.FromSeed([]byte(strings.TrimSpace(string(d))))
+}
+
+// agent_identity_expiry and agent_boot_times remember, per slot, when the
+// document we last gave that guest expires and when the guest booted. After a
+// restart we know neither, so every document gets reissued on the first
+// lifecycle pass, with the time of that as the boot time.
+var (
+	agent_identity_expiry = map[int]time.Time{}
+	agent_boot_times      = map[int]time.Time{}
+)
+
+// guest_identity_mmds issues a document for a guest that booted at boot_time.
+func guest_identity_mmds(slot *datamodel.FirecrackerSlot, boot_time time.Time) (map[string]any, error) {
+	if !identity_enabled() {
+		return map[string]any{}, nil
+	}
+	host_key, e := read_host_key()
+	if e != nil {
+		return nil, e
+	}
+	defer host_key.Wipe()
+
+	token, seed, e := guest_identity.Issue(host_key, guest_identity.Document{
+		Host:     cfg.Firecracker.HostId,
+		Tenant:   slot.Tenant,
+		Agent:    slot.Agent,
+		Slot:     slot.Slot,
+		BootTime: boot_time,
+		Expires:  time.Now().Add(guest_identity.DOCUMENT_TTL).UTC(),
+	})
+	if e != nil {
+		return nil, e
+	}
+	agent_boot_times[slot.Slot] = boot_time
+	agent_identity_expiry[slot.Slot] = time.Now().Add(guest_identity.DOCUMENT_TTL)
+	return map[string]any{
+		"token": token,
+		"seed":  seed,
+	}, nil
+}
+
+// rotate_agent_identities gives each running guest a new document before its
+// old one expires, as rotate_agent_creds does for credentials.
+func rotate_agent_identities(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) {
+	if !identity_enabled() {
+		return
+	}
+	renew_before := guest_identity.DOCUMENT_TTL / 3
+
+	for _, d := range defined {
+		runs := false
+		for _, r := range running {
+			if d.Slot == r.Slot {
+				runs = true
+				break
+			}
+		}
+		if !runs {
+			delete(agent_identity_expiry, d.Slot)
+			delete(agent_boot_times, d.Slot)
+			continue
+		}
+		if exp, ok := agent_identity_expiry[d.Slot]; ok && time.Until(exp) > renew_before {
+			continue
+		}
+
+		boot_time, ok := agent_boot_times[d.Slot]
+		if !ok {
+			boot_time = time.Now().UTC()
+		}
+		identity, e := guest_identity_mmds(&d, boot_time)
+		if e != nil {
+			log.Printf("FAILED to issue an identity document for slot %d, %s", d.Slot, e)
+			continue
+		}
+		api_sock := fmt.Sprintf("%s.%d", cfg.Firecracker.UnixSocketPrefix, d.Slot)
+		if _, _, _, e := CurlPatchJSONMap("http://localhost/mmds", api_sock, map[string]any{
+			"identity": identity,
+		}); e != nil {
+			log.Printf("FAILED to renew the identity document for slot %d, %s", d.Slot, e)
+			delete(agent_identity_expiry, d.Slot)
+			continue
+		}
+		log.Printf("renewed the identity document for slot %d, agent %s", d.Slot, d.Agent)
+	}
+}
+
+// verify_guest_report checks the signature on a report from one of our guests.
+// With identities turned off there's nothing to check against, so every report
+// passes, as it did before.
+func verify_guest_report(m *nats.Msg, agent string) error {
+	if !identity_enabled() {
+		return nil
+	}
+	host_key, e := read_host_key()
+	if e != nil {
+		return e
+	}
+	pub, e := host_key.PublicKey()
+	host_key.Wipe()
+	if e != nil {
+		return e
+	}
+
+	doc, e := guest_identity.VerifyMsg(m, guest_identity.Trust{cfg.Firecracker.HostId: pub})
+	if e != nil {
+		return e
+	}
+	if doc.Agent != agent {
+		return fmt.Errorf("report for agent %s signed by agent %s", agent, doc.Agent)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+/* Keys for encrypting sentences at rest in guests, see guest_sentences.
+ *
+ * With sentence-key-file configured, each guest gets a 32-byte AES key in MMDS
+ * under "sentences-key", base64. The key is derived from the secret in that file
+ * and the tenant and agent, so the agent gets the same key every boot, and on
+ * every host that shares the secret, and can still read sentences it persisted
+ * before a restart. Nothing needs storing per agent.
+ */
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sdp/datamodel"
+	"strings"
+)
+
+// agent_sentence_key is "" when sentence keys are turned off.
+func agent_sentence_key(slot *datamodel.FirecrackerSlot) (string, error) {
+	if cfg.Firecracker.SentenceKeyFile == "" {
+		return "", nil
+	}
+	d, e := os.ReadFile(cfg.Firecracker.SentenceKeyFile)
+	if e != nil {
+		return "", e
+	}
+	secret := []byte(strings.TrimSpace(string(d)))
+	if len(secret) < 32 {
+		return "", fmt.Errorf("%s: the secret needs at least 32 bytes", cfg.Firecracker.SentenceKeyFile)
+	}
+
+	// The NULs keep tenant "a.b" agent "c" apart from tenant "a" agent "b.c".
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("sentences\x00" + slot.Tenant + "\x00" + slot.Agent))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+/* What guest_sentences tells us about each agent's sentences.
+ *
+ * Every minute or so each guest sends a "sentences" report: per subscription,
+ * how many sentences it persisted, failed to persist, quarantined, and had
+ * rejected by user code in that interval, how many sit in its quarantine, and
+ * its status: connection, consumer, sequences, lag and local backlog. We log the
+ * ones with trouble in them, and keep the latest from each agent for the
+ * lifecycle status, which goes to the firecracker log topic.
+ *
+ * From the status we judge each subscription's health:
+ *
+ *   ok        sentences are flowing, or there are none
+ *   slow      the agent isn't taking its sentences, so guest_sentences held off
+ *   broken    not connected, no consumer, or sentences waiting in the stream
+ *             and none arriving
+ */
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// SENTENCES_REPORT_TTL is how long a report stays in the status. A guest that
+// has stopped reporting has probably stopped.
+var SENTENCES_REPORT_TTL = 5 * time.Minute
+
+// sentences_report is what guest_sentences sends, see guest_sentences/report.go.
+type sentences_report struct {
+	Agent         string                   `json:"agent"`
+	Tenant        string                   `json:"tenant"`
+	Interval      float64                  `json:"interval"`
+	Received      time.Time                `json:"received"`
+	Subscriptions []sentences_subscription `json:"subscriptions"`
+}
+
+// sentences_subscription is one subscription in a report.
+type sentences_subscription struct {
+	Name              string `json:"name"`
+	Persisted         int64  `json:"persisted"`
+	Failed            int64  `json:"failed"`
+	Quarantined       int64  `json:"quarantined"`
+	Rejected          int64  `json:"rejected"`
+	QuarantineDepth   int    `json:"quarantine_depth"`
+	DeadLetterPending int    `json:"dead_letter_pending"`
+	Status            struct {
+		Consumer         string    `json:"consumer"`
+		Connection       string    `json:"connection"`
+		Reconnects       uint64    `json:"reconnects"`
+		HighestPersisted uint64    `json:"highest_persisted"`
+		LastFetched      uint64    `json:"last_fetched"`
+		NumPending       int64     `json:"num_pending"`
+		BacklogFiles     int       `json:"backlog_files"`
+		BacklogBytes     int64     `json:"backlog_bytes"`
+		HeldOff          string    `json:"held_off"`
+		FetchErrors      uint64    `json:"fetch_errors"`
+		LastMessage      time.Time `json:"last_message,omitzero"`
+		Updated          time.Time `json:"updated"`
+	} `json:"status"`
+
+	// Health is ours, see sentences_health.
+	Health string `json:"health"`
+}
+
+// sentences_health judges a subscription from its report. A guest too old to send a
+// status gets "ok" if it's not reporting trouble.
+func sentences_health(s *sentences_subscription) string {
+	st := &s.Status
+	switch {
+	case st.Updated.IsZero():
+		return "ok"
+	case st.Connection != "connected" || st.Consumer == "":
+		return "broken"
+	case st.HeldOff != "":
+		return "slow"
+	case st.NumPending > 0 && s.Persisted == 0 && s.Quarantined == 0:
+		return "broken"
+	}
+	return "ok"
+}
+
+var (
+	agent_sentences_mu sync.Mutex
+	agent_sentences    = map[string]sentences_report{}
+)
+
+// process_sentences_report
+func process_sentences_report(data []byte) {
+	var r sentences_report
+	if e := json.Unmarshal(data, &r); e != nil {
+		log.Printf("bad sentences report: %s", e)
+		return
+	}
+	r.Received = time.Now().UTC()
+	for i := range r.Subscriptions {
+		s := &r.Subscriptions[i]
+		s.Health = sentences_health(s)
+		switch s.Health {
+		case "broken":
+			log.Printf("agent %s, tenant %s, %s: sentences pipeline broken: connection %s, consumer %q, %d pending, %d fetch errors",
+				r.Agent, r.Tenant, s.Name, s.Status.Connection, s.Status.Consumer, s.Status.NumPending, s.Status.FetchErrors)
+		case "slow":
+			log.Printf("agent %s, tenant %s, %s: agent is slow taking sentences: %s, %d files, %d bytes waiting",
+				r.Agent, r.Tenant, s.Name, s.Status.HeldOff, s.Status.BacklogFiles, s.Status.BacklogBytes)
+		}
+		if s.Failed > 0 || s.Quarantined > 0 || s.Rejected > 0 || s.DeadLetterPending > 0 {
+			log.Printf("agent %s, tenant %s, %s: %d sentences failed, %d quarantined, %d rejected in %.0fs; %d in quarantine, %d not yet dead-lettered",
+				r.Agent, r.Tenant, s.Name, s.Failed, s.Quarantined, s.Rejected, r.Interval, s.QuarantineDepth, s.DeadLetterPending)
+		}
+	}
+
+	agent_sentences_mu.Lock()
+	agent_sentences[r.Agent] = r
+	agent_sentences_mu.Unlock()
+}
+
+// agent_sentences_status returns the recent reports, by agent, and forgets old ones.
+func agent_sentences_status() map[string]sentences_report {
+	agent_sentences_mu.Lock()
+	defer agent_sentences_mu.Unlock()
+	out := map[string]sentences_report{}
+	for agent, r := range agent_sentences {
+		if time.Since(r.Received) > SENTENCES_REPORT_TTL {
+			delete(agent_sentences, agent)
+			continue
+		}
+		out[agent] = r
+	}
+	return out
+}
@@ -0,0 +1,176 @@
+package main
+
+/* Operator SSH keys for guests.
+ *
+ * The keys live in the JSON file named by ssh-keys-file, which we re-read on
+ * every lifecycle pass so keys can be granted and revoked without restarting
+ * the daemon. Each entry names an operator, a public key, an expiry, and
+ * optionally the tenants and agents it applies to (empty means all).
+ *
+ * Each guest gets the unexpired keys that apply to it in MMDS under "ssh-keys",
+ * at boot and again whenever its list changes. guest_daemon installs them into
+ * root's authorized_keys and sends back an "ssh-key" audit report for every key
+ * it adds or removes.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"log"
+	"os"
+	"sdp/datamodel"
+	"slices"
+	"time"
+)
+
+// key_grant is one entry in the ssh keys file, or the exec keys file.
+type key_grant struct {
+	Operator string    `json:"operator"`
+	Key      string    `json:"key"`
+	Expires  time.Time `json:"expires"`
+	Tenants  []string  `json:"tenants"`
+	Agents   []string  `json:"agents"`
+}
+
+// guest_key is what a guest sees in MMDS.
+type guest_key struct {
+	Operator string    `json:"operator"`
+	Key      string    `json:"key"`
+	Expires  time.Time `json:"expires"`
+}
+
+// agent_ssh_keys_sent remembers, per slot, the key list we last put into MMDS.
+var agent_ssh_keys_sent = map[int]string{}
+
+// read_key_grants returns nothing, without complaint, when no file is configured.
+func read_key_grants(file string) ([]key_grant, error) {
+	grants := []key_grant{}
+	if file == "" {
+		return grants, nil
+	}
+	d, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	if e := json.Unmarshal(d, &grants); e != nil {
+		return nil, fmt.Errorf("%s: %w", file, e)
+	}
+	return grants, nil
+}
+
+// agent_keys picks out the grants that apply to an agent and haven't expired.
+// A grant without an expiry is ignored: every key has to run out sometime.
+func agent_keys(grants []key_grant, slot *datamodel.FirecrackerSlot) []guest_key {
+	now := time.Now()
+	out := []guest_key{}
+	for _, g := range grants {
+		if g.Expires.IsZero() || !now.Before(g.Expires) {
+			continue
+		}
+		if len(g.Tenants) > 0 && !slices.Contains(g.Tenants, slot.Tenant) {
+			continue
+		}
+		if len(g.Agents) > 0 && !slices.Contains(g.Agents, slot.Agent) {
+			continue
+		}
+		out = append(out, guest_key{g.Operator, g.Key, g.Expires})
+	}
+	return out
+}
+
+// agent_keys_mmds is the key list from file for a guest we're about to boot.
+// sent remembers it, for sync_agent_keys.
+func agent_keys_mmds(file string, sent map[int]string, slot *datamodel.FirecrackerSlot) []guest_key {
+	grants, e := read_key_grants(file)
+	if e != nil {
+		log.Printf("FAILED to read %s, %s", file, e)
+	}
+	keys := agent_keys(grants, slot)
+	j, _ := json.Marshal(keys)
+	sent[slot.Slot] = string(j)
+	return keys
+}
+
+// agent_ssh_keys_mmds is the "ssh-keys" list for a guest we're about to boot.
+func agent_ssh_keys_mmds(slot *datamodel.FirecrackerSlot) []guest_key {
+	return agent_keys_mmds(cfg.Firecracker.SshKeysFile, agent_ssh_keys_sent, slot)
+}
+
+// sync_agent_ssh_keys patches MMDS for every running guest whose key list has
+// changed, because the file changed or a key expired.
+func sync_agent_ssh_keys(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) {
+	sync_agent_keys("ssh-keys", cfg.Firecracker.SshKeysFile, agent_ssh_keys_sent, defined, running)
+}
+
+// sync_agent_keys patches the MMDS list called name, from file, for every running
+// guest whose list isn't what we last sent it.
+func sync_agent_keys(name string, file string, sent map[int]string, defined []datamodel.FirecrackerSlot, running []FirecrackerProc) {
+	grants, e := read_key_grants(file)
+	if e != nil {
+		// Better to leave the guests' keys alone than to revoke everything
+		// because of a typo in the file. Expiry is also enforced in the guest.
+		log.Printf("FAILED to read %s, %s", file, e)
+		return
+	}
+
+	for _, d := range defined {
+		runs := false
+		for _, r := range running {
+			if d.Slot == r.Slot {
+				runs = true
+				break
+			}
+		}
+		if !runs {
+			delete(sent, d.Slot)
+			continue
+		}
+
+		keys := agent_keys(grants, &d)
+		j, _ := json.Marshal(keys)
+		if was, ok := sent[d.Slot]; ok && was == string(j) {
+			continue
+		}
+
+		api_sock := fmt.Sprintf("%s.%d", cfg.Firecracker.UnixSocketPrefix, d.Slot)
+		if _, _, _, e := CurlPatchJSONMap("http://localhost/mmds", api_sock, map[string]any{
+			name: keys,
+		}); e != nil {
+			log.Printf("FAILED to update %s for slot %d, %s", name, d.Slot, e)
+			continue
+		}
+		sent[d.Slot] = string(j)
+		log.Printf("updated %s for slot %d, agent %s, %d keys", name, d.Slot, d.Agent, len(keys))
+	}
+}
+
+// process_ssh_key_audit logs a guest's report of an authorized_keys change and
+// forwards it to the firecracker log topic, where audit events are kept.
+func process_ssh_key_audit(data []byte) {
+	var a struct {
+		Agent       string `json:"agent"`
+		Tenant      string `json:"tenant"`
+		Action      string `json:"action"`
+		Operator    string `json:"operator"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	if e := json.Unmarshal(data, &a); e != nil {
+		log.Printf("bad ssh key report: %s", e)
+		return
+	}
+	log.Printf("AUDIT agent %s, tenant %s: ssh key %s, %s %s", a.Agent, a.Tenant, a.Action, a.Operator, a.Fingerprint)
+	forward_audit(data)
+}
+
+// forward_audit sends a guest's audit report on to the firecracker log topic.
+func forward_audit(data []byte) {
+	msg := kafka.Message{
+		Key:   []byte(cfg.Firecracker.HostId),
+		Value: data,
+	}
+	if e := firecracker_log_producer.WriteMessages(context.Background(), msg); e != nil {
+		log.Printf("? %s", e)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+/* Multi-tenancy on a firecracker host.
+ *
+ * Every slot belongs to a tenant, which comes from the firecracker_slot table.
+ * The tenant is passed into the guest (boot args and MMDS) and is part of every
+ * NATS subject that concerns an agent, so one tenant's guests can't wander into
+ * another tenant's traffic.
+ *
+ * On this host we enforce per-tenant limits on slot count, vCPUs and memory,
+ * and keep guests of different tenants from reaching each other through the
+ * FC-TENANTS iptables chain. create_taps.sh creates that chain and hooks it into
+ * FORWARD at boot; we keep its contents in step with the running guests, and
+ * bring it up to date before each guest boots. Guests are told apart by their
+ * tap (tap<slot>), not their IP address, which a guest can change.
+ *
+ * The tenant needs sdp/datamodel with FirecrackerSlot.Tenant, read from the
+ * tenant column of firecracker_slot. Older versions of datamodel won't build
+ * with this daemon. Slots with no tenant, such as those from before tenants,
+ * are in DEFAULT_TENANT, which is what every guest used to be told.
+ */
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sdp/datamodel"
+	"sort"
+	"strings"
+)
+
+const (
+	TENANT_CHAIN   = "FC-TENANTS"
+	TENANT_BRIDGE  = "fire0"
+	DEFAULT_TENANT = "0"
+)
+
+// tenant_limits is the per-tenant section of the config. A zero Max value means
+// no limit. Vcpus and MemMib are what each of the tenant's guests gets.
+type tenant_limits struct {
+	MaxSlots  int `json:"max-slots"`
+	MaxVcpus  int `json:"max-vcpus"`
+	MaxMemMib int `json:"max-mem-mib"`
+	Vcpus     int `json:"vcpus"`
+	MemMib    int `json:"mem-mib"`
+}
+
+// tenant_usage is what a tenant currently has running on this host.
+type tenant_usage struct {
+	Slots  int
+	Vcpus  int
+	MemMib int
+}
+
+var (
+	tenant_firewall_applied bool
+	last_tenant_firewall    string
+)
+
+// valid_subject_token reports whether s can be used as a single token in a NATS
+// subject. Tenant and agent ids both end up in subjects, so a dot or a wildcard
+// in one of them would let a guest see traffic that isn't its own.
+func valid_subject_token(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+// default_tenants puts slots without a tenant in DEFAULT_TENANT.
+func default_tenants(slots []datamodel.FirecrackerSlot) {
+	for i := range slots {
+		if slots[i].Tenant == "" {
+			slots[i].Tenant = DEFAULT_TENANT
+		}
+	}
+}
+
+// get_tenant_limits returns the configured limits for a tenant, falling back to
+// default-tenant-limits, with the historical 2 vCPU / 512 MiB guest size.
+func get_tenant_limits(tenant string) tenant_limits {
+	l, ok := cfg.Firecracker.Tenants[tenant]
+	if !ok {
+		l = cfg.Firecracker.DefaultTenantLimits
+	}
+	if l.Vcpus == 0 {
+		l.Vcpus = 2
+	}
+	if l.MemMib == 0 {
+		l.MemMib = 512
+	}
+	return l
+}
+
+// get_tenant_usage adds up the guests that are defined and actually running.
+// Running guests that aren't defined any more are about to be stopped, and
+// we don't know their tenant anyway, so they don't count.
+func get_tenant_usage(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) map[string]*tenant_usage {
+	out := map[string]*tenant_usage{}
+	for _, d := range defined {
+		for _, r := range running {
+			if d.Slot == r.Slot {
+				add_tenant_usage(out, &d)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// add_tenant_usage
+func add_tenant_usage(usage map[string]*tenant_usage, slot *datamodel.FirecrackerSlot) {
+	u, ok := usage[slot.Tenant]
+	if !ok {
+		u = &tenant_usage{}
+		usage[slot.Tenant] = u
+	}
+	l := get_tenant_limits(slot.Tenant)
+	u.Slots++
+	u.Vcpus += l.Vcpus
+	u.MemMib += l.MemMib
+}
+
+// admit_slot decides whether we may start this slot. If so, the slot is
+// added to the usage so the next decision sees it.
+func admit_slot(slot *datamodel.FirecrackerSlot, usage map[string]*tenant_usage) error {
+	if !valid_subject_token(slot.Tenant) {
+		return fmt.Errorf("slot %d has bad tenant %q", slot.Slot, slot.Tenant)
+	}
+	if !valid_subject_token(slot.Agent) {
+		return fmt.Errorf("slot %d has bad agent %q", slot.Slot, slot.Agent)
+	}
+
+	l := get_tenant_limits(slot.Tenant)
+	u := tenant_usage{}
+	if p, ok := usage[slot.Tenant]; ok {
+		u = *p
+	}
+	if l.MaxSlots > 0 && u.Slots+1 > l.MaxSlots {
+		return fmt.Errorf("tenant %s is at its limit of %d slots", slot.Tenant, l.MaxSlots)
+	}
+	if l.MaxVcpus > 0 && u.Vcpus+l.Vcpus > l.MaxVcpus {
+		return fmt.Errorf("tenant %s would exceed its limit of %d vcpus", slot.Tenant, l.MaxVcpus)
+	}
+	if l.MaxMemMib > 0 && u.MemMib+l.MemMib > l.MaxMemMib {
+		return fmt.Errorf("tenant %s would exceed its limit of %d MiB", slot.Tenant, l.MaxMemMib)
+	}
+
+	add_tenant_usage(usage, slot)
+	return nil
+}
+
+// tenant_firewall_guests maps the slot of each defined guest that's running
+// to its tenant.
+func tenant_firewall_guests(defined []datamodel.FirecrackerSlot, running []FirecrackerProc) map[int]string {
+	out := map[int]string{}
+	for _, d := range defined {
+		for _, r := range running {
+			if d.Slot == r.Slot {
+				out[d.Slot] = d.Tenant
+				break
+			}
+		}
+	}
+	return out
+}
+
+// tenant_firewall_rules is the FC-TENANTS chain for these guests, as
+// iptables-restore input. Bridged traffic from a tap is dropped unless it goes
+// to the tap of a guest of the same tenant. Traffic routed back onto the bridge
+// is dropped too, so a guest can't get around that through the host. Anything
+// else, such as traffic to the outside, goes back to FORWARD.
+func tenant_firewall_rules(guests map[int]string) []string {
+	slots := []int{}
+	for slot := range guests {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+
+	rules := []string{
+		fmt.Sprintf("-A %s -i %s -o %s -m physdev ! --physdev-is-bridged -j DROP", TENANT_CHAIN, TENANT_BRIDGE, TENANT_BRIDGE),
+		fmt.Sprintf("-A %s -m physdev ! --physdev-is-bridged -j RETURN", TENANT_CHAIN),
+	}
+	for _, a := range slots {
+		for _, b := range slots {
+			if a != b && guests[a] == guests[b] {
+				rules = append(rules, fmt.Sprintf("-A %s -m physdev --physdev-in tap%d --physdev-out tap%d -j ACCEPT", TENANT_CHAIN, a, b))
+			}
+		}
+	}
+	return append(rules, fmt.Sprintf("-A %s -m physdev --physdev-is-bridged -j DROP", TENANT_CHAIN))
+}
+
+// apply_tenant_firewall replaces the FC-TENANTS chain with the rules for these
+// guests, in one iptables-restore, so there's never a moment when the chain is
+// empty or half written. We only touch iptables when the rules change.
+func apply_tenant_firewall(guests map[int]string) error {
+	if !cfg.Firecracker.TenantFirewall {
+		return nil
+	}
+
+	rules := tenant_firewall_rules(guests)
+	signature := strings.Join(rules, "\n")
+	if tenant_firewall_applied && signature == last_tenant_firewall {
+		return nil
+	}
+
+	// With --noflush, iptables-restore leaves the rest of the table alone and
+	// empties just the chains it's given before filling them.
+	input := "*filter\n:" + TENANT_CHAIN + " - [0:0]\n" + signature + "\nCOMMIT\n"
+	if e := run_iptables_restore(input); e != nil {
+		tenant_firewall_applied = false
+		return fmt.Errorf("replacing %s: %w", TENANT_CHAIN, e)
+	}
+	last_tenant_firewall = signature
+	tenant_firewall_applied = true
+	log.Printf("tenant firewall updated, %d guests, %d rules", len(guests), len(rules))
+	return nil
+}
+
+// run_iptables_restore feeds input to the configured iptables-restore command.
+// The daemon usually isn't root, so the config typically says something like
+// ["sudo", "-n", "iptables-restore"].
+func run_iptables_restore(input string) error {
+	command := cfg.Firecracker.IptablesRestoreCommand
+	if len(command) == 0 {
+		command = []string{"iptables-restore"}
+	}
+	c := exec.Command(command[0], append(command[1:], "--noflush")...)
+	c.Stdin = strings.NewReader(input)
+	if out, e := c.CombinedOutput(); e != nil {
+		return fmt.Errorf("%s: %s", e, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
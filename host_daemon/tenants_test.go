@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sdp/datamodel"
+	"testing"
+)
+
+// A slot from before tenants is admitted in DEFAULT_TENANT, and tenants stop at
+// their limits.
+func TestAdmitSlot(t *testing.T) {
+	was := cfg.Firecracker
+	t.Cleanup(func() { cfg.Firecracker = was })
+	cfg.Firecracker.Tenants = map[string]tenant_limits{
+		DEFAULT_TENANT: {MaxSlots: 2},
+		"acme":         {MaxVcpus: 4, MaxMemMib: 2048, Vcpus: 2, MemMib: 1024},
+	}
+	cfg.Firecracker.DefaultTenantLimits = tenant_limits{MaxSlots: 1}
+
+	slots := []datamodel.FirecrackerSlot{
+		{Agent: "a1", Slot: 1},
+		{Agent: "a2", Slot: 2},
+		{Agent: "a3", Slot: 3},
+		{Agent: "b1", Slot: 4, Tenant: "acme"},
+		{Agent: "b2", Slot: 5, Tenant: "acme"},
+		{Agent: "b3", Slot: 6, Tenant: "acme"},
+		{Agent: "c1", Slot: 7, Tenant: "other"},
+		{Agent: "c2", Slot: 8, Tenant: "other"},
+	}
+	default_tenants(slots)
+	if slots[0].Tenant != DEFAULT_TENANT || slots[3].Tenant != "acme" {
+		t.Fatalf("tenants %q and %q", slots[0].Tenant, slots[3].Tenant)
+	}
+
+	// Slot 1 is running already.
+	usage := get_tenant_usage(slots, []FirecrackerProc{{Slot: 1}})
+	for i, want := range []bool{true, false, true, true, false, true, false} {
+		s := &slots[i+1]
+		if e := admit_slot(s, usage); (e == nil) != want {
+			t.Errorf("slot %d, tenant %s: %v", s.Slot, s.Tenant, e)
+		}
+	}
+
+	if u := usage["acme"]; u == nil || u.Slots != 2 || u.Vcpus != 4 || u.MemMib != 2048 {
+		t.Errorf("acme usage %+v", u)
+	}
+	if u := usage[DEFAULT_TENANT]; u == nil || u.Slots != 2 {
+		t.Errorf("%s usage %+v", DEFAULT_TENANT, u)
+	}
+
+	for _, bad := range []datamodel.FirecrackerSlot{
+		{Agent: "x", Slot: 9, Tenant: "a.b"},
+		{Agent: "x", Slot: 9, Tenant: "*"},
+		{Agent: "a.>", Slot: 9, Tenant: "acme2"},
+		{Agent: "", Slot: 9, Tenant: "acme2"},
+	} {
+		if e := admit_slot(&bad, usage); e == nil {
+			t.Errorf("admitted %+v", bad)
+		}
+	}
+}
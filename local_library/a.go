@@ -0,0 +1,246 @@
+package local_library
+
+/* Functions for agents running as firecracker guests, starting with reading
+ * the sentence files guest_sentences leaves in /opt/agentsentences.
+ *
+ * guest_sentences can compress sentences and encrypt them at rest. An encoded
+ * file starts with a 14-byte header:
+ *
+ *   "NGS\x01"          magic and version
+ *   1 byte             compression: 0 none, 1 gzip, 2 zstd
+ *   1 byte             cipher: 0 none, 1 AES-256-GCM
+ *   8 bytes            the stream sequence, big-endian, as in the file name
+ *
+ * followed, with a cipher, by a 12-byte nonce and the sealed body, with the
+ * header as additional data; or without one, by the body. The body is the
+ * payload, compressed if the header says so.
+ *
+ * With encoding turned off, files are the plain payload, with no header. We
+ * never guess which kind a file is from its first bytes, since a payload can
+ * start with anything: guest_sentences leaves its encoding in ENCODING_FILE
+ * when it's on, and ReadSentence goes by that.
+ *
+ * The key is per agent. guest_sentences gets it from the host at boot and
+ * leaves it in KEY_FILE, which is on tmpfs, readable by the agent group if
+ * guest_sentences has one, and otherwise only by root.
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAGIC       = "NGS\x01"
+	HEADER_SIZE = 14
+
+	COMPRESS_NONE = 0
+	COMPRESS_GZIP = 1
+	COMPRESS_ZSTD = 2
+
+	CIPHER_NONE   = 0
+	CIPHER_AES256 = 1
+)
+
+// KEY_FILE holds the agent's sentence key, base64. ENCODING_FILE holds the
+// encoding, as in a sidecar, e.g. "zstd+aes-256-gcm", and is only there while
+// encoding is on.
+var (
+	KEY_FILE      = "/run/ngen/sentences.key"
+	ENCODING_FILE = "/run/ngen/sentences.encoding"
+)
+
+// COMPRESSIONS and CIPHERS map config names to header values.
+var (
+	COMPRESSIONS = map[string]byte{"": COMPRESS_NONE, "none": COMPRESS_NONE, "gzip": COMPRESS_GZIP, "zstd": COMPRESS_ZSTD}
+	CIPHERS      = map[string]byte{"": CIPHER_NONE, "none": CIPHER_NONE, "aes-256-gcm": CIPHER_AES256}
+)
+
+// Encode wraps a payload for sequence seq. With no compression and no cipher
+// it returns the payload as it is.
+func Encode(payload []byte, seq uint64, compression byte, ciph byte, key []byte) ([]byte, error) {
+	if compression == COMPRESS_NONE && ciph == CIPHER_NONE {
+		return payload, nil
+	}
+	header := make([]byte, HEADER_SIZE)
+	copy(header, MAGIC)
+	header[4], header[5] = compression, ciph
+	binary.BigEndian.PutUint64(header[6:], seq)
+
+	body, e := compress(payload, compression)
+	if e != nil {
+		return nil, e
+	}
+	switch ciph {
+	case CIPHER_NONE:
+		return append(header, body...), nil
+	case CIPHER_AES256:
+		gcm, e := new_gcm(key)
+		if e != nil {
+			return nil, e
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, e := rand.Read(nonce); e != nil {
+			return nil, e
+		}
+		out := append(header, nonce...)
+		return gcm.Seal(out, nonce, body, header), nil
+	}
+	return nil, fmt.Errorf("unknown cipher %d", ciph)
+}
+
+// Decode returns the payload in an encoded sentence. data must have the header,
+// and with a key it must be encrypted. If seq isn't 0, it must match the
+// sequence in the header, which catches one file being swapped for another.
+func Decode(data []byte, seq uint64, key []byte) ([]byte, error) {
+	if len(data) < HEADER_SIZE || string(data[:4]) != MAGIC {
+		return nil, errors.New("not an encoded sentence")
+	}
+	header, body := data[:HEADER_SIZE], data[HEADER_SIZE:]
+	if got := binary.BigEndian.Uint64(header[6:]); seq != 0 && got != seq {
+		return nil, fmt.Errorf("sentence %d is labeled %d", seq, got)
+	}
+
+	switch header[5] {
+	case CIPHER_NONE:
+		if key != nil {
+			return nil, errors.New("sentence isn't encrypted")
+		}
+	case CIPHER_AES256:
+		gcm, e := new_gcm(key)
+		if e != nil {
+			return nil, e
+		}
+		if len(body) < gcm.NonceSize() {
+			return nil, errors.New("sentence too short")
+		}
+		body, e = gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], header)
+		if e != nil {
+			return nil, errors.New("sentence fails authentication, wrong key or tampered with")
+		}
+	default:
+		return nil, fmt.Errorf("unknown cipher %d", header[5])
+	}
+	return decompress(body, header[4])
+}
+
+// ReadSentence reads a sentence file and, if guest_sentences says encoding is
+// on, decodes it, with the key from KEY_FILE if it's encrypted.
+func ReadSentence(path string) ([]byte, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	encoding, e := ReadEncoding()
+	if e != nil || encoding == "" {
+		return data, e
+	}
+	var key []byte
+	if strings.Contains(encoding, "aes-256-gcm") {
+		if key, e = ReadKey(); e != nil {
+			return nil, e
+		}
+	}
+	return Decode(data, SequenceOf(path), key)
+}
+
+// ReadEncoding returns the encoding from ENCODING_FILE, or "" if encoding is off.
+func ReadEncoding() (string, error) {
+	d, e := os.ReadFile(ENCODING_FILE)
+	if errors.Is(e, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(d)), e
+}
+
+// ReadKey reads the agent's sentence key from KEY_FILE.
+func ReadKey() ([]byte, error) {
+	d, e := os.ReadFile(KEY_FILE)
+	if e != nil {
+		return nil, e
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(d)))
+}
+
+// SequenceOf returns the sequence in an as-<seq>.bin file name, or 0.
+func SequenceOf(path string) uint64 {
+	base := filepath.Base(path)
+	if !strings.HasPrefix(base, "as-") || !strings.HasSuffix(base, ".bin") {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(base, "as-"), ".bin"), 10, 64)
+	return n
+}
+
+// new_gcm
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("sentence key must be 32 bytes, not %d", len(key))
+	}
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+// compress
+func compress(data []byte, compression byte) ([]byte, error) {
+	switch compression {
+	case COMPRESS_NONE:
+		return data, nil
+	case COMPRESS_GZIP:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, e := w.Write(data); e != nil {
+			return nil, e
+		}
+		if e := w.Close(); e != nil {
+			return nil, e
+		}
+		return b.Bytes(), nil
+	case COMPRESS_ZSTD:
+		w, e := zstd.NewWriter(nil)
+		if e != nil {
+			return nil, e
+		}
+		defer w.Close()
+		return w.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
+
+// decompress
+func decompress(data []byte, compression byte) ([]byte, error) {
+	switch compression {
+	case COMPRESS_NONE:
+		return data, nil
+	case COMPRESS_GZIP:
+		r, e := gzip.NewReader(bytes.NewReader(data))
+		if e != nil {
+			return nil, e
+		}
+		return io.ReadAll(r)
+	case COMPRESS_ZSTD:
+		r, e := zstd.NewReader(nil)
+		if e != nil {
+			return nil, e
+		}
+		defer r.Close()
+		return r.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %d", compression)
+}
@@ -0,0 +1,135 @@
+package local_library
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// test_key
+func test_key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// Every compression, with and without encryption, comes back as it went in.
+func TestRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat("the quick brown fox ", 50))
+	for name, compression := range map[string]byte{"none": COMPRESS_NONE, "gzip": COMPRESS_GZIP, "zstd": COMPRESS_ZSTD} {
+		for _, ciph := range []byte{CIPHER_NONE, CIPHER_AES256} {
+			var key []byte
+			if ciph == CIPHER_AES256 {
+				key = test_key(1)
+				name += "+aes-256-gcm"
+			}
+			if compression == COMPRESS_NONE && ciph == CIPHER_NONE {
+				// That's a plain file, see TestPlain.
+				continue
+			}
+			t.Run(name, func(t *testing.T) {
+				d, e := Encode(payload, 42, compression, ciph, key)
+				if e != nil {
+					t.Fatal(e)
+				}
+				if string(d[:4]) != MAGIC || d[4] != compression || d[5] != ciph {
+					t.Fatalf("header % x", d[:HEADER_SIZE])
+				}
+				got, e := Decode(d, 42, key)
+				if e != nil {
+					t.Fatal(e)
+				}
+				if !bytes.Equal(got, payload) {
+					t.Errorf("got %q", got)
+				}
+			})
+		}
+	}
+}
+
+// With encoding off, the file is the payload, whatever it starts with.
+func TestPlain(t *testing.T) {
+	payload := []byte(MAGIC + "\x07\x07 not really a header")
+	d, e := Encode(payload, 42, COMPRESS_NONE, CIPHER_NONE, nil)
+	if e != nil || !bytes.Equal(d, payload) {
+		t.Fatalf("got %q, %v", d, e)
+	}
+}
+
+// Decode refuses what it shouldn't open.
+func TestDecodeRefuses(t *testing.T) {
+	key := test_key(1)
+	sealed, e := Encode([]byte("secret"), 42, COMPRESS_ZSTD, CIPHER_AES256, key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	unsealed, e := Encode([]byte("not secret"), 42, COMPRESS_GZIP, CIPHER_NONE, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	relabeled := bytes.Clone(sealed)
+	relabeled[HEADER_SIZE-1] ^= 1
+
+	for _, c := range []struct {
+		what string
+		data []byte
+		seq  uint64
+		key  []byte
+	}{
+		{"wrong key", sealed, 42, test_key(2)},
+		{"no key", sealed, 42, nil},
+		{"wrong seq", sealed, 43, key},
+		{"relabeled", relabeled, 0, key},
+		{"tampered", tampered, 42, key},
+		{"truncated body", sealed[:HEADER_SIZE+5], 42, key},
+		{"truncated header", sealed[:HEADER_SIZE-1], 42, key},
+		{"empty", nil, 42, key},
+		{"plain with a key", []byte("hello"), 42, key},
+		{"unencrypted with a key", unsealed, 42, key},
+		{"plain", []byte("hello"), 42, nil},
+		{"truncated gzip", unsealed[:len(unsealed)-4], 42, nil},
+	} {
+		if got, e := Decode(c.data, c.seq, c.key); e == nil {
+			t.Errorf("%s: got %q", c.what, got)
+		}
+	}
+}
+
+// ReadSentence goes by ENCODING_FILE, not by what's in the file.
+func TestReadSentence(t *testing.T) {
+	dir := t.TempDir()
+	KEY_FILE = filepath.Join(dir, "sentences.key")
+	ENCODING_FILE = filepath.Join(dir, "sentences.encoding")
+	key := test_key(3)
+	os.WriteFile(KEY_FILE, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+
+	path := filepath.Join(dir, "as-00000000000000000042.bin")
+	payload := []byte(MAGIC + "\x01\x01 a payload that looks encoded")
+
+	// Encoding off.
+	os.WriteFile(path, payload, 0600)
+	if got, e := ReadSentence(path); e != nil || !bytes.Equal(got, payload) {
+		t.Errorf("plain: got %q, %v", got, e)
+	}
+
+	// Encoding on: the plain file is refused, an encoded one is read.
+	os.WriteFile(ENCODING_FILE, []byte("zstd+aes-256-gcm\n"), 0644)
+	if got, e := ReadSentence(path); e == nil {
+		t.Errorf("plain with encoding on: got %q", got)
+	}
+	d, _ := Encode(payload, 42, COMPRESS_ZSTD, CIPHER_AES256, key)
+	os.WriteFile(path, d, 0600)
+	if got, e := ReadSentence(path); e != nil || !bytes.Equal(got, payload) {
+		t.Errorf("encoded: got %q, %v", got, e)
+	}
+
+	// Moved to another sequence.
+	other := filepath.Join(dir, "as-00000000000000000043.bin")
+	os.Rename(path, other)
+	if got, e := ReadSentence(other); e == nil {
+		t.Errorf("moved: got %q", got)
+	}
+}
@@ -0,0 +1,5 @@
+module local_library
+
+go 1.25.4
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,25 @@
+package main
+
+/* read_sentence writes the decoded payload of a sentence file to stdout, for
+ * agents that aren't written in Go:
+ *
+ *   read_sentence /opt/agentsentences/as-00000000000000000042.bin
+ */
+
+import (
+	"local_library"
+	"log"
+	"os"
+)
+
+// main
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <sentence file>", os.Args[0])
+	}
+	d, e := local_library.ReadSentence(os.Args[1])
+	if e != nil {
+		log.Fatal(e)
+	}
+	os.Stdout.Write(d)
+}
@@ -0,0 +1,252 @@
+package nats_connect
+
+/* The one way our daemons connect to NATS.
+ *
+ * host_daemon, guest_daemon, guest_sentences and guest_network all used to call
+ * nats.Connect with a bare URL. This package turns a "nats-connection" config
+ * section into the full set of options: TLS with a CA bundle and client cert,
+ * a creds file or nkey seed, a connection name that says who we are, reconnect
+ * backoff, and callbacks that log errors and disconnects and count them.
+ *
+ * Every field is optional. An empty Config gives a plain connection that
+ * reconnects forever with backoff.
+ *
+ * Guests can't read files off the host, so the certificates can also be given
+ * inline as PEM text, which is how host_daemon passes them through MMDS.
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"log"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the "nats-connection" section of a daemon's config.
+type Config struct {
+	// TLS. The *File fields name files; the others carry the PEM text itself.
+	CaFile   string `json:"ca-file"`
+	Ca       string `json:"ca"`
+	CertFile string `json:"cert-file"`
+	KeyFile  string `json:"key-file"`
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+
+	// Authentication. Use one or the other.
+	CredsFile    string `json:"creds-file"`
+	NkeySeedFile string `json:"nkey-seed-file"`
+
+	// Reconnect backoff, as Go durations. The delay doubles from the min
+	// to the max, with some jitter. MaxReconnects left out, or -1, means
+	// forever, and 0 means never.
+	ReconnectWaitMin string `json:"reconnect-wait-min"`
+	ReconnectWaitMax string `json:"reconnect-wait-max"`
+	MaxReconnects    *int   `json:"max-reconnects"`
+}
+
+// Stats counts connection events for this process. It's meant to be reported
+// alongside whatever status the daemon already emits.
+type Stats struct {
+	Connects    uint64 `json:"connects"`
+	Disconnects uint64 `json:"disconnects"`
+	Reconnects  uint64 `json:"reconnects"`
+	Errors      uint64 `json:"errors"`
+	Closed      uint64 `json:"closed"`
+}
+
+var stats struct {
+	connects    atomic.Uint64
+	disconnects atomic.Uint64
+	reconnects  atomic.Uint64
+	errors      atomic.Uint64
+	closed      atomic.Uint64
+}
+
+// GetStats
+func GetStats() Stats {
+	return Stats{
+		Connects:    stats.connects.Load(),
+		Disconnects: stats.disconnects.Load(),
+		Reconnects:  stats.reconnects.Load(),
+		Errors:      stats.errors.Load(),
+		Closed:      stats.closed.Load(),
+	}
+}
+
+// Connect connects to url with the options from c. The name shows up in the
+// server's connection list, so it should say which daemon and which host or
+// agent we are. Extra options are applied last and win.
+func Connect(url string, c *Config, name string, extra ...nats.Option) (*nats.Conn, error) {
+	opts, e := Options(c, name)
+	if e != nil {
+		return nil, e
+	}
+	nc, e := nats.Connect(url, append(opts, extra...)...)
+	if e != nil {
+		stats.errors.Add(1)
+		return nil, e
+	}
+	stats.connects.Add(1)
+	log.Printf("nats connected to %s as %q", nc.ConnectedUrlRedacted(), name)
+	return nc, nil
+}
+
+// Drain stops nc's subscriptions, lets their handlers finish, flushes what we've
+// published and closes it, giving up and closing it anyway after timeout. It's
+// for a daemon that's shutting down; nc.Drain on its own doesn't wait.
+func Drain(nc *nats.Conn, timeout time.Duration) error {
+	if nc == nil || nc.IsClosed() {
+		return nil
+	}
+	if e := nc.Drain(); e != nil {
+		nc.Close()
+		return e
+	}
+	deadline := time.Now().Add(timeout)
+	for !nc.IsClosed() {
+		if time.Now().After(deadline) {
+			nc.Close()
+			return fmt.Errorf("nats drain timed out after %s", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+// Options builds the nats options for c. A nil c is the same as an empty one.
+func Options(c *Config, name string) ([]nats.Option, error) {
+	if c == nil {
+		c = &Config{}
+	}
+
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.CustomReconnectDelay(reconnect_delay(c)),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, e error) {
+			stats.disconnects.Add(1)
+			if e != nil {
+				log.Printf("nats %q disconnected: %s", name, e)
+			} else {
+				log.Printf("nats %q disconnected", name)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			stats.reconnects.Add(1)
+			log.Printf("nats %q reconnected to %s", name, nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			stats.closed.Add(1)
+			log.Printf("nats %q closed", name)
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, e error) {
+			stats.errors.Add(1)
+			if sub != nil {
+				log.Printf("nats %q error on %s: %s", name, sub.Subject, e)
+			} else {
+				log.Printf("nats %q error: %s", name, e)
+			}
+		}),
+	}
+
+	if c.MaxReconnects == nil || *c.MaxReconnects < 0 {
+		opts = append(opts, nats.MaxReconnects(-1))
+	} else {
+		opts = append(opts, nats.MaxReconnects(*c.MaxReconnects))
+	}
+
+	if t, e := tls_config(c); e != nil {
+		return nil, e
+	} else if t != nil {
+		opts = append(opts, nats.Secure(t))
+	}
+
+	switch {
+	case c.CredsFile != "" && c.NkeySeedFile != "":
+		return nil, fmt.Errorf("nats connection has both a creds file and an nkey seed file")
+	case c.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	case c.NkeySeedFile != "":
+		o, e := nats.NkeyOptionFromSeed(c.NkeySeedFile)
+		if e != nil {
+			return nil, e
+		}
+		opts = append(opts, o)
+	}
+
+	return opts, nil
+}
+
+// tls_config returns nil if nothing TLS-related is configured.
+func tls_config(c *Config) (*tls.Config, error) {
+	ca := []byte(c.Ca)
+	if c.CaFile != "" {
+		d, e := os.ReadFile(c.CaFile)
+		if e != nil {
+			return nil, e
+		}
+		ca = d
+	}
+
+	cert, key := []byte(c.Cert), []byte(c.Key)
+	if c.CertFile != "" || c.KeyFile != "" {
+		var e error
+		if cert, e = os.ReadFile(c.CertFile); e != nil {
+			return nil, e
+		}
+		if key, e = os.ReadFile(c.KeyFile); e != nil {
+			return nil, e
+		}
+	}
+
+	if len(ca) == 0 && len(cert) == 0 {
+		return nil, nil
+	}
+
+	t := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in nats CA bundle")
+		}
+		t.RootCAs = pool
+	}
+	if len(cert) > 0 {
+		pair, e := tls.X509KeyPair(cert, key)
+		if e != nil {
+			return nil, fmt.Errorf("nats client certificate: %w", e)
+		}
+		t.Certificates = []tls.Certificate{pair}
+	}
+	return t, nil
+}
+
+// reconnect_delay doubles the wait on each attempt, from 500ms up to 30s unless
+// configured otherwise, plus up to 20% jitter so a fleet of guests doesn't
+// come back all at once.
+func reconnect_delay(c *Config) func(int) time.Duration {
+	min, max := 500*time.Millisecond, 30*time.Second
+	if d, e := time.ParseDuration(c.ReconnectWaitMin); e == nil && d > 0 {
+		min = d
+	}
+	if d, e := time.ParseDuration(c.ReconnectWaitMax); e == nil && d > 0 {
+		max = d
+	}
+	if max < min {
+		max = min
+	}
+	return func(attempts int) time.Duration {
+		d := min
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d + time.Duration(rand.Int63n(int64(d)/5+1))
+	}
+}